@@ -0,0 +1,466 @@
+package alert
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+const (
+	atag           = "alert"
+	CHECK_INTERVAL = 1 * time.Second // frequency to check for rules with a minimum duration
+	DEDUP_WINDOW   = 5 * time.Minute // default window to suppress identical alerts
+	SINK_QUEUE_LEN = 100             // number of alerts to buffer for each sink
+	INCIDENT_RULE  = "incident"      // rule name of the alerts about incidents
+)
+
+// An alert is fired when the inferred status of a subject crosses
+// the severity threshold of a rule, or recovers from it
+type Alert struct {
+	Rule      string    `json:"rule"`
+	Subject   string    `json:"subject"`
+	Metric    string    `json:"metric"`
+	Status    string    `json:"status"`
+	Previous  string    `json:"previous"`
+	Score     float32   `json:"score"`
+	Observers []string  `json:"observers"`
+	Members   []string  `json:"members,omitempty"` // failed members of an incident
+	Since     time.Time `json:"since"`             // when the subject entered the status
+	Time      time.Time `json:"time"`              // when the alert is fired
+	Resolved  bool      `json:"resolved"`
+}
+
+type AlertRule struct {
+	Name        string
+	Subject     *regexp.Regexp
+	Metric      string
+	Severity    pb.Status
+	MinDuration time.Duration
+	Sinks       []string
+}
+
+type ruleKey struct {
+	rule    string
+	subject string
+	metric  string
+}
+
+type ruleState struct {
+	status    pb.Status
+	previous  pb.Status
+	score     float32
+	observers []string
+	since     time.Time
+	fired     bool // the failing state has lasted long enough
+	notified  bool // an alert was sent for the failing state
+}
+
+type dedupKey struct {
+	ruleKey
+	status   pb.Status
+	resolved bool
+}
+
+type AlertManager struct {
+	Rules []*AlertRule
+	Sinks map[string]Sink
+
+	states      map[ruleKey]*ruleState
+	sent        map[dedupKey]time.Time
+	dedupWindow time.Duration
+	queues      map[string]chan *Alert
+	silencer    dt.HealthSilencer
+	incidents   *IncidentDetector
+	mu          *sync.Mutex
+	alive       bool
+	stopc       chan bool
+	workers     sync.WaitGroup // the delivery and check goroutines
+}
+
+var _ dt.InferenceListener = new(AlertManager)
+var _ dt.IncidentListener = new(AlertManager)
+
+func NewAlertRule(config *dt.AlertRuleConfig) (*AlertRule, error) {
+	rule := &AlertRule{
+		Name:        config.Name,
+		Metric:      config.Metric,
+		MinDuration: time.Duration(config.MinDuration) * time.Second,
+		Sinks:       config.Sinks,
+	}
+	if len(config.Subject) > 0 {
+		re, err := regexp.Compile(config.Subject)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid subject pattern in rule %s: %s", config.Name, err)
+		}
+		rule.Subject = re
+	}
+	if len(config.Severity) > 0 {
+		rule.Severity = dt.StatusFromFullStr(config.Severity)
+		if rule.Severity == pb.Status_INVALID {
+			return nil, fmt.Errorf("Invalid severity %s in rule %s", config.Severity, config.Name)
+		}
+	} else {
+		rule.Severity = pb.Status_UNHEALTHY
+	}
+	return rule, nil
+}
+
+// Check if the rule applies to a metric of a subject
+func (self *AlertRule) Match(subject string, metric string) bool {
+	if self.Subject != nil && !self.Subject.MatchString(subject) {
+		return false
+	}
+	return len(self.Metric) == 0 || self.Metric == metric
+}
+
+func NewAlertManager(config *dt.AlertingConfig) (*AlertManager, error) {
+	manager := &AlertManager{
+		Sinks:       make(map[string]Sink),
+		states:      make(map[ruleKey]*ruleState),
+		sent:        make(map[dedupKey]time.Time),
+		dedupWindow: DEDUP_WINDOW,
+		queues:      make(map[string]chan *Alert),
+		mu:          &sync.Mutex{},
+	}
+	if config.DedupWindow > 0 {
+		manager.dedupWindow = time.Duration(config.DedupWindow) * time.Second
+	}
+	for _, sc := range config.Sinks {
+		if _, ok := manager.Sinks[sc.Name]; ok {
+			return nil, fmt.Errorf("Duplicate alert sink %s", sc.Name)
+		}
+		sink, err := NewSink(sc)
+		if err != nil {
+			return nil, err
+		}
+		manager.Sinks[sc.Name] = sink
+	}
+	for _, rc := range config.Rules {
+		rule, err := NewAlertRule(rc)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range rule.Sinks {
+			if _, ok := manager.Sinks[name]; !ok {
+				return nil, fmt.Errorf("Unknown sink %s in rule %s", name, rule.Name)
+			}
+		}
+		manager.Rules = append(manager.Rules, rule)
+	}
+	return manager, nil
+}
+
+// Add a sink to the manager, must be called before Start
+func (self *AlertManager) AddSink(name string, sink Sink) {
+	self.Sinks[name] = sink
+}
+
+// Use silencer to suppress alerts about subjects under maintenance
+func (self *AlertManager) SetSilencer(silencer dt.HealthSilencer) {
+	self.silencer = silencer
+}
+
+// Replace the alerts about subjects failing together with one alert
+// about the incident
+func (self *AlertManager) SetIncidentDetector(detector *IncidentDetector) {
+	self.incidents = detector
+	detector.AddListener(self)
+}
+
+func (self *AlertManager) Start() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.alive {
+		return fmt.Errorf("AlertManager is already started")
+	}
+	self.alive = true
+	self.stopc = make(chan bool)
+	for name, sink := range self.Sinks {
+		queue := make(chan *Alert, SINK_QUEUE_LEN)
+		self.queues[name] = queue
+		self.workers.Add(1)
+		go self.deliver(name, sink, queue)
+	}
+	self.workers.Add(1)
+	go self.check(self.stopc)
+	return nil
+}
+
+// Stop after the queued alerts are delivered
+func (self *AlertManager) Stop() error {
+	self.mu.Lock()
+	if !self.alive {
+		self.mu.Unlock()
+		return nil
+	}
+	self.alive = false
+	close(self.stopc)
+	for name, queue := range self.queues {
+		close(queue)
+		delete(self.queues, name)
+	}
+	self.mu.Unlock()
+	self.workers.Wait()
+	return nil
+}
+
+func (self *AlertManager) OnInference(inf *pb.Inference) {
+	if inf == nil || inf.Observation == nil {
+		return
+	}
+	now := time.Now()
+	if self.silencer != nil && self.silencer.MatchSubject(inf.Subject, now) != nil {
+		du.LogD(atag, "%s is under maintenance, skip alerting", inf.Subject)
+		return
+	}
+	if self.incidents != nil && self.incidents.Covers(inf.Subject) {
+		du.LogD(atag, "%s is part of an incident, skip alerting", inf.Subject)
+		return
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for name, metric := range inf.Observation.Metrics {
+		if metric.Value == nil {
+			continue
+		}
+		for _, rule := range self.Rules {
+			if !rule.Match(inf.Subject, name) {
+				continue
+			}
+			key := ruleKey{rule: rule.Name, subject: inf.Subject, metric: name}
+			self.update(rule, key, metric.Value, inf.Observers, now)
+		}
+	}
+}
+
+// Update the state of a rule for a subject metric and fire an alert if
+// the status crossed the severity threshold. Must be called with lock held.
+func (self *AlertManager) update(rule *AlertRule, key ruleKey, value *pb.Value, observers []string, now time.Time) {
+	state, ok := self.states[key]
+	if !ok {
+		state = &ruleState{status: pb.Status_INVALID}
+		self.states[key] = state
+	}
+	status := value.Status
+	if status >= rule.Severity {
+		if state.status < rule.Severity {
+			// just entered the failing state
+			state.previous = state.status
+			state.since = now
+		} else if state.status != status && state.fired {
+			// escalated or de-escalated while failing, which is a new transition
+			state.previous = state.status
+			state.fired = false
+		}
+		state.status = status
+		state.score = value.Score
+		state.observers = observers
+		if !state.fired && now.Sub(state.since) >= rule.MinDuration {
+			state.fired = true
+			if self.fire(rule, key, state, false, now) {
+				state.notified = true
+			}
+		}
+	} else {
+		if state.notified {
+			// only announce recovery if the failure was announced
+			state.previous = state.status
+			state.status = status
+			state.score = value.Score
+			state.observers = observers
+			self.fire(rule, key, state, true, now)
+		}
+		state.status = status
+		state.fired = false
+		state.notified = false
+	}
+}
+
+func (self *AlertManager) OnIncident(incident *pb.Incident) {
+	now := time.Now()
+	var members []string
+	for _, member := range incident.Members {
+		if self.silencer != nil && self.silencer.MatchSubject(member, now) != nil {
+			du.LogD(atag, "%s is under maintenance, leave it out of incident alert", member)
+			continue
+		}
+		members = append(members, member)
+	}
+	if len(members) == 0 {
+		du.LogD(atag, "all members of incident %s=%s are under maintenance, skip alerting", incident.Key, incident.Value)
+		return
+	}
+	start, _ := ptypes.Timestamp(incident.Start)
+	alert := &Alert{
+		Rule:     INCIDENT_RULE,
+		Subject:  incident.Key + "=" + incident.Value,
+		Status:   incident.Status.String(),
+		Previous: pb.Status_HEALTHY.String(),
+		Members:  members,
+		Since:    start,
+		Time:     now,
+		Resolved: incident.End != nil,
+	}
+	if alert.Resolved {
+		alert.Status, alert.Previous = alert.Previous, alert.Status
+	}
+	// a recovery is identified by the status it recovered from
+	dkey := dedupKey{ruleKey: ruleKey{rule: INCIDENT_RULE, subject: alert.Subject}, status: incident.Status, resolved: alert.Resolved}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if !alert.Resolved {
+		// the pending alerts about the members are absorbed by the incident
+		for key, state := range self.states {
+			if !state.notified && contains(incident.Members, key.subject) {
+				delete(self.states, key)
+			}
+		}
+	}
+	self.send(dkey, nil, alert, now)
+}
+
+// Fire alerts for failing states that have lasted long enough
+func (self *AlertManager) check(stopc chan bool) {
+	defer self.workers.Done()
+	ticker := time.NewTicker(CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopc:
+			return
+		case <-ticker.C:
+		}
+		self.mu.Lock()
+		now := time.Now()
+		for _, rule := range self.Rules {
+			if rule.MinDuration == 0 {
+				continue
+			}
+			for key, state := range self.states {
+				if key.rule != rule.Name || state.fired || state.status < rule.Severity {
+					continue
+				}
+				if now.Sub(state.since) >= rule.MinDuration {
+					state.fired = true
+					if self.fire(rule, key, state, false, now) {
+						state.notified = true
+					}
+				}
+			}
+		}
+		for key, ts := range self.sent {
+			if now.Sub(ts) >= self.dedupWindow {
+				delete(self.sent, key)
+			}
+		}
+		self.mu.Unlock()
+	}
+}
+
+// Send an alert unless an identical one was sent recently. Return
+// whether the alert is sent. Must be called with lock held.
+func (self *AlertManager) fire(rule *AlertRule, key ruleKey, state *ruleState, resolved bool, now time.Time) bool {
+	dkey := dedupKey{ruleKey: key, status: state.status, resolved: resolved}
+	if resolved {
+		// a recovery is identified by the status it recovered from
+		dkey.status = state.previous
+	}
+	alert := &Alert{
+		Rule:      rule.Name,
+		Subject:   key.subject,
+		Metric:    key.metric,
+		Status:    state.status.String(),
+		Previous:  state.previous.String(),
+		Score:     state.score,
+		Observers: state.observers,
+		Since:     state.since,
+		Time:      now,
+		Resolved:  resolved,
+	}
+	return self.send(dkey, rule.Sinks, alert, now)
+}
+
+// Send an alert to the sinks unless an alert with the same key was sent
+// recently. Must be called with lock held.
+func (self *AlertManager) send(dkey dedupKey, sinks []string, alert *Alert, now time.Time) bool {
+	if ts, ok := self.sent[dkey]; ok && now.Sub(ts) < self.dedupWindow {
+		du.LogD(atag, "suppress duplicate alert %s", alert)
+		return false
+	}
+	self.sent[dkey] = now
+	du.LogI(atag, "firing alert %s", alert)
+	self.dispatch(sinks, alert)
+	return true
+}
+
+// Must be called with lock held
+func (self *AlertManager) dispatch(sinks []string, alert *Alert) {
+	if len(sinks) == 0 {
+		for name := range self.queues {
+			sinks = append(sinks, name)
+		}
+	}
+	for _, name := range sinks {
+		queue, ok := self.queues[name]
+		if !ok {
+			continue
+		}
+		select {
+		case queue <- alert:
+		default:
+			du.LogE(atag, "queue of sink %s is full, drop alert %s", name, alert)
+		}
+	}
+}
+
+func (self *AlertManager) deliver(name string, sink Sink, queue chan *Alert) {
+	defer self.workers.Done()
+	for alert := range queue {
+		err := sink.Deliver(alert)
+		if err != nil {
+			du.LogE(atag, "fail to deliver alert %s to sink %s: %s", alert, name, err)
+		} else {
+			du.LogD(atag, "delivered alert %s to sink %s", alert, name)
+		}
+	}
+}
+
+func (self *Alert) String() string {
+	if len(self.Members) > 0 {
+		if self.Resolved {
+			return fmt.Sprintf("[%s] %s resolved (%s)", self.Rule, self.Subject, strings.Join(self.Members, ","))
+		}
+		return fmt.Sprintf("[%s] %s %s since %s (%s)", self.Rule, self.Subject, self.Status,
+			self.Since.Format(time.RFC3339), strings.Join(self.Members, ","))
+	}
+	if self.Resolved {
+		return fmt.Sprintf("[%s] %s:%s resolved (%s -> %s)", self.Rule, self.Subject, self.Metric, self.Previous, self.Status)
+	}
+	return fmt.Sprintf("[%s] %s:%s %s -> %s since %s", self.Rule, self.Subject, self.Metric,
+		self.Previous, self.Status, self.Since.Format(time.RFC3339))
+}
+
+// Environment variables describing the alert, used by the exec sink
+func (self *Alert) Environ() []string {
+	return []string{
+		"PANORAMA_ALERT_RULE=" + self.Rule,
+		"PANORAMA_ALERT_SUBJECT=" + self.Subject,
+		"PANORAMA_ALERT_METRIC=" + self.Metric,
+		"PANORAMA_ALERT_STATUS=" + self.Status,
+		"PANORAMA_ALERT_PREVIOUS=" + self.Previous,
+		fmt.Sprintf("PANORAMA_ALERT_SCORE=%.1f", self.Score),
+		"PANORAMA_ALERT_OBSERVERS=" + strings.Join(self.Observers, ","),
+		"PANORAMA_ALERT_MEMBERS=" + strings.Join(self.Members, ","),
+		"PANORAMA_ALERT_SINCE=" + self.Since.Format(time.RFC3339),
+		"PANORAMA_ALERT_TIME=" + self.Time.Format(time.RFC3339),
+		fmt.Sprintf("PANORAMA_ALERT_RESOLVED=%t", self.Resolved),
+	}
+}
@@ -0,0 +1,190 @@
+package alert
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+type chanSink struct {
+	ch chan *Alert
+}
+
+func (self *chanSink) Deliver(alert *Alert) error {
+	self.ch <- alert
+	return nil
+}
+
+func makeInference(subject string, metric string, status pb.Status) *pb.Inference {
+	return &pb.Inference{
+		Subject:     subject,
+		Observers:   []string{"FE_1"},
+		Observation: dt.NewObservationSingleMetric(time.Now(), metric, status, 10),
+	}
+}
+
+func expectAlert(t *testing.T, sink *chanSink, subject string, status string, resolved bool) {
+	select {
+	case alert := <-sink.ch:
+		if alert.Subject != subject || alert.Status != status || alert.Resolved != resolved {
+			t.Errorf("expecting alert for %s %s (resolved=%t), got %s", subject, status, resolved, alert)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("expecting alert for %s %s, got none", subject, status)
+	}
+}
+
+func expectNoAlert(t *testing.T, sink *chanSink, wait time.Duration) {
+	select {
+	case alert := <-sink.ch:
+		t.Errorf("unexpected alert %s", alert)
+	case <-time.After(wait):
+	}
+}
+
+func TestAlertTransition(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	config := &dt.AlertingConfig{
+		Rules: []*dt.AlertRuleConfig{
+			&dt.AlertRuleConfig{Name: "ts-down", Subject: "^TS_", Metric: "cpu", Severity: "unhealthy"},
+		},
+	}
+	manager, err := NewAlertManager(config)
+	if err != nil {
+		t.Fatalf("Fail to create alert manager: %s", err)
+	}
+	sink := &chanSink{ch: make(chan *Alert, 10)}
+	manager.AddSink("test", sink)
+	manager.Start()
+	defer manager.Stop()
+
+	manager.OnInference(makeInference("TS_1", "cpu", pb.Status_HEALTHY))
+	manager.OnInference(makeInference("FE_1", "cpu", pb.Status_DEAD))
+	manager.OnInference(makeInference("TS_1", "disk", pb.Status_DEAD))
+	expectNoAlert(t, sink, 200*time.Millisecond)
+
+	manager.OnInference(makeInference("TS_1", "cpu", pb.Status_UNHEALTHY))
+	expectAlert(t, sink, "TS_1", "UNHEALTHY", false)
+	// repeated verdicts should not fire again
+	manager.OnInference(makeInference("TS_1", "cpu", pb.Status_UNHEALTHY))
+	expectNoAlert(t, sink, 200*time.Millisecond)
+	manager.OnInference(makeInference("TS_1", "cpu", pb.Status_DEAD))
+	expectAlert(t, sink, "TS_1", "DEAD", false)
+	manager.OnInference(makeInference("TS_1", "cpu", pb.Status_HEALTHY))
+	expectAlert(t, sink, "TS_1", "HEALTHY", true)
+
+	// flapping within the dedup window is suppressed
+	manager.OnInference(makeInference("TS_1", "cpu", pb.Status_UNHEALTHY))
+	manager.OnInference(makeInference("TS_1", "cpu", pb.Status_HEALTHY))
+	expectNoAlert(t, sink, 200*time.Millisecond)
+}
+
+func TestAlertMinDuration(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	config := &dt.AlertingConfig{
+		Rules: []*dt.AlertRuleConfig{
+			&dt.AlertRuleConfig{Name: "slow", Severity: "dead", MinDuration: 2},
+		},
+	}
+	manager, err := NewAlertManager(config)
+	if err != nil {
+		t.Fatalf("Fail to create alert manager: %s", err)
+	}
+	sink := &chanSink{ch: make(chan *Alert, 10)}
+	manager.AddSink("test", sink)
+	manager.Start()
+	defer manager.Stop()
+
+	// a short failure does not fire
+	manager.OnInference(makeInference("TS_2", "network", pb.Status_DEAD))
+	manager.OnInference(makeInference("TS_2", "network", pb.Status_HEALTHY))
+	manager.OnInference(makeInference("TS_3", "network", pb.Status_DEAD))
+	expectNoAlert(t, sink, 1*time.Second)
+	// fired by the periodic check even without new inference
+	expectAlert(t, sink, "TS_3", "DEAD", false)
+}
+
+func TestAlertConfig(t *testing.T) {
+	bad := []*dt.AlertingConfig{
+		&dt.AlertingConfig{Rules: []*dt.AlertRuleConfig{&dt.AlertRuleConfig{Name: "r", Subject: "("}}},
+		&dt.AlertingConfig{Rules: []*dt.AlertRuleConfig{&dt.AlertRuleConfig{Name: "r", Severity: "bad"}}},
+		&dt.AlertingConfig{Rules: []*dt.AlertRuleConfig{&dt.AlertRuleConfig{Name: "r", Sinks: []string{"none"}}}},
+		&dt.AlertingConfig{Sinks: []*dt.AlertSinkConfig{&dt.AlertSinkConfig{Name: "s", Kind: "pager", Target: "x"}}},
+	}
+	for i, config := range bad {
+		if _, err := NewAlertManager(config); err == nil {
+			t.Errorf("config %d should be rejected", i)
+		}
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "alerts.json")
+	sink := NewFileSink(path)
+	for _, subject := range []string{"TS_1", "TS_2"} {
+		if err := sink.Deliver(&Alert{Rule: "r", Subject: subject, Status: "DEAD"}); err != nil {
+			t.Fatalf("Fail to deliver alert: %s", err)
+		}
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	n := 0
+	for scanner.Scan() {
+		var alert Alert
+		if err := json.Unmarshal(scanner.Bytes(), &alert); err != nil {
+			t.Errorf("Fail to decode line %d: %s", n, err)
+		}
+		if !strings.HasPrefix(scanner.Text(), `{"rule":"r","subject":"TS_`) {
+			t.Errorf("expecting lower-case keys, got %s", scanner.Text())
+		}
+		n++
+	}
+	if n != 2 {
+		t.Errorf("expecting 2 alerts in file, got %d", n)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var alert Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil || alert.Subject != "TS_1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}))
+	defer server.Close()
+	sink := NewWebhookSink(server.URL, 2, time.Second)
+	if err := sink.Deliver(&Alert{Rule: "r", Subject: "TS_1", Status: "DEAD"}); err != nil {
+		t.Errorf("Fail to deliver alert after retry: %s", err)
+	}
+	if attempts != 2 {
+		t.Errorf("expecting 2 attempts, got %d", attempts)
+	}
+}
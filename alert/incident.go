@@ -0,0 +1,257 @@
+package alert
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+const (
+	itag                 = "incident"
+	INCIDENT_WINDOW      = 1 * time.Minute // default window for members to fail together
+	INCIDENT_MIN_MEMBERS = 2               // default minimum number of failed members
+	INCIDENT_MIN_RATIO   = 0.5             // default minimum ratio of failed members
+	INCIDENT_HISTORY_LEN = 100             // number of resolved incidents to keep
+)
+
+type failure struct {
+	status pb.Status
+	since  time.Time
+}
+
+type domainKey struct {
+	key   string
+	value string
+}
+
+// Detect correlated failures in failure domains, which are groups of subjects
+// sharing a label value (e.g., rack=r1). When enough members of a domain fail
+// within a short window, a single incident is opened for the domain, which
+// absorbs the failures of the other members until all of them recover.
+type IncidentDetector struct {
+	Domains    []string
+	Window     time.Duration
+	MinMembers int
+	MinRatio   float32
+	Severity   pb.Status
+
+	labeler   dt.HealthLabeler
+	silencer  dt.HealthSilencer
+	failing   map[string]*failure
+	open      map[domainKey]*pb.Incident
+	history   []*pb.Incident
+	listeners []dt.IncidentListener
+	mu        *sync.Mutex
+}
+
+var _ dt.InferenceListener = new(IncidentDetector)
+
+func NewIncidentDetector(config *dt.IncidentDetectionConfig, labeler dt.HealthLabeler) (*IncidentDetector, error) {
+	detector := &IncidentDetector{
+		Domains:    config.Domains,
+		Window:     INCIDENT_WINDOW,
+		MinMembers: INCIDENT_MIN_MEMBERS,
+		MinRatio:   INCIDENT_MIN_RATIO,
+		Severity:   pb.Status_UNHEALTHY,
+		labeler:    labeler,
+		failing:    make(map[string]*failure),
+		open:       make(map[domainKey]*pb.Incident),
+		mu:         &sync.Mutex{},
+	}
+	if config.Window > 0 {
+		detector.Window = time.Duration(config.Window) * time.Second
+	}
+	if config.MinMembers > 0 {
+		detector.MinMembers = config.MinMembers
+	}
+	if config.MinRatio > 0 {
+		if config.MinRatio > 1 {
+			return nil, fmt.Errorf("Invalid incident ratio %f", config.MinRatio)
+		}
+		detector.MinRatio = config.MinRatio
+	}
+	if len(config.Severity) > 0 {
+		detector.Severity = dt.StatusFromFullStr(config.Severity)
+		if detector.Severity == pb.Status_INVALID {
+			return nil, fmt.Errorf("Invalid incident severity %s", config.Severity)
+		}
+	}
+	return detector, nil
+}
+
+// Add a listener to be notified when an incident is opened or resolved
+func (self *IncidentDetector) AddListener(listener dt.IncidentListener) {
+	self.listeners = append(self.listeners, listener)
+}
+
+// Use silencer to leave subjects under maintenance out of the incidents
+func (self *IncidentDetector) SetSilencer(silencer dt.HealthSilencer) {
+	self.silencer = silencer
+}
+
+func (self *IncidentDetector) OnInference(inf *pb.Inference) {
+	if inf == nil || inf.Observation == nil {
+		return
+	}
+	worst := pb.Status_INVALID
+	for _, metric := range inf.Observation.Metrics {
+		if metric.Value != nil && metric.Value.Status > worst {
+			worst = metric.Value.Status
+		}
+	}
+	now := time.Now()
+	silenced := self.silencer != nil && self.silencer.MatchSubject(inf.Subject, now) != nil
+	if silenced {
+		du.LogD(itag, "%s is under maintenance, not counted as failing", inf.Subject)
+	}
+	labels := self.labeler.GetLabels(inf.Subject)
+	self.mu.Lock()
+	f, ok := self.failing[inf.Subject]
+	if worst >= self.Severity && !silenced {
+		if !ok {
+			f = &failure{since: now}
+			self.failing[inf.Subject] = f
+		}
+		f.status = worst
+	} else {
+		delete(self.failing, inf.Subject)
+	}
+	var changed []*pb.Incident
+	for _, key := range self.Domains {
+		value, ok := labels[key]
+		if !ok {
+			continue
+		}
+		incident := self.evaluate(domainKey{key: key, value: value}, now)
+		if incident != nil {
+			changed = append(changed, copyIncident(incident))
+		}
+	}
+	self.mu.Unlock()
+	for _, incident := range changed {
+		for _, listener := range self.listeners {
+			listener.OnIncident(incident)
+		}
+	}
+}
+
+// Open or resolve the incident of a failure domain. Return the incident
+// if it is opened or resolved. Must be called with lock held.
+func (self *IncidentDetector) evaluate(domain domainKey, now time.Time) *pb.Incident {
+	var members, failed, recent []string
+	for subject, labels := range self.labeler.DumpLabels() {
+		if labels[domain.key] != domain.value {
+			continue
+		}
+		members = append(members, subject)
+		if f, ok := self.failing[subject]; ok {
+			failed = append(failed, subject)
+			if now.Sub(f.since) <= self.Window {
+				recent = append(recent, subject)
+			}
+		}
+	}
+	incident, ok := self.open[domain]
+	if ok {
+		if len(failed) == 0 {
+			incident.End, _ = ptypes.TimestampProto(now)
+			delete(self.open, domain)
+			self.history = append(self.history, incident)
+			if len(self.history) > INCIDENT_HISTORY_LEN {
+				self.history = self.history[1:]
+			}
+			du.LogI(itag, "incident %s resolved", incident.Id)
+			return incident
+		}
+		for _, subject := range failed {
+			if !contains(incident.Members, subject) {
+				incident.Members = append(incident.Members, subject)
+				sort.Strings(incident.Members)
+				du.LogI(itag, "%s joined incident %s", subject, incident.Id)
+			}
+			if self.failing[subject].status > incident.Status {
+				incident.Status = self.failing[subject].status
+			}
+		}
+		incident.Size = int32(len(members))
+		return nil
+	}
+	if len(recent) < self.MinMembers || float32(len(recent)) < self.MinRatio*float32(len(members)) {
+		return nil
+	}
+	sort.Strings(failed)
+	start, _ := ptypes.TimestampProto(now)
+	incident = &pb.Incident{
+		Id:      fmt.Sprintf("%s=%s-%d", domain.key, domain.value, now.UnixNano()),
+		Key:     domain.key,
+		Value:   domain.value,
+		Members: failed,
+		Size:    int32(len(members)),
+		Start:   start,
+	}
+	for _, subject := range failed {
+		if self.failing[subject].status > incident.Status {
+			incident.Status = self.failing[subject].status
+		}
+	}
+	self.open[domain] = incident
+	du.LogI(itag, "incident %s opened: %d/%d members failed", incident.Id, len(failed), len(members))
+	return incident
+}
+
+// Check if a subject is failing as part of an open incident
+func (self *IncidentDetector) Covers(subject string) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if _, ok := self.failing[subject]; !ok {
+		return false
+	}
+	for _, incident := range self.open {
+		if contains(incident.Members, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the open incidents, and optionally the recently resolved ones,
+// with the latest first
+func (self *IncidentDetector) GetIncidents(resolved bool) []*pb.Incident {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	var incidents []*pb.Incident
+	for _, incident := range self.open {
+		incidents = append(incidents, copyIncident(incident))
+	}
+	if resolved {
+		incidents = append(incidents, self.history...)
+	}
+	sort.Slice(incidents, func(i, j int) bool {
+		return dt.CompareTimestamp(incidents[i].Start, incidents[j].Start) > 0
+	})
+	return incidents
+}
+
+// Open incidents are still updated, so hand out a copy
+func copyIncident(incident *pb.Incident) *pb.Incident {
+	result := &pb.Incident{}
+	*result = *incident
+	result.Members = append([]string(nil), incident.Members...)
+	return result
+}
+
+func contains(list []string, item string) bool {
+	for _, s := range list {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
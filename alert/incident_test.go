@@ -0,0 +1,170 @@
+package alert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	pb "panorama/build/gen"
+	"panorama/store"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+type chanIncidentListener struct {
+	ch chan *pb.Incident
+}
+
+func (self *chanIncidentListener) OnIncident(incident *pb.Incident) {
+	self.ch <- incident
+}
+
+func TestIncidentDetection(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	labels := map[string]map[string]string{
+		"TS_1": {"rack": "r1"},
+		"TS_2": {"rack": "r1"},
+		"TS_3": {"rack": "r1"},
+		"TS_4": {"rack": "r2"},
+		"TS_5": {"rack": "r2"},
+	}
+	labeler := store.NewLabelStorage(labels)
+	detector, err := NewIncidentDetector(&dt.IncidentDetectionConfig{Domains: []string{"rack"}}, labeler)
+	if err != nil {
+		t.Fatalf("Fail to create incident detector: %s", err)
+	}
+	listener := &chanIncidentListener{ch: make(chan *pb.Incident, 10)}
+	detector.AddListener(listener)
+
+	// a single failure is not an incident
+	detector.OnInference(makeInference("TS_1", "cpu", pb.Status_DEAD))
+	detector.OnInference(makeInference("TS_4", "cpu", pb.Status_UNHEALTHY))
+	if len(listener.ch) != 0 || len(detector.GetIncidents(true)) != 0 {
+		t.Fatal("a single failure should not open an incident")
+	}
+	detector.OnInference(makeInference("TS_2", "cpu", pb.Status_UNHEALTHY))
+	if len(listener.ch) != 1 {
+		t.Fatalf("expecting one incident, got %d", len(listener.ch))
+	}
+	incident := <-listener.ch
+	if incident.Value != "r1" || len(incident.Members) != 2 || incident.Size != 3 ||
+		incident.Status != pb.Status_DEAD || incident.End != nil {
+		t.Errorf("unexpected incident %v", incident)
+	}
+	if !detector.Covers("TS_1") || detector.Covers("TS_3") || detector.Covers("TS_4") {
+		t.Error("only the failed members of r1 should be covered")
+	}
+	// later failures join the open incident
+	detector.OnInference(makeInference("TS_3", "cpu", pb.Status_UNHEALTHY))
+	if len(listener.ch) != 0 {
+		t.Error("member joining an incident should not open another")
+	}
+	if incidents := detector.GetIncidents(false); len(incidents) != 1 || len(incidents[0].Members) != 3 {
+		t.Errorf("expecting one incident with 3 members, got %v", incidents)
+	}
+	for _, subject := range []string{"TS_1", "TS_2", "TS_3"} {
+		detector.OnInference(makeInference(subject, "cpu", pb.Status_HEALTHY))
+	}
+	if len(listener.ch) != 1 {
+		t.Fatalf("expecting incident to be resolved")
+	}
+	if incident = <-listener.ch; incident.End == nil {
+		t.Errorf("expecting resolved incident, got %v", incident)
+	}
+	if len(detector.GetIncidents(false)) != 0 || len(detector.GetIncidents(true)) != 1 {
+		t.Error("resolved incident should only be listed in history")
+	}
+}
+
+func TestIncidentWindow(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	labeler := store.NewLabelStorage(map[string]map[string]string{
+		"TS_1": {"zone": "a"},
+		"TS_2": {"zone": "a"},
+	})
+	detector, _ := NewIncidentDetector(&dt.IncidentDetectionConfig{Domains: []string{"zone"}}, labeler)
+	detector.Window = 50 * time.Millisecond
+	detector.OnInference(makeInference("TS_1", "cpu", pb.Status_DEAD))
+	time.Sleep(100 * time.Millisecond)
+	// failures far apart are independent
+	detector.OnInference(makeInference("TS_2", "cpu", pb.Status_DEAD))
+	if len(detector.GetIncidents(true)) != 0 {
+		t.Error("failures outside the window should not be correlated")
+	}
+}
+
+func TestIncidentAlert(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	labeler := store.NewLabelStorage(map[string]map[string]string{
+		"TS_1": {"rack": "r1"},
+		"TS_2": {"rack": "r1"},
+	})
+	detector, _ := NewIncidentDetector(&dt.IncidentDetectionConfig{Domains: []string{"rack"}}, labeler)
+	manager, _ := NewAlertManager(&dt.AlertingConfig{
+		Rules: []*dt.AlertRuleConfig{&dt.AlertRuleConfig{Name: "down", MinDuration: 1}},
+	})
+	manager.SetIncidentDetector(detector)
+	sink := &chanSink{ch: make(chan *Alert, 10)}
+	manager.AddSink("test", sink)
+	manager.Start()
+	defer manager.Stop()
+
+	for _, subject := range []string{"TS_1", "TS_2"} {
+		inf := makeInference(subject, "cpu", pb.Status_DEAD)
+		detector.OnInference(inf)
+		manager.OnInference(inf)
+	}
+	expectAlert(t, sink, "rack=r1", "DEAD", false)
+	expectNoAlert(t, sink, 1500*time.Millisecond)
+}
+
+func TestIncidentSilence(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	labeler := store.NewLabelStorage(map[string]map[string]string{
+		"TS_1": {"rack": "r1"},
+		"TS_2": {"rack": "r1"},
+		"TS_3": {"rack": "r1"},
+	})
+	silencer := store.NewSilenceStorage()
+	start, _ := ptypes.TimestampProto(time.Now().Add(-time.Minute))
+	end, _ := ptypes.TimestampProto(time.Now().Add(time.Hour))
+	silencer.AddSilence(&pb.Silence{Id: "s1", Subject: "TS_2", Start: start, End: end, Mode: pb.Silence_EXCLUDE})
+	detector, _ := NewIncidentDetector(&dt.IncidentDetectionConfig{Domains: []string{"rack"}}, labeler)
+	detector.SetSilencer(silencer)
+	manager, _ := NewAlertManager(&dt.AlertingConfig{
+		Rules: []*dt.AlertRuleConfig{&dt.AlertRuleConfig{Name: "down"}},
+	})
+	manager.SetSilencer(silencer)
+	manager.SetIncidentDetector(detector)
+	sink := &chanSink{ch: make(chan *Alert, 10)}
+	manager.AddSink("test", sink)
+	manager.Start()
+	defer manager.Stop()
+
+	// the member under maintenance does not make an incident
+	for _, subject := range []string{"TS_1", "TS_2"} {
+		inf := makeInference(subject, "cpu", pb.Status_DEAD)
+		detector.OnInference(inf)
+		manager.OnInference(inf)
+	}
+	if len(detector.GetIncidents(true)) != 0 {
+		t.Fatal("a silenced member should not count as failing")
+	}
+	expectAlert(t, sink, "TS_1", "DEAD", false)
+
+	inf := makeInference("TS_3", "cpu", pb.Status_DEAD)
+	detector.OnInference(inf)
+	manager.OnInference(inf)
+	select {
+	case alert := <-sink.ch:
+		if alert.Subject != "rack=r1" || len(alert.Members) != 2 || contains(alert.Members, "TS_2") {
+			t.Errorf("expecting an incident alert without TS_2, got %s", alert)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expecting an incident alert, got none")
+	}
+	// the same incident is not announced twice
+	manager.OnIncident(detector.GetIncidents(false)[0])
+	expectNoAlert(t, sink, 200*time.Millisecond)
+}
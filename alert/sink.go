@@ -0,0 +1,160 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+const (
+	SINK_TIMEOUT    = 10 * time.Second // default time to wait for a delivery
+	WEBHOOK_RETRIES = 3                // default number of retries for webhook
+)
+
+// A sink delivers alerts to the outside world
+type Sink interface {
+	Deliver(alert *Alert) error
+}
+
+// Post the alert as a JSON payload to an HTTP endpoint
+type WebhookSink struct {
+	Url     string
+	Retries int
+
+	client *http.Client
+}
+
+// Execute a local script with the alert described in environment variables
+type ExecSink struct {
+	Command string
+	Args    []string
+	Timeout time.Duration
+}
+
+// Append the alert as a JSON line to a file
+type FileSink struct {
+	Path string
+
+	mu *sync.Mutex
+}
+
+var _ Sink = new(WebhookSink)
+var _ Sink = new(ExecSink)
+var _ Sink = new(FileSink)
+
+func NewSink(config *dt.AlertSinkConfig) (Sink, error) {
+	if len(config.Target) == 0 {
+		return nil, fmt.Errorf("Empty target for alert sink %s", config.Name)
+	}
+	timeout := SINK_TIMEOUT
+	if config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout) * time.Second
+	}
+	switch strings.ToLower(config.Kind) {
+	case "webhook":
+		retries := WEBHOOK_RETRIES
+		if config.Retries > 0 {
+			retries = config.Retries
+		}
+		return NewWebhookSink(config.Target, retries, timeout), nil
+	case "exec":
+		return NewExecSink(config.Target, config.Args, timeout), nil
+	case "file":
+		return NewFileSink(config.Target), nil
+	}
+	return nil, fmt.Errorf("Unknown kind %s for alert sink %s", config.Kind, config.Name)
+}
+
+func NewWebhookSink(url string, retries int, timeout time.Duration) *WebhookSink {
+	return &WebhookSink{
+		Url:     url,
+		Retries: retries,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+func NewExecSink(command string, args []string, timeout time.Duration) *ExecSink {
+	return &ExecSink{
+		Command: command,
+		Args:    args,
+		Timeout: timeout,
+	}
+}
+
+func NewFileSink(path string) *FileSink {
+	return &FileSink{
+		Path: path,
+		mu:   &sync.Mutex{},
+	}
+}
+
+func (self *WebhookSink) Deliver(alert *Alert) error {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	sleep := time.Second
+	// retry with exponential back-off
+	for retries := 0; ; retries++ {
+		err = self.post(payload)
+		if err == nil || retries >= self.Retries {
+			break
+		}
+		du.LogD(atag, "fail to post alert to %s: %s, retry in %s", self.Url, err, sleep)
+		time.Sleep(sleep)
+		sleep = sleep * 2
+	}
+	return err
+}
+
+func (self *WebhookSink) post(payload []byte) error {
+	resp, err := self.client.Post(self.Url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned %s", self.Url, resp.Status)
+	}
+	return nil
+}
+
+func (self *ExecSink) Deliver(alert *Alert) error {
+	ctx, cancel := context.WithTimeout(context.Background(), self.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, self.Command, self.Args...)
+	cmd.Env = append(os.Environ(), alert.Environ()...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (self *FileSink) Deliver(alert *Alert) error {
+	line, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	fp, err := os.OpenFile(self.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fp.Write(append(line, '\n'))
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,311 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+
+	pb "panorama/build/gen"
+	du "panorama/util"
+)
+
+const (
+	DIAL_TIMEOUT = 5 * time.Second  // default deadline to establish a connection
+	IDLE_TIMEOUT = 10 * time.Minute // default time after which an unused connection is closed
+	BACKOFF_MIN  = 1 * time.Second  // delay before dialing again after the first failure
+	BACKOFF_MAX  = 30 * time.Second // maximum delay before dialing again or reconnecting
+)
+
+// Health of the connection to a target
+type ConnHealth struct {
+	Addr      string
+	State     connectivity.State
+	Since     time.Time // when the connection entered the state
+	LastUsed  time.Time
+	Failures  int       // failures in a row to connect
+	RetryAt   time.Time // the target is not dialed again before this time
+	LastError string
+}
+
+type dialConfig struct {
+	timeout time.Duration
+	options []grpc.DialOption
+}
+
+type managedConn struct {
+	dialMu sync.Mutex // only one dial to a target at a time
+	conn   *grpc.ClientConn
+	client pb.HealthServiceClient
+	health ConnHealth
+}
+
+// Connections to Panorama instances shared by concurrent callers. A target,
+// usually the id of a peer, is dialed on first use and the connection is
+// reused until it is idle for too long or removed. Failed dials are retried
+// with exponential backoff, while established connections are reconnected
+// by gRPC in the background.
+type ConnManager struct {
+	DialTimeout time.Duration
+	IdleTimeout time.Duration
+	MaxBackoff  time.Duration
+	// verify the TLS certificate of a server against the target, e.g., the
+	// id of a peer, instead of the address dialed
+	TargetAuthority bool
+
+	options []grpc.DialOption      // dial options of all targets
+	configs map[string]*dialConfig // dial options and deadlines of certain targets
+	conns   map[string]*managedConn
+	mu      sync.Mutex
+	stop    chan struct{}
+	running sync.WaitGroup // goroutines waited for when closing
+}
+
+func NewConnManager(options ...grpc.DialOption) *ConnManager {
+	return &ConnManager{
+		DialTimeout: DIAL_TIMEOUT,
+		IdleTimeout: IDLE_TIMEOUT,
+		MaxBackoff:  BACKOFF_MAX,
+		options:     options,
+		configs:     make(map[string]*dialConfig),
+		conns:       make(map[string]*managedConn),
+	}
+}
+
+// Listen for the connections of the peers on a TCP address
+func (self *ConnManager) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// Dial a target with its own options and deadline instead of the default
+// ones, a zero timeout keeps the default deadline. The current connection
+// to the target is closed so that the options take effect.
+func (self *ConnManager) SetDialOptions(target string, timeout time.Duration, options ...grpc.DialOption) {
+	self.mu.Lock()
+	self.configs[target] = &dialConfig{timeout: timeout, options: options}
+	self.mu.Unlock()
+	self.Remove(target)
+}
+
+// Dial all targets with other default options, e.g., the credentials of the
+// caller, and verify their TLS certificates against the targets if authority
+// is set. The current connections are closed so that the options take effect.
+func (self *ConnManager) SetDefaultOptions(authority bool, options ...grpc.DialOption) {
+	self.mu.Lock()
+	self.options = options
+	self.TargetAuthority = authority
+	targets := make([]string, 0, len(self.conns))
+	for target := range self.conns {
+		targets = append(targets, target)
+	}
+	self.mu.Unlock()
+	for _, target := range targets {
+		self.Remove(target)
+	}
+}
+
+// Get a client to a target at an address. A target that moved to another
+// address is dialed again.
+func (self *ConnManager) Get(target string, addr string) (pb.HealthServiceClient, error) {
+	self.mu.Lock()
+	entry, ok := self.conns[target]
+	if !ok {
+		entry = &managedConn{health: ConnHealth{Addr: addr}}
+		self.conns[target] = entry
+	}
+	self.mu.Unlock()
+
+	entry.dialMu.Lock()
+	defer entry.dialMu.Unlock()
+	now := time.Now()
+	self.mu.Lock()
+	if entry.conn != nil && entry.health.Addr == addr {
+		entry.health.LastUsed = now
+		client := entry.client
+		self.mu.Unlock()
+		return client, nil
+	}
+	if entry.health.Addr == addr && now.Before(entry.health.RetryAt) {
+		err := fmt.Errorf("Connection to %s at %s is backing off after %d failures: %s", target, addr,
+			entry.health.Failures, entry.health.LastError)
+		self.mu.Unlock()
+		return nil, err
+	}
+	old := entry.conn
+	entry.conn, entry.client = nil, nil
+	if entry.health.Addr != addr {
+		entry.health = ConnHealth{Addr: addr}
+	}
+	timeout := self.DialTimeout
+	options := append([]grpc.DialOption{}, self.options...)
+	if config, ok := self.configs[target]; ok {
+		if config.timeout > 0 {
+			timeout = config.timeout
+		}
+		options = append(options, config.options...)
+	}
+	if self.TargetAuthority {
+		options = append(options, grpc.WithAuthority(target))
+	}
+	options = append(options, grpc.WithBlock(), grpc.FailOnNonTempDialError(true), grpc.WithBackoffMaxDelay(self.MaxBackoff))
+	self.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	conn, err := grpc.DialContext(ctx, addr, options...)
+	cancel()
+	now = time.Now()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.conns[target] != entry {
+		// removed while dialing
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, fmt.Errorf("Connection to %s was closed", target)
+	}
+	if err != nil {
+		entry.health.Failures++
+		backoff := BACKOFF_MIN << uint(entry.health.Failures-1)
+		if backoff > self.MaxBackoff || backoff <= 0 {
+			backoff = self.MaxBackoff
+		}
+		entry.health.RetryAt = now.Add(backoff)
+		entry.health.LastError = err.Error()
+		if entry.health.State != connectivity.TransientFailure {
+			entry.health.State = connectivity.TransientFailure
+			entry.health.Since = now
+		}
+		du.LogE(tag, "fail to connect to %s at %s, retry in %s: %s", target, addr, backoff, err)
+		return nil, err
+	}
+	entry.conn = conn
+	entry.client = pb.NewHealthServiceClient(conn)
+	entry.health.State = conn.GetState()
+	entry.health.Since = now
+	entry.health.LastUsed = now
+	entry.health.Failures = 0
+	entry.health.RetryAt = time.Time{}
+	entry.health.LastError = ""
+	du.LogD(tag, "connected to %s at %s", target, addr)
+	self.running.Add(1)
+	go self.monitor(target, entry, conn)
+	return entry.client, nil
+}
+
+// Follow the state of a connection until it is closed
+func (self *ConnManager) monitor(target string, entry *managedConn, conn *grpc.ClientConn) {
+	defer self.running.Done()
+	state := conn.GetState()
+	for state != connectivity.Shutdown {
+		conn.WaitForStateChange(context.Background(), state)
+		state = conn.GetState()
+		now := time.Now()
+		self.mu.Lock()
+		if entry.conn == conn && entry.health.State != state {
+			if state == connectivity.TransientFailure {
+				entry.health.Failures++
+			} else if state == connectivity.Ready {
+				entry.health.Failures = 0
+			}
+			entry.health.State = state
+			entry.health.Since = now
+		}
+		self.mu.Unlock()
+		du.LogD(tag, "connection to %s is %s", target, state)
+	}
+}
+
+// Close the connection to a target, it is dialed again on demand
+func (self *ConnManager) Remove(target string) {
+	self.mu.Lock()
+	entry, ok := self.conns[target]
+	delete(self.conns, target)
+	var conn *grpc.ClientConn
+	if ok {
+		conn = entry.conn
+		entry.conn, entry.client = nil, nil
+	}
+	self.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Health of the connections to all the targets dialed so far
+func (self *ConnManager) Health() map[string]ConnHealth {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	health := make(map[string]ConnHealth, len(self.conns))
+	for target, entry := range self.conns {
+		health[target] = entry.health
+	}
+	return health
+}
+
+// Close the connections that have not been used for IdleTimeout
+func (self *ConnManager) closeIdle() {
+	now := time.Now()
+	self.mu.Lock()
+	var idle []*grpc.ClientConn
+	for target, entry := range self.conns {
+		if entry.conn != nil && now.Sub(entry.health.LastUsed) > self.IdleTimeout {
+			du.LogD(tag, "close connection to %s idle since %s", target, entry.health.LastUsed)
+			idle = append(idle, entry.conn)
+			delete(self.conns, target)
+		}
+	}
+	self.mu.Unlock()
+	for _, conn := range idle {
+		conn.Close()
+	}
+}
+
+// Start closing idle connections in the background
+func (self *ConnManager) Start() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.stop != nil || self.IdleTimeout <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	self.stop = stop
+	self.running.Add(1)
+	go func() {
+		defer self.running.Done()
+		ticker := time.NewTicker(self.IdleTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				self.closeIdle()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close all the connections and wait for the background goroutines to exit
+func (self *ConnManager) Close() {
+	self.mu.Lock()
+	if self.stop != nil {
+		close(self.stop)
+		self.stop = nil
+	}
+	conns := self.conns
+	self.conns = make(map[string]*managedConn)
+	self.mu.Unlock()
+	for _, entry := range conns {
+		if entry.conn != nil {
+			entry.conn.Close()
+		}
+	}
+	self.running.Wait()
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	pb "panorama/build/gen"
+	du "panorama/util"
+)
+
+// A server that only needs to accept connections
+type idleServer struct {
+	pb.HealthServiceServer
+}
+
+func TestConnManager(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	pb.RegisterHealthServiceServer(s, &idleServer{})
+	go s.Serve(lis)
+	defer s.Stop()
+
+	conns := NewConnManager(grpc.WithInsecure())
+	defer conns.Close()
+	addr := lis.Addr().String()
+	c1, err := conns.Get("DHS_1", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := conns.Get("DHS_1", addr)
+	if err != nil || c1 != c2 {
+		t.Errorf("expecting the connection to DHS_1 to be reused, got %v", err)
+	}
+	if health := conns.Health()["DHS_1"]; health.Addr != addr || health.Failures != 0 {
+		t.Errorf("unexpected health of the connection to DHS_1: %+v", health)
+	}
+
+	// nobody listens at the address of DHS_2
+	down, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddr := down.Addr().String()
+	down.Close()
+	if _, err = conns.Get("DHS_2", downAddr); err == nil {
+		t.Fatal("expecting the dial to DHS_2 to fail")
+	}
+	if _, err = conns.Get("DHS_2", downAddr); err == nil || !strings.Contains(err.Error(), "backing off") {
+		t.Errorf("expecting the dial to DHS_2 to back off, got %v", err)
+	}
+	if health := conns.Health()["DHS_2"]; health.Failures != 1 || !health.RetryAt.After(time.Now()) {
+		t.Errorf("unexpected health of the connection to DHS_2: %+v", health)
+	}
+	// DHS_2 moved to a reachable address
+	if _, err = conns.Get("DHS_2", addr); err != nil {
+		t.Errorf("expecting a moved target to be dialed at once, got %v", err)
+	}
+
+	conns.IdleTimeout = time.Millisecond
+	time.Sleep(10 * time.Millisecond)
+	conns.closeIdle()
+	if health := conns.Health(); len(health) != 0 {
+		t.Errorf("expecting idle connections to be closed, got %d", len(health))
+	}
+}
@@ -0,0 +1,358 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Faults of the link from one peer to another
+type Link struct {
+	Latency time.Duration // one-way delay of each request and reply
+	Jitter  time.Duration // random extra delay up to this, so calls sent close together arrive out of order
+	Loss    float64       // probability that a request or a reply is lost
+}
+
+// A simulated network between named peers in memory, to run a whole cluster
+// in one process without sockets, e.g., in tests. Peers talk gRPC over
+// in-memory connections, and the calls between two peers are delayed,
+// reordered or lost as programmed for their link. Peers in different
+// partitions cannot reach each other until the partitions are healed.
+// The faults are drawn from a seeded source to be repeatable.
+type MemNetwork struct {
+	listeners map[string]*memListener // instances listening at each address
+	defaults  Link
+	links     map[string]Link // faults of the links set on their own, keyed by from and to
+	groups    map[string]int  // partition of each peer, 0 for the peers not in any
+	rand      *rand.Rand
+	mu        sync.Mutex
+}
+
+func NewMemNetwork(seed int64) *MemNetwork {
+	return &MemNetwork{
+		listeners: make(map[string]*memListener),
+		links:     make(map[string]Link),
+		groups:    make(map[string]int),
+		rand:      rand.New(rand.NewSource(seed)),
+	}
+}
+
+func linkKey(from string, to string) string {
+	return from + "\x00" + to
+}
+
+// Set the faults of all the links that are not set on their own
+func (self *MemNetwork) SetDefault(link Link) {
+	self.mu.Lock()
+	self.defaults = link
+	self.mu.Unlock()
+}
+
+// Set the faults of the link from one peer to another
+func (self *MemNetwork) SetLink(from string, to string, link Link) {
+	self.mu.Lock()
+	self.links[linkKey(from, to)] = link
+	self.mu.Unlock()
+}
+
+// Split the peers into partitions that cannot reach each other. The peers
+// not in any of the groups are in one more partition.
+func (self *MemNetwork) Partition(groups ...[]string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, peer := range group {
+			self.groups[peer] = i + 1
+		}
+	}
+}
+
+// Let all the peers reach each other again
+func (self *MemNetwork) Heal() {
+	self.Partition()
+}
+
+// Check if a peer can reach another, must be called with lock held
+func (self *MemNetwork) reachable(from string, to string) bool {
+	return self.groups[from] == self.groups[to]
+}
+
+// Get the peer listening at an address, empty if none
+func (self *MemNetwork) peerAt(addr string) string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if lis, ok := self.listeners[addr]; ok {
+		return lis.peer
+	}
+	return ""
+}
+
+// Decide the fate of a message from one peer to another: how long it takes
+// and whether it arrives
+func (self *MemNetwork) send(from string, to string) (time.Duration, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	link, ok := self.links[linkKey(from, to)]
+	if !ok {
+		link = self.defaults
+	}
+	delay := link.Latency
+	if link.Jitter > 0 {
+		delay += time.Duration(self.rand.Int63n(int64(link.Jitter)))
+	}
+	lost := link.Loss > 0 && self.rand.Float64() < link.Loss
+	return delay, !lost && self.reachable(from, to)
+}
+
+// Wait for a message to travel, false if the call is abandoned meanwhile
+func travel(ctx context.Context, delay time.Duration) bool {
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Apply the faults of the link to the peer called by a peer
+func (self *MemNetwork) intercept(from string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		to := self.peerAt(cc.Target())
+		delay, ok := self.send(from, to)
+		if !travel(ctx, delay) {
+			return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+		}
+		if !ok {
+			return status.Errorf(codes.Unavailable, "Request from %s to %s is lost", from, to)
+		}
+		if err := invoker(ctx, method, req, reply, cc, opts...); err != nil {
+			return err
+		}
+		delay, ok = self.send(to, from)
+		if !travel(ctx, delay) {
+			return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+		}
+		if !ok {
+			return status.Errorf(codes.Unavailable, "Reply from %s to %s is lost", to, from)
+		}
+		return nil
+	}
+}
+
+// Error of dialing an address nobody listens at, not worth retrying
+type refusedError struct {
+	addr string
+}
+
+func (self refusedError) Error() string {
+	return fmt.Sprintf("Connection to %s refused", self.addr)
+}
+
+func (self refusedError) Temporary() bool {
+	return false
+}
+
+// Connect to the peer listening at an address. Connections are established
+// even across partitions, only the calls over them fail.
+func (self *MemNetwork) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	self.mu.Lock()
+	lis, ok := self.listeners[addr]
+	self.mu.Unlock()
+	if !ok {
+		return nil, refusedError{addr}
+	}
+	c2s, s2c := newMemPipe(), newMemPipe()
+	client := &memConn{r: s2c, w: c2s, local: memAddr("client:" + addr), remote: memAddr(addr)}
+	server := &memConn{r: c2s, w: s2c, local: memAddr(addr), remote: client.local}
+	select {
+	case lis.conns <- server:
+		return client, nil
+	case <-lis.done:
+		return nil, refusedError{addr}
+	}
+}
+
+func (self *MemNetwork) listen(peer string, addr string) (net.Listener, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if _, ok := self.listeners[addr]; ok {
+		return nil, fmt.Errorf("Address %s is already in use", addr)
+	}
+	lis := &memListener{network: self, peer: peer, addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+	self.listeners[addr] = lis
+	return lis, nil
+}
+
+// Get the transport of a peer on the network, which dials insecurely unless
+// given other options
+func (self *MemNetwork) Transport(peer string) *MemTransport {
+	conns := NewConnManager(append([]grpc.DialOption{grpc.WithInsecure()}, self.dialOptions(peer)...)...)
+	return &MemTransport{ConnManager: conns, network: self, peer: peer}
+}
+
+// Options to dial the other peers on the network from a peer
+func (self *MemNetwork) dialOptions(peer string) []grpc.DialOption {
+	return []grpc.DialOption{grpc.WithDialer(self.dial), grpc.WithUnaryInterceptor(self.intercept(peer))}
+}
+
+// The transport of a peer on a MemNetwork
+type MemTransport struct {
+	*ConnManager
+	network *MemNetwork
+	peer    string
+}
+
+func (self *MemTransport) Listen(addr string) (net.Listener, error) {
+	return self.network.listen(self.peer, addr)
+}
+
+// The calls still go through the network, whatever the options of the caller
+func (self *MemTransport) SetDefaultOptions(authority bool, options ...grpc.DialOption) {
+	options = append(append([]grpc.DialOption{}, options...), self.network.dialOptions(self.peer)...)
+	self.ConnManager.SetDefaultOptions(authority, options...)
+}
+
+type memAddr string
+
+func (self memAddr) Network() string {
+	return "mem"
+}
+
+func (self memAddr) String() string {
+	return string(self)
+}
+
+type memListener struct {
+	network *MemNetwork
+	peer    string
+	addr    string
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (self *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-self.conns:
+		return conn, nil
+	case <-self.done:
+		return nil, fmt.Errorf("Listener at %s is closed", self.addr)
+	}
+}
+
+func (self *memListener) Close() error {
+	self.once.Do(func() {
+		close(self.done)
+		self.network.mu.Lock()
+		if self.network.listeners[self.addr] == self {
+			delete(self.network.listeners, self.addr)
+		}
+		self.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (self *memListener) Addr() net.Addr {
+	return memAddr(self.addr)
+}
+
+// One direction of an in-memory connection. Unlike net.Pipe, writes are
+// buffered so that both ends may write at the same time.
+type memPipe struct {
+	buf    bytes.Buffer
+	closed bool
+	mu     sync.Mutex
+	cond   *sync.Cond
+}
+
+func newMemPipe() *memPipe {
+	pipe := &memPipe{}
+	pipe.cond = sync.NewCond(&pipe.mu)
+	return pipe
+}
+
+func (self *memPipe) Read(b []byte) (int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for self.buf.Len() == 0 && !self.closed {
+		self.cond.Wait()
+	}
+	if self.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return self.buf.Read(b)
+}
+
+func (self *memPipe) Write(b []byte) (int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return 0, io.ErrClosedPipe
+	}
+	self.cond.Broadcast()
+	return self.buf.Write(b)
+}
+
+func (self *memPipe) Close() {
+	self.mu.Lock()
+	self.closed = true
+	self.cond.Broadcast()
+	self.mu.Unlock()
+}
+
+type memConn struct {
+	r, w   *memPipe
+	local  memAddr
+	remote memAddr
+}
+
+func (self *memConn) Read(b []byte) (int, error) {
+	return self.r.Read(b)
+}
+
+func (self *memConn) Write(b []byte) (int, error) {
+	return self.w.Write(b)
+}
+
+func (self *memConn) Close() error {
+	self.r.Close()
+	self.w.Close()
+	return nil
+}
+
+func (self *memConn) LocalAddr() net.Addr {
+	return self.local
+}
+
+func (self *memConn) RemoteAddr() net.Addr {
+	return self.remote
+}
+
+// Deadlines are not supported, the calls time out through their contexts
+func (self *memConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (self *memConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (self *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
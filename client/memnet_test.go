@@ -0,0 +1,81 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "panorama/build/gen"
+	du "panorama/util"
+)
+
+// A server that only answers pings
+type pingServer struct {
+	pb.HealthServiceServer
+}
+
+func (self *pingServer) Ping(ctx context.Context, in *pb.PingRequest) (*pb.PingReply, error) {
+	return &pb.PingReply{Result: pb.PingReply_GOOD}, nil
+}
+
+func TestMemNetwork(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	network := NewMemNetwork(1)
+	for _, peer := range []string{"DHS_1", "DHS_2"} {
+		lis, err := network.Transport(peer).Listen(peer + ":6688")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := grpc.NewServer()
+		pb.RegisterHealthServiceServer(s, &pingServer{})
+		go s.Serve(lis)
+		defer s.Stop()
+	}
+	if _, err := network.Transport("DHS_3").Listen("DHS_1:6688"); err == nil {
+		t.Error("expecting the address of DHS_1 to be in use")
+	}
+
+	transport := network.Transport("DHS_1")
+	defer transport.Close()
+	ping := func() error {
+		client, err := transport.Get("DHS_2", "DHS_2:6688")
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err = client.Ping(ctx, &pb.PingRequest{})
+		return err
+	}
+	network.SetLink("DHS_1", "DHS_2", Link{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	if err := ping(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expecting the ping to take the latency of the link, took %s", elapsed)
+	}
+
+	network.Partition([]string{"DHS_1"}, []string{"DHS_2"})
+	if err := ping(); status.Code(err) != codes.Unavailable {
+		t.Errorf("expecting DHS_2 to be unreachable across the partition, got %v", err)
+	}
+	network.Heal()
+	if err := ping(); err != nil {
+		t.Errorf("expecting DHS_2 to be reachable once healed, got %v", err)
+	}
+
+	network.SetLink("DHS_2", "DHS_1", Link{Loss: 1})
+	if err := ping(); status.Code(err) != codes.Unavailable {
+		t.Errorf("expecting the reply of DHS_2 to be lost, got %v", err)
+	}
+
+	start = time.Now()
+	if _, err := transport.Get("DHS_3", "DHS_3:6688"); err == nil || time.Since(start) > time.Second {
+		t.Errorf("expecting the dial to nobody to be refused at once, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+func loadCAs(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to read certificate authorities: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificate authority found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// Credentials to serve TLS with a certificate. With mutual TLS, the clients
+// must present certificates issued by the authorities in caFile.
+func ServerTLS(certFile string, keyFile string, caFile string, mutual bool) (credentials.TransportCredentials, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to load server certificate: %s", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if mutual {
+		if len(caFile) == 0 {
+			return nil, fmt.Errorf("Mutual TLS requires the certificate authorities of the clients")
+		}
+		config.ClientCAs, err = loadCAs(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// Credentials to reach servers with TLS. The servers are verified by the
+// authorities in caFile, or the ones of the system if empty, and against
+// serverName instead of the address dialed if set. A certificate is presented
+// to the servers if certFile is set.
+func ClientTLS(certFile string, keyFile string, caFile string, serverName string) (credentials.TransportCredentials, error) {
+	config := &tls.Config{ServerName: serverName}
+	if len(certFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Fail to load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if len(caFile) > 0 {
+		pool, err := loadCAs(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// Identities in the verified certificate of the caller of an RPC, its common
+// name and DNS names, none without mutual TLS
+func PeerIdentities(ctx context.Context) []string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := info.State.VerifiedChains[0][0]
+	return append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	TOKEN_KEY = "token" // metadata carrying the token of the caller of an RPC
+)
+
+type tokenCredentials string
+
+func (self tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{TOKEN_KEY: string(self)}, nil
+}
+
+func (self tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// Option to present a token in every RPC to authorize the calls with
+func WithToken(token string) grpc.DialOption {
+	return grpc.WithPerRPCCredentials(tokenCredentials(token))
+}
+
+// Token presented by the caller of an RPC, empty if none
+func CallerToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md[TOKEN_KEY]) == 0 {
+		return ""
+	}
+	return md[TOKEN_KEY][0]
+}
@@ -0,0 +1,38 @@
+package client
+
+import (
+	"net"
+
+	"google.golang.org/grpc"
+
+	pb "panorama/build/gen"
+)
+
+// How Panorama instances reach each other. The default transport is gRPC over
+// TCP through a ConnManager, while a MemNetwork runs a cluster in memory.
+type Transport interface {
+	// Listen for the connections of the peers at an address
+	Listen(addr string) (net.Listener, error)
+
+	// Get a client to a target, usually the id of a peer, at an address
+	Get(target string, addr string) (pb.HealthServiceClient, error)
+
+	// Close the connection to a target
+	Remove(target string)
+
+	// Dial the targets with the options of the caller, e.g., its credentials,
+	// and verify their certificates against the targets if authority is set
+	SetDefaultOptions(authority bool, options ...grpc.DialOption)
+
+	// Health of the connections to all the targets
+	Health() map[string]ConnHealth
+
+	// Start the background maintenance of the connections
+	Start()
+
+	// Close all the connections
+	Close()
+}
+
+var _ Transport = new(ConnManager)
+var _ Transport = new(MemTransport)
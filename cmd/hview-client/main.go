@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
@@ -15,23 +16,42 @@ import (
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	pb "panorama/build/gen"
+	dc "panorama/client"
 	dt "panorama/types"
 )
 
 var (
-	server = flag.String("server", "", "Address of health server to report events to (Required)")
+	server        = flag.String("server", "", "Address of health server to report events to (Required)")
+	token         = flag.String("token", "", "Token of the observer to register with the health server, if required")
+	authToken     = flag.String("auth_token", "", "Token to authorize the calls to the health server with, if required")
+	tlsCert       = flag.String("tls_cert", "", "Certificate to present to the health server with mutual TLS")
+	tlsKey        = flag.String("tls_key", "", "Private key of the certificate")
+	tlsCA         = flag.String("tls_ca", "", "Certificate authorities to verify the health server with, enables TLS")
+	tlsServerName = flag.String("tls_server_name", "", "Name in the certificate of the health server, e.g., its id, if not its host")
 )
 
 const (
 	cmdHelp = `Command list:
 	 me observer
 	 report subject [<metric:status:score...>]
-	 list [subject]
-	 get [report|view|inference|panorama] [observer] subject 
-	 dump [inference|panorama]
+	 list [subject [selector]|silence|queue|peer|subscription|registration|federation]
+	 get [report|view|inference|panorama|merged] [observer] subject 
+	 dump [inference [selector]|panorama]
+	 cluster [panorama|inference] subject [quorum]
+	 cluster dump [selector]
+	 label subject [key=value|-key...]
+	 group selector [group_by] [min_unhealthy]
+	 incidents [all]
+	 rootcause subject
+	 owners subject
 	 tail freq [get|dump]...
+	 silence [subject|observer|all] entity duration [exclude|flag] [reason...]
+	 unsilence id
+	 peer [add id addr|remove id]
 	 ping
 	 help
 	 exit
@@ -140,7 +160,10 @@ func register() error {
 	if len(observer) == 0 {
 		observer = "client"
 	}
-	reply, err := client.Register(context.Background(), &pb.RegisterRequest{Module: "default", Observer: observer})
+	host, _ := os.Hostname()
+	info := &pb.ObserverInfo{Host: host, Process: filepath.Base(os.Args[0]), Pid: uint32(os.Getpid())}
+	reply, err := client.Register(context.Background(), &pb.RegisterRequest{Module: "default", Observer: observer,
+		Token: *token, Info: info})
 	if err != nil {
 		return err
 	}
@@ -205,13 +228,37 @@ func exeGet(args []string) {
 				fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
 			}
 		}
+	case "merged":
+		{
+			if len(args) != 3 {
+				fmt.Println(cmdHelp)
+				return
+			}
+			reply, err := client.GetMergedInference(context.Background(), &pb.GetInferenceRequest{Subject: args[2]})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+				return
+			}
+			if reply.Local != nil {
+				fmt.Printf("local:\t%s\n", dt.InferenceString(reply.Local))
+			}
+			peers := make([]string, 0, len(reply.Remote))
+			for peer := range reply.Remote {
+				peers = append(peers, peer)
+			}
+			sort.Strings(peers)
+			for _, peer := range peers {
+				fmt.Printf("%s:\t%s\n", peer, dt.InferenceString(reply.Remote[peer]))
+			}
+			fmt.Printf("merged:\t%s\n", dt.InferenceString(reply.Inference))
+		}
 	default:
 		fmt.Println(cmdHelp)
 	}
 }
 
 func exeDump(args []string) {
-	if len(args) != 2 {
+	if len(args) < 2 || len(args) > 3 {
 		fmt.Println(cmdHelp)
 		return
 	}
@@ -235,7 +282,11 @@ func exeDump(args []string) {
 		}
 	case "inference":
 		{
-			tenants, err := client.DumpInference(context.Background(), &empty)
+			var selector string
+			if len(args) == 3 {
+				selector = args[2]
+			}
+			tenants, err := client.DumpInference(context.Background(), &pb.DumpInferenceRequest{Selector: selector})
 			if err == nil {
 				keys := make([]string, 0, len(tenants.Inferences))
 				for key := range tenants.Inferences {
@@ -255,9 +306,225 @@ func exeDump(args []string) {
 	}
 }
 
+func exeCluster(args []string) {
+	if len(args) < 2 || len(args) > 4 {
+		fmt.Println(cmdHelp)
+		return
+	}
+	request := &pb.ClusterQueryRequest{}
+	if args[1] == "dump" {
+		if len(args) == 3 {
+			request.Selector = args[2]
+		}
+		reply, err := client.DumpClusterInference(context.Background(), request)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+			return
+		}
+		keys := make([]string, 0, len(reply.Inferences))
+		for key := range reply.Inferences {
+			keys = append(keys, key)
+		}
+		sortSubjects(keys)
+		for _, key := range keys {
+			fmt.Printf("=============%s=============\n", key)
+			fmt.Println(dt.InferenceString(reply.Inferences[key]))
+		}
+		fmt.Printf("answered by %s\n", strings.Join(reply.Responders, ","))
+		return
+	}
+	if len(args) < 3 {
+		fmt.Println(cmdHelp)
+		return
+	}
+	request.Subject = args[2]
+	if len(args) == 4 {
+		quorum, err := strconv.Atoi(args[3])
+		if err != nil || quorum < 0 {
+			fmt.Println("Error, quorum must be a non-negative number")
+			return
+		}
+		request.Quorum = uint32(quorum)
+	}
+	switch args[1] {
+	case "panorama":
+		reply, err := client.GetClusterPanorama(context.Background(), request)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+			return
+		}
+		dt.DumpPanorama(os.Stdout, reply.Panorama)
+		fmt.Printf("answered by %s\n", strings.Join(reply.Responders, ","))
+	case "inference":
+		reply, err := client.GetClusterInference(context.Background(), request)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+			return
+		}
+		fmt.Println(dt.InferenceString(reply.Inference))
+		fmt.Printf("answered by %s\n", strings.Join(reply.Responders, ","))
+	default:
+		fmt.Println(cmdHelp)
+	}
+}
+
+func exeSilence(args []string) {
+	if len(args) < 4 {
+		fmt.Println(cmdHelp)
+		return
+	}
+	duration, err := time.ParseDuration(args[3])
+	if err != nil || duration <= 0 {
+		fmt.Println("Error, duration must be positive, e.g., 10m")
+		return
+	}
+	now := time.Now()
+	start, _ := ptypes.TimestampProto(now)
+	end, _ := ptypes.TimestampProto(now.Add(duration))
+	silence := &pb.Silence{Start: start, End: end, Creator: observer}
+	if len(args) > 4 {
+		switch args[4] {
+		case "exclude":
+			silence.Mode = pb.Silence_EXCLUDE
+		case "flag":
+			silence.Mode = pb.Silence_FLAG
+		default:
+			fmt.Println(cmdHelp)
+			return
+		}
+	}
+	if len(args) > 5 {
+		silence.Reason = strings.Join(args[5:], " ")
+	}
+	var silences []*pb.Silence
+	switch args[1] {
+	case "subject":
+		silence.Subject = args[2]
+		silences = append(silences, silence)
+	case "observer":
+		silence.Observer = args[2]
+		silences = append(silences, silence)
+	case "all":
+		// a silence on both only covers the reports the entity makes about itself
+		bySubject := *silence
+		bySubject.Subject = args[2]
+		byObserver := *silence
+		byObserver.Observer = args[2]
+		silences = append(silences, &bySubject, &byObserver)
+	default:
+		fmt.Println(cmdHelp)
+		return
+	}
+	for _, silence := range silences {
+		reply, err := client.Silence(context.Background(), &pb.SilenceRequest{Silence: silence})
+		if err == nil {
+			fmt.Println(reply.Id)
+		} else {
+			fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+		}
+	}
+}
+
+func exeLabel(args []string) {
+	if len(args) < 2 {
+		fmt.Println(cmdHelp)
+		return
+	}
+	request := &pb.LabelSubjectRequest{Subject: args[1], Labels: make(map[string]string)}
+	for _, arg := range args[2:] {
+		if strings.HasPrefix(arg, "-") {
+			request.Remove = append(request.Remove, arg[1:])
+			continue
+		}
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			logError(fmt.Errorf("invalid label %s\n", arg))
+			return
+		}
+		request.Labels[parts[0]] = parts[1]
+	}
+	reply, err := client.LabelSubject(context.Background(), request)
+	if err == nil {
+		fmt.Printf("%s\t%s\n", args[1], dt.LabelsString(reply.Labels))
+	} else {
+		fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+	}
+}
+
+func exeGroup(args []string) {
+	if len(args) < 2 || len(args) > 4 {
+		fmt.Println(cmdHelp)
+		return
+	}
+	request := &pb.GetGroupInferenceRequest{Selector: args[1]}
+	if len(args) > 2 {
+		request.GroupBy = args[2]
+	}
+	if len(args) > 3 {
+		ratio, err := strconv.ParseFloat(args[3], 32)
+		if err != nil || ratio < 0 || ratio > 1 {
+			fmt.Println("Error, min_unhealthy must be a ratio between 0 and 1")
+			return
+		}
+		request.MinUnhealthy = float32(ratio)
+	}
+	reply, err := client.GetGroupInference(context.Background(), request)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+		return
+	}
+	for _, group := range reply.Groups {
+		fmt.Printf("=============%s=%s=============\n", group.Key, group.Value)
+		fmt.Printf("unhealthy %d/%d (%.0f%%): %s\n", len(group.Unhealthy), len(group.Members),
+			group.UnhealthyRatio*100, strings.Join(group.Unhealthy, ","))
+		if group.Observation != nil {
+			fmt.Println(dt.ObservationString(group.Observation))
+		}
+	}
+}
+
+func incidentString(incident *pb.Incident) string {
+	start, _ := ptypes.Timestamp(incident.Start)
+	period := start.Local().Format(time.Stamp) + " ~ now"
+	if incident.End != nil {
+		end, _ := ptypes.Timestamp(incident.End)
+		period = start.Local().Format(time.Stamp) + " ~ " + end.Local().Format(time.Stamp)
+	}
+	return fmt.Sprintf("%s\t%s=%s\t%s\t%d/%d failed: %s\t%s", incident.Id, incident.Key, incident.Value,
+		incident.Status, len(incident.Members), incident.Size, strings.Join(incident.Members, ","), period)
+}
+
+func silenceString(silence *pb.Silence) string {
+	start, _ := ptypes.Timestamp(silence.Start)
+	end, _ := ptypes.Timestamp(silence.End)
+	return fmt.Sprintf("%s\tsubject=%s observer=%s\t%s ~ %s\t%s\t%s", silence.Id, silence.Subject,
+		silence.Observer, start.Local().Format(time.Stamp), end.Local().Format(time.Stamp),
+		silence.Mode, silence.Reason)
+}
+
 func runCmd(args []string) bool {
 	cmd := args[0]
 	switch cmd {
+	case "peer":
+		{
+			var reply *pb.MembershipReply
+			var err error
+			if len(args) == 4 && args[1] == "add" {
+				reply, err = client.AddPeer(context.Background(), &pb.Peer{Id: args[2], Addr: args[3]})
+			} else if len(args) == 3 && args[1] == "remove" {
+				reply, err = client.RemovePeer(context.Background(), &pb.Peer{Id: args[2]})
+			} else {
+				fmt.Println(cmdHelp)
+				return false
+			}
+			if err == nil {
+				for _, member := range reply.Members {
+					fmt.Printf("%s\t%s\n", member.Peer.Id, member.Peer.Addr)
+				}
+			} else {
+				fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+			}
+		}
 	case "ping":
 		{
 			now := time.Now()
@@ -284,6 +551,14 @@ func runCmd(args []string) bool {
 		{
 			r := parseReport(args)
 			reply, err := client.SubmitReport(context.Background(), &pb.SubmitReportRequest{Handle: handle, Report: r})
+			if status.Code(err) == codes.NotFound && register() == nil {
+				// the registration expired
+				reply, err = client.SubmitReport(context.Background(), &pb.SubmitReportRequest{Handle: handle, Report: r})
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+				return false
+			}
 			switch reply.Result {
 			case pb.SubmitReportReply_ACCEPTED:
 				fmt.Println("Accepted")
@@ -292,17 +567,90 @@ func runCmd(args []string) bool {
 			case pb.SubmitReportReply_FAILED:
 				fmt.Println("Failed")
 			}
-			if err != nil {
-				fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
-				return false
-			}
 		}
 	case "get":
 		exeGet(args)
 		return false
+	case "silence":
+		exeSilence(args)
+		return false
+	case "unsilence":
+		{
+			if len(args) != 2 {
+				fmt.Println(cmdHelp)
+				return false
+			}
+			reply, err := client.Unsilence(context.Background(), &pb.UnsilenceRequest{Id: args[1]})
+			if err == nil {
+				fmt.Printf("Ended %s\n", reply.Id)
+			} else {
+				fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+			}
+			return false
+		}
 	case "dump":
 		exeDump(args)
 		return false
+	case "cluster":
+		exeCluster(args)
+		return false
+	case "label":
+		exeLabel(args)
+		return false
+	case "group":
+		exeGroup(args)
+		return false
+	case "owners":
+		{
+			if len(args) != 2 {
+				fmt.Println(cmdHelp)
+				return false
+			}
+			reply, err := client.GetOwners(context.Background(), &pb.GetOwnersRequest{Subject: args[1]})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+				return false
+			}
+			for _, owner := range reply.Owners {
+				fmt.Printf("%s\t%s\n", owner.Id, owner.Addr)
+			}
+		}
+	case "rootcause":
+		{
+			if len(args) != 2 {
+				fmt.Println(cmdHelp)
+				return false
+			}
+			reply, err := client.GetRootCause(context.Background(), &pb.GetRootCauseRequest{Subject: args[1]})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+				return false
+			}
+			if len(reply.Causes) == 0 {
+				fmt.Printf("No unhealthy evidence along the dependencies of %s\n", args[1])
+			}
+			for _, cause := range reply.Causes {
+				fmt.Printf("%5.1f%%\t%s\t%s\t%s\n", cause.Score*100, cause.Subject, cause.Status,
+					strings.Join(cause.Path, " -> "))
+			}
+			return false
+		}
+	case "incidents":
+		{
+			if len(args) > 2 || (len(args) == 2 && args[1] != "all") {
+				fmt.Println(cmdHelp)
+				return false
+			}
+			reply, err := client.GetIncidents(context.Background(), &pb.GetIncidentsRequest{Resolved: len(args) == 2})
+			if err == nil {
+				for _, incident := range reply.Incidents {
+					fmt.Println(incidentString(incident))
+				}
+			} else {
+				fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+			}
+			return false
+		}
 	case "tail":
 		{
 			if len(args) < 3 {
@@ -333,18 +681,130 @@ func runCmd(args []string) bool {
 		}
 	case "list":
 		{
-			if len(args) != 2 {
+			if len(args) < 2 || len(args) > 3 {
 				fmt.Println(cmdHelp)
 				return false
 			}
 			switch args[1] {
 			case "subject":
 				{
-					reply, err := client.GetObservedSubjects(context.Background(), &empty)
+					var selector string
+					if len(args) == 3 {
+						selector = args[2]
+					}
+					reply, err := client.GetObservedSubjects(context.Background(), &pb.GetObservedSubjectsRequest{Selector: selector})
 					if err == nil {
 						for subject, ts := range reply.Subjects {
 							t, _ := ptypes.Timestamp(ts)
-							fmt.Printf("%s\t%s\n", subject, t)
+							var labels string
+							if sl, ok := reply.Labels[subject]; ok {
+								labels = dt.LabelsString(sl.Labels)
+							}
+							fmt.Printf("%s\t%s\t%s\n", subject, t, labels)
+						}
+					} else {
+						fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+					}
+				}
+			case "queue":
+				{
+					reply, err := client.GetPeerQueues(context.Background(), &empty)
+					if err == nil {
+						peers := make([]string, 0, len(reply.Queues))
+						for peer := range reply.Queues {
+							peers = append(peers, peer)
+						}
+						sortSubjects(peers)
+						for _, peer := range peers {
+							q := reply.Queues[peer]
+							fmt.Printf("%s\tdepth=%d/%d sent=%d batches=%d dropped=%d failed=%d outbox=%d expired=%d outbox_dropped=%d\n",
+								peer, q.Depth, q.Capacity, q.Sent, q.Batches, q.Dropped, q.Failed, q.Outbox, q.Expired, q.OutboxDropped)
+						}
+					} else {
+						fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+					}
+				}
+			case "peer":
+				{
+					reply, err := client.GetPeerStatus(context.Background(), &empty)
+					if err == nil {
+						for _, status := range reply.Peers {
+							last := "never"
+							if status.LastHeartbeat != nil {
+								last = ptypes.TimestampString(status.LastHeartbeat)
+							}
+							conn := status.Connection
+							if len(conn) == 0 {
+								conn = "NONE"
+							}
+							fmt.Printf("%s\t%s\t%s phi=%.2f rtt=%.2fms missed=%d last=%s conn=%s conn_failures=%d\n", status.Peer.Id,
+								status.Peer.Addr, status.State, status.Phi, status.Rtt, status.Missed, last, conn, status.ConnFailures)
+						}
+					} else {
+						fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+					}
+				}
+			case "subscription":
+				{
+					reply, err := client.GetSubscriptions(context.Background(), &empty)
+					if err == nil {
+						fmt.Printf("subscribed to %s\n", strings.Join(reply.Subscribed, ","))
+						for _, lease := range reply.Leases {
+							fmt.Printf("%s\t%s\texpires=%s\n", lease.Subject, lease.Peer, ptypes.TimestampString(lease.Expires))
+						}
+					} else {
+						fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+					}
+				}
+			case "registration":
+				{
+					reply, err := client.ListRegistrations(context.Background(), &empty)
+					if err == nil {
+						for _, reg := range reply.Registrations {
+							last, expires := "never", "never"
+							if reg.LastSubmission != nil {
+								last = ptypes.TimestampString(reg.LastSubmission)
+							}
+							if reg.Expires != nil {
+								expires = ptypes.TimestampString(reg.Expires)
+							}
+							fmt.Printf("%d\t%s\t%s\tregistered=%s last=%s expires=%s\n", reg.Handle, reg.Module, reg.Observer,
+								ptypes.TimestampString(reg.Time), last, expires)
+							if info := reg.Info; info != nil {
+								fmt.Printf("\tkind=%s host=%s process=%s[%d] version=%s metrics=%s\n", info.Kind, info.Host,
+									info.Process, info.Pid, info.Version, strings.Join(info.Metrics, ","))
+							}
+						}
+					} else {
+						fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+					}
+				}
+			case "federation":
+				{
+					reply, err := client.GetFederation(context.Background(), &empty)
+					if err == nil {
+						for _, cluster := range reply.Clusters {
+							last := "never"
+							if cluster.LastPull != nil {
+								last = ptypes.TimestampString(cluster.LastPull)
+							}
+							if len(cluster.Error) > 0 {
+								fmt.Printf("%s\tlast=%s error=%s\n", cluster.Name, last, cluster.Error)
+							} else {
+								fmt.Printf("%s\tlast=%s from=%s subjects=%d responders=%s\n", cluster.Name, last, cluster.Addr,
+									cluster.Subjects, strings.Join(cluster.Responders, ","))
+							}
+						}
+					} else {
+						fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
+					}
+				}
+			case "silence":
+				{
+					reply, err := client.ListSilences(context.Background(), &empty)
+					if err == nil {
+						for _, silence := range reply.Silences {
+							fmt.Println(silenceString(silence))
 						}
 					} else {
 						fmt.Fprintln(os.Stderr, grpc.ErrorDesc(err))
@@ -428,15 +888,29 @@ func main() {
 		}
 		addr = host + ":6688"
 	}
-	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	option := grpc.WithInsecure()
+	if len(*tlsCert) > 0 || len(*tlsCA) > 0 {
+		creds, err := dc.ClientTLS(*tlsCert, *tlsKey, *tlsCA, *tlsServerName)
+		if err != nil {
+			panic(err)
+		}
+		option = grpc.WithTransportCredentials(creds)
+	}
+	options := []grpc.DialOption{option}
+	if len(*authToken) > 0 {
+		options = append(options, dc.WithToken(*authToken))
+	}
+	conns := dc.NewConnManager(options...)
+	defer conns.Close()
+	var err error
+	client, err = conns.Get(addr, addr)
 	if err != nil {
-		panic(fmt.Sprintf("Could not connect to %s: %v", *server, err))
+		panic(fmt.Sprintf("Could not connect to %s: %v", addr, err))
 	}
-	defer conn.Close()
-	client = pb.NewHealthServiceClient(conn)
 	err = register()
 	if err != nil {
-		panic(fmt.Sprintf("Fail to register with the health service: %v", err))
+		// queries don't need a registration, e.g., without the token of the observer
+		fmt.Fprintf(os.Stderr, "Fail to register with the health service, reports will be rejected: %v\n", err)
 	}
 	if len(args) == 0 {
 		runPrompt()
@@ -4,24 +4,36 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hpcloud/tail"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	pb "panorama/build/gen"
+	dc "panorama/client"
 	dp "panorama/plugin"
 	dt "panorama/types"
 )
 
 var (
-	report       = flag.Bool("report", true, "Whether to report events to health service")
-	staleSeconds = flag.Float64("stale", 5*60, "Cutoff in seconds to skip stale events. -1 means no check for staleness.")
-	mergeSeconds = flag.Float64("merge", 1, "Do not repeated report event for a subject within the given time.")
-	log          = flag.String("log", "", "Log file to watch for (Required)")
-	server       = flag.String("server", "", "Address of health server to report events to (Required)")
+	report        = flag.Bool("report", true, "Whether to report events to health service")
+	staleSeconds  = flag.Float64("stale", 5*60, "Cutoff in seconds to skip stale events. -1 means no check for staleness.")
+	mergeSeconds  = flag.Float64("merge", 1, "Do not repeated report event for a subject within the given time.")
+	log           = flag.String("log", "", "Log file to watch for (Required)")
+	server        = flag.String("server", "", "Address of health server to report events to (Required)")
+	token         = flag.String("token", "", "Token of the observer to register with the health server, if required")
+	version       = flag.String("observer_version", "", "Version of the observer, e.g., of the component whose log is watched")
+	authToken     = flag.String("auth_token", "", "Token to authorize the calls to the health server with, if required")
+	tlsCert       = flag.String("tls_cert", "", "Certificate to present to the health server with mutual TLS")
+	tlsKey        = flag.String("tls_key", "", "Private key of the certificate")
+	tlsCA         = flag.String("tls_ca", "", "Certificate authorities to verify the health server with, enables TLS")
+	tlsServerName = flag.String("tls_server_name", "", "Name in the certificate of the health server, e.g., its id, if not its host")
 )
 
 type report_key struct {
@@ -36,13 +48,60 @@ var ipEntities = make(map[string]string)
 var staleCutoff float64
 var mergeCutoff float64
 var reportHandle uint64
+var handleMu sync.Mutex
 
 func usage() {
 	fmt.Printf("Usage: %s OPTIONS <plugin> [PLUGIN OPTIONS]...\n\n", os.Args[0])
 	flag.PrintDefaults()
 }
 
-func reportEvent(client pb.HealthServiceClient, event *dt.Event) error {
+// Register the observer of the plugin, again if its registration expired,
+// and get the seconds the registration lasts
+func register(client pb.HealthServiceClient, module dt.ObserverModule) (uint32, error) {
+	host, _ := os.Hostname()
+	info := &pb.ObserverInfo{
+		Host:    host,
+		Process: filepath.Base(os.Args[0]),
+		Pid:     uint32(os.Getpid()),
+		Version: *version,
+		Kind:    pb.ObserverInfo_IN_SITU, // the observer's own log tells what it sees
+	}
+	reply, err := client.Register(context.Background(), &pb.RegisterRequest{Module: module.Module, Observer: module.Observer,
+		Token: *token, Info: info})
+	if err != nil {
+		return 0, err
+	}
+	if reply.Capabilities != nil {
+		fmt.Printf("Registered with %s as handle %d, features: %s\n", reply.Capabilities.Id, reply.Handle,
+			strings.Join(reply.Capabilities.Features, ","))
+	}
+	handleMu.Lock()
+	reportHandle = reply.Handle
+	handleMu.Unlock()
+	return reply.Lease, nil
+}
+
+func getHandle() uint64 {
+	handleMu.Lock()
+	defer handleMu.Unlock()
+	return reportHandle
+}
+
+// Renew the registration so that it does not expire while the log is quiet
+func keepRegistered(client pb.HealthServiceClient, module dt.ObserverModule, lease time.Duration) {
+	for {
+		time.Sleep(lease / 3)
+		_, err := client.RenewRegistration(context.Background(), &pb.HandleRequest{Handle: getHandle(), Observer: module.Observer})
+		if status.Code(err) == codes.NotFound {
+			_, err = register(client, module)
+		}
+		if err != nil {
+			fmt.Printf("Fail to renew registration: %v\n", err)
+		}
+	}
+}
+
+func reportEvent(client pb.HealthServiceClient, module dt.ObserverModule, event *dt.Event) error {
 	key := report_key{event.Subject, event.Context, event.Status, int32(event.Score)}
 	if mergeCutoff > 0 {
 		ts, ok := lastReportTime[key]
@@ -57,7 +116,13 @@ func reportEvent(client pb.HealthServiceClient, event *dt.Event) error {
 		Subject:     event.Subject,
 		Observation: observation,
 	}
-	reply, err := client.SubmitReport(context.Background(), &pb.SubmitReportRequest{Handle: reportHandle, Report: report})
+	reply, err := client.SubmitReport(context.Background(), &pb.SubmitReportRequest{Handle: getHandle(), Report: report})
+	if status.Code(err) == codes.NotFound {
+		// the registration expired, e.g., the health server restarted long ago
+		if _, err = register(client, module); err == nil {
+			reply, err = client.SubmitReport(context.Background(), &pb.SubmitReportRequest{Handle: getHandle(), Report: report})
+		}
+	}
 	if err != nil {
 		return err
 	}
@@ -121,18 +186,32 @@ func main() {
 			}
 			addr = host + ":6688"
 		}
-		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		option := grpc.WithInsecure()
+		if len(*tlsCert) > 0 || len(*tlsCA) > 0 {
+			creds, err := dc.ClientTLS(*tlsCert, *tlsKey, *tlsCA, *tlsServerName)
+			if err != nil {
+				panic(err)
+			}
+			option = grpc.WithTransportCredentials(creds)
+		}
+		options := []grpc.DialOption{option}
+		if len(*authToken) > 0 {
+			options = append(options, dc.WithToken(*authToken))
+		}
+		conns := dc.NewConnManager(options...)
+		defer conns.Close()
+		client, err = conns.Get(addr, addr)
 		if err != nil {
-			panic(fmt.Sprintf("Could not connect to %s: %v", *server, err))
+			panic(fmt.Sprintf("Could not connect to %s: %v", addr, err))
 		}
-		defer conn.Close()
-		client = pb.NewHealthServiceClient(conn)
 
-		reply, err := client.Register(context.Background(), &pb.RegisterRequest{Module: module.Module, Observer: module.Observer})
+		lease, err := register(client, module)
 		if err != nil {
 			panic(fmt.Sprintf("Fail to register with DeepHealth service: %v", err))
 		}
-		reportHandle = reply.Handle
+		if lease > 0 {
+			go keepRegistered(client, module, time.Duration(lease)*time.Second)
+		}
 	}
 
 	fmt.Println("Sleeping 3 seconds to stabilize")
@@ -153,7 +232,7 @@ func main() {
 			}
 			fmt.Println(event)
 			if *report {
-				err = reportEvent(client, event)
+				err = reportEvent(client, module, event)
 				if err != nil {
 					fmt.Printf("Error in reporting event: %s\n", err)
 				}
@@ -27,6 +27,9 @@ var (
 	filter    = flag.Bool("filter", false, "whether to filter health reports based on subjects")
 	dbfile    = flag.String("dbfile", "deephealth.db", "database file to persist health information")
 	output    = flag.String("output", "", "file path to output the generated RC")
+	xmode     = flag.String("exchange", "broadcast", "how reports are disseminated to peers, broadcast, gossip or sharded")
+	fanout    = flag.Int("fanout", 0, "number of peers to gossip a report to in each round")
+	replicas  = flag.Int("replicas", 0, "number of owners of each subject in sharded mode")
 )
 
 var r = rand.New(rand.NewSource(time.Now().UnixNano()))
@@ -84,6 +87,9 @@ func main() {
 		rc.Subjects = strings.Split(*subjects, ",")
 	}
 	rc.DBFile = *dbfile
+	rc.ExchangeConfig.Mode = *xmode
+	rc.ExchangeConfig.Fanout = *fanout
+	rc.ExchangeConfig.Replicas = *replicas
 	if len(*output) > 0 {
 		fmt.Println("Saving to " + *output)
 		err := dt.SaveConfig(*output, rc)
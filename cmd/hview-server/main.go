@@ -26,6 +26,11 @@ var (
 	portend    = flag.Int("port_end", 30000, "end of port range for a random port")
 	cpuprofile = flag.String("cpuprofile", "", "write CPU profiling to file")
 	memusage   = flag.Bool("mem_usage", false, "periodically dump memory usage")
+	join       = flag.String("join", "", "comma separated addresses of instances to join the cluster through")
+	tlsCert    = flag.String("tls_cert", "", "certificate of this instance issued to its id, enables TLS")
+	tlsKey     = flag.String("tls_key", "", "private key of the certificate")
+	tlsCA      = flag.String("tls_ca", "", "certificate authorities of the peers and clients")
+	mutualTLS  = flag.Bool("mutual_tls", false, "require certificates from clients and check the identities of peers")
 )
 
 var r = rand.New(rand.NewSource(time.Now().UnixNano()))
@@ -69,8 +74,15 @@ func main() {
 			Addr:   faddr,
 			Id:     args[0],
 			DBFile: *dbfile,
+			Peers:  map[string]string{args[0]: faddr},
 		}
 	}
+	if len(*join) > 0 {
+		config.Seeds = strings.Split(*join, ",")
+	}
+	if len(*tlsCert) > 0 {
+		config.TLSConfig = dt.TLSConfig{CertFile: *tlsCert, KeyFile: *tlsKey, CAFile: *tlsCA, Mutual: *mutualTLS}
+	}
 	if *memusage || config.DumpMemUsage {
 		memf, err := os.OpenFile("memusage.csv", os.O_RDWR|os.O_CREATE, 0644)
 		if err != nil {
@@ -0,0 +1,84 @@
+package decision
+
+import (
+	"sort"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+var gtag = "group"
+
+// Aggregate the inferences of the members in a group, e.g., all the subjects
+// in rack r1. A member is considered unhealthy if any of its metrics is at
+// or worse than the severity. The group observation takes the majority status
+// and the average score of each metric among the members.
+func InferGroup(key string, value string, members map[string]*pb.Inference, severity pb.Status) *pb.GroupInference {
+	if severity == pb.Status_INVALID {
+		severity = pb.Status_UNHEALTHY
+	}
+	group := &pb.GroupInference{
+		Key:     key,
+		Value:   value,
+		Members: make([]string, 0, len(members)),
+	}
+	statmap := make(map[string]*valueStat)
+	var pts *timestamp.Timestamp = nil
+	inferred := 0
+	for member, inference := range members {
+		group.Members = append(group.Members, member)
+		if inference == nil || inference.Observation == nil {
+			continue
+		}
+		inferred++
+		if pts == nil || dt.CompareTimestamp(pts, inference.Observation.Ts) < 0 {
+			pts = inference.Observation.Ts
+		}
+		unhealthy := false
+		for name, metric := range inference.Observation.Metrics {
+			stat, ok := statmap[name]
+			if !ok {
+				stat = &valueStat{StatusHist: make(map[pb.Status]uint32)}
+				statmap[name] = stat
+			}
+			stat.ScoreSum += metric.Value.Score
+			stat.Cnt++
+			stat.StatusHist[metric.Value.Status]++
+			if metric.Value.Status >= severity {
+				unhealthy = true
+			}
+		}
+		if unhealthy {
+			group.Unhealthy = append(group.Unhealthy, member)
+		}
+	}
+	sort.Strings(group.Members)
+	sort.Strings(group.Unhealthy)
+	if inferred > 0 {
+		group.UnhealthyRatio = float32(len(group.Unhealthy)) / float32(inferred)
+	}
+	if pts == nil {
+		return group
+	}
+	metrics := make(map[string]*pb.Metric)
+	for name, stat := range statmap {
+		var maxcnt uint32 = 0
+		maxstatus := pb.Status_HEALTHY
+		for status, cnt := range stat.StatusHist {
+			if cnt > maxcnt || (cnt == maxcnt && status > maxstatus) {
+				maxcnt = cnt
+				maxstatus = status
+			}
+		}
+		metrics[name] = &pb.Metric{
+			Name:  name,
+			Value: &pb.Value{Status: maxstatus, Score: stat.ScoreSum / float32(stat.Cnt)},
+		}
+	}
+	group.Observation = &pb.Observation{Ts: pts, Metrics: metrics}
+	du.LogD(gtag, "group %s=%s: %d members, %d unhealthy", key, value, len(group.Members), len(group.Unhealthy))
+	return group
+}
@@ -0,0 +1,31 @@
+package decision
+
+import (
+	"testing"
+	"time"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+)
+
+func TestInferGroup(t *testing.T) {
+	now := time.Now()
+	members := map[string]*pb.Inference{
+		"TS_1": &pb.Inference{Subject: "TS_1", Observation: dt.NewObservationSingleMetric(now, "cpu", pb.Status_HEALTHY, 90)},
+		"TS_2": &pb.Inference{Subject: "TS_2", Observation: dt.NewObservationSingleMetric(now, "cpu", pb.Status_DEAD, 10)},
+		"TS_3": &pb.Inference{Subject: "TS_3", Observation: dt.NewObservationSingleMetric(now, "cpu", pb.Status_DEAD, 20)},
+		"TS_4": &pb.Inference{Subject: "TS_4", Observation: dt.NewObservationSingleMetric(now, "cpu", pb.Status_MAYBE_UNHEALTHY, 50)},
+	}
+	group := InferGroup("rack", "r1", members, pb.Status_INVALID)
+	if len(group.Members) != 4 || len(group.Unhealthy) != 2 || group.UnhealthyRatio != 0.5 {
+		t.Errorf("expecting 2 of 4 members unhealthy, got %v of %v", group.Unhealthy, group.Members)
+	}
+	cpu := group.Observation.Metrics["cpu"]
+	if cpu.Value.Status != pb.Status_DEAD || cpu.Value.Score != 42.5 {
+		t.Errorf("expecting DEAD 42.5 for the group, got %s %.1f", cpu.Value.Status, cpu.Value.Score)
+	}
+	group = InferGroup("rack", "r1", members, pb.Status_MAYBE_UNHEALTHY)
+	if len(group.Unhealthy) != 3 {
+		t.Errorf("expecting 3 members at least MAYBE_UNHEALTHY, got %v", group.Unhealthy)
+	}
+}
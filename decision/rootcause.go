@@ -0,0 +1,163 @@
+package decision
+
+import (
+	"sort"
+
+	pb "panorama/build/gen"
+	du "panorama/util"
+)
+
+var rtag = "rootcause"
+
+// How strongly a status indicates that a subject is at fault
+var statusEvidence = map[pb.Status]float32{
+	pb.Status_MAYBE_UNHEALTHY: 0.5,
+	pb.Status_UNHEALTHY:       0.8,
+	pb.Status_DYING:           0.9,
+	pb.Status_DEAD:            1.0,
+}
+
+// Dependencies among subjects, e.g., a RegionServer depends on a DataNode,
+// which depends on a disk. An edge points from a subject to one it depends on.
+type DependencyGraph struct {
+	Edges map[string][]string
+}
+
+func NewDependencyGraph(dependencies map[string][]string) *DependencyGraph {
+	graph := &DependencyGraph{Edges: make(map[string][]string)}
+	for subject, deps := range dependencies {
+		for _, dep := range deps {
+			graph.AddEdge(subject, dep)
+		}
+	}
+	return graph
+}
+
+func (self *DependencyGraph) AddEdge(subject string, dependency string) {
+	for _, dep := range self.Edges[subject] {
+		if dep == dependency {
+			return
+		}
+	}
+	self.Edges[subject] = append(self.Edges[subject], dependency)
+}
+
+// Unhealthy evidence of a subject from the worst status in its inference
+func evidence(inference *pb.Inference) (float32, pb.Status) {
+	worst := pb.Status_INVALID
+	if inference == nil || inference.Observation == nil {
+		return 0, worst
+	}
+	for _, metric := range inference.Observation.Metrics {
+		if metric.Value != nil && metric.Value.Status > worst {
+			worst = metric.Value.Status
+		}
+	}
+	return statusEvidence[worst], worst
+}
+
+// Rank the likely root causes of the symptom on a subject. The unhealthy
+// evidence of each subject reachable from the symptom is propagated along the
+// dependency edges: a subject whose dependencies are also unhealthy passes
+// most of its blame on to them, in proportion to their own evidence, and keeps
+// the rest. The blame that ends up with each subject, normalized to sum to 1,
+// is its score. Return the subjects with any blame, the most likely first.
+func (self *DependencyGraph) RankRootCause(subject string, inferences map[string]*pb.Inference) []*pb.RootCause {
+	// order the reachable subjects so that a subject comes before its
+	// dependencies, ignoring the edges that close a cycle
+	var order []string
+	parents := map[string]string{subject: ""}
+	visiting := make(map[string]bool)
+	done := make(map[string]bool)
+	var visit func(node string)
+	visit = func(node string) {
+		visiting[node] = true
+		for _, dep := range self.Edges[node] {
+			if visiting[dep] || done[dep] {
+				continue
+			}
+			if _, ok := parents[dep]; !ok {
+				parents[dep] = node
+			}
+			visit(dep)
+		}
+		visiting[node] = false
+		done[node] = true
+		order = append(order, node)
+	}
+	visit(subject)
+	position := make(map[string]int)
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	for i, node := range order {
+		position[node] = i
+	}
+
+	blame := make(map[string]float32)
+	statuses := make(map[string]pb.Status)
+	for _, node := range order {
+		blame[node], statuses[node] = evidence(inferences[node])
+	}
+	for _, node := range order {
+		if blame[node] == 0 {
+			continue
+		}
+		var sum, max float32
+		for _, dep := range self.Edges[node] {
+			if position[dep] <= position[node] {
+				continue // back edge
+			}
+			e, _ := evidence(inferences[dep])
+			sum += e
+			if e > max {
+				max = e
+			}
+		}
+		if sum == 0 {
+			continue
+		}
+		passed := blame[node] * max
+		blame[node] -= passed
+		for _, dep := range self.Edges[node] {
+			if position[dep] <= position[node] {
+				continue
+			}
+			e, _ := evidence(inferences[dep])
+			blame[dep] += passed * e / sum
+		}
+	}
+
+	var total float32
+	for _, b := range blame {
+		total += b
+	}
+	var causes []*pb.RootCause
+	if total == 0 {
+		du.LogD(rtag, "no unhealthy evidence for %s", subject)
+		return causes
+	}
+	for node, b := range blame {
+		if b == 0 {
+			continue
+		}
+		var path []string
+		for n := node; len(n) > 0; n = parents[n] {
+			path = append([]string{n}, path...)
+		}
+		causes = append(causes, &pb.RootCause{
+			Subject: node,
+			Score:   b / total,
+			Status:  statuses[node],
+			Path:    path,
+		})
+	}
+	sort.Slice(causes, func(i, j int) bool {
+		if causes[i].Score != causes[j].Score {
+			return causes[i].Score > causes[j].Score
+		}
+		return causes[i].Subject < causes[j].Subject
+	})
+	du.LogD(rtag, "ranked %d root causes for %s among %d subjects", len(causes), subject, len(order))
+	return causes
+}
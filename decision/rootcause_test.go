@@ -0,0 +1,77 @@
+package decision
+
+import (
+	"testing"
+	"time"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+)
+
+func makeInferences(statuses map[string]pb.Status) map[string]*pb.Inference {
+	inferences := make(map[string]*pb.Inference)
+	for subject, status := range statuses {
+		inferences[subject] = &pb.Inference{
+			Subject:     subject,
+			Observation: dt.NewObservationSingleMetric(time.Now(), "cpu", status, 10),
+		}
+	}
+	return inferences
+}
+
+func TestRankRootCause(t *testing.T) {
+	graph := NewDependencyGraph(map[string][]string{
+		"rs1":  {"dn1", "dn2"},
+		"dn1":  {"disk1", "disk2"},
+		"dn2":  {"disk3"},
+		"disk": {"rs1"},
+	})
+	inferences := makeInferences(map[string]pb.Status{
+		"rs1":   pb.Status_UNHEALTHY,
+		"dn1":   pb.Status_UNHEALTHY,
+		"dn2":   pb.Status_HEALTHY,
+		"disk1": pb.Status_DEAD,
+		"disk2": pb.Status_HEALTHY,
+	})
+	causes := graph.RankRootCause("rs1", inferences)
+	// dn1 passes all its blame on to the dead disk1
+	if len(causes) != 2 {
+		t.Fatalf("expecting 2 candidates, got %v", causes)
+	}
+	if causes[0].Subject != "disk1" || causes[0].Status != pb.Status_DEAD {
+		t.Errorf("expecting disk1 to be the top root cause, got %v", causes[0])
+	}
+	if len(causes[0].Path) != 3 || causes[0].Path[1] != "dn1" {
+		t.Errorf("expecting path rs1 -> dn1 -> disk1, got %v", causes[0].Path)
+	}
+	var total float32
+	for _, cause := range causes {
+		total += cause.Score
+	}
+	if total < 0.99 || total > 1.01 {
+		t.Errorf("scores should sum to 1, got %f", total)
+	}
+
+	// the symptom itself is the culprit if its dependencies are healthy
+	inferences = makeInferences(map[string]pb.Status{"rs1": pb.Status_DEAD, "dn1": pb.Status_HEALTHY})
+	causes = graph.RankRootCause("rs1", inferences)
+	if len(causes) != 1 || causes[0].Subject != "rs1" || causes[0].Score != 1 {
+		t.Errorf("expecting rs1 to be the only root cause, got %v", causes)
+	}
+	if causes = graph.RankRootCause("dn2", inferences); len(causes) != 0 {
+		t.Errorf("expecting no root cause for healthy dn2, got %v", causes)
+	}
+}
+
+func TestRankRootCauseCycle(t *testing.T) {
+	graph := NewDependencyGraph(map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}})
+	inferences := makeInferences(map[string]pb.Status{
+		"a": pb.Status_UNHEALTHY,
+		"b": pb.Status_UNHEALTHY,
+		"c": pb.Status_UNHEALTHY,
+	})
+	causes := graph.RankRootCause("a", inferences)
+	if len(causes) == 0 || causes[0].Subject != "c" {
+		t.Errorf("expecting c to be the top root cause, got %v", causes)
+	}
+}
@@ -0,0 +1,282 @@
+package exchange
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+const (
+	dtag               = "detector"
+	HEARTBEAT_INTERVAL = 1 * time.Second  // default time between heartbeats to a peer
+	PHI_SUSPECT        = 3.0              // default suspicion level to suspect a peer
+	PHI_DEAD           = 8.0              // default suspicion level to consider a peer dead
+	HEARTBEAT_WINDOW   = 100              // number of heartbeat intervals to estimate the arrival rate from
+	STATUS_REFRESH     = 30 * time.Second // time after which an unchanged peer status is reported again
+)
+
+type peerLiveness struct {
+	intervals []time.Duration // recent intervals between heartbeats
+	last      time.Time       // time of the last heartbeat, or of the start if none yet
+	heard     bool
+	rtt       time.Duration
+	missed    uint64
+	inflight  bool
+	state     pb.PeerStatus_State
+	reported  time.Time
+}
+
+// A phi accrual failure detector over the heartbeats to peers. Instead of a
+// binary alive or dead verdict, the time since the last heartbeat of a peer
+// is turned into a suspicion level phi with regard to how often heartbeats
+// from the peer usually arrive, assuming exponentially distributed intervals.
+// A peer is suspected when phi exceeds PhiSuspect and considered dead when it
+// exceeds PhiDead.
+type FailureDetector struct {
+	Interval   time.Duration
+	PhiSuspect float64
+	PhiDead    float64
+
+	exchange  *ExchangeProtocol
+	peers     map[string]*peerLiveness
+	listeners []dt.PeerStatusListener
+	mu        *sync.Mutex
+	stopc     chan bool
+	running   sync.WaitGroup // the loop and the heartbeats in flight
+}
+
+func NewFailureDetector(exchange *ExchangeProtocol, interval time.Duration, suspect float64, dead float64) *FailureDetector {
+	return &FailureDetector{
+		Interval:   interval,
+		PhiSuspect: suspect,
+		PhiDead:    dead,
+		exchange:   exchange,
+		peers:      make(map[string]*peerLiveness),
+		mu:         &sync.Mutex{},
+	}
+}
+
+// Add a listener to be notified about the status of peers when it changes,
+// and periodically otherwise
+func (self *FailureDetector) AddListener(listener dt.PeerStatusListener) {
+	self.listeners = append(self.listeners, listener)
+}
+
+// Must be called with lock held
+func (self *FailureDetector) getOrMakePeer(peer string, now time.Time) *peerLiveness {
+	pl, ok := self.peers[peer]
+	if !ok {
+		pl = &peerLiveness{last: now}
+		self.peers[peer] = pl
+	}
+	return pl
+}
+
+// Record a heartbeat from a peer that took rtt to come back, return whether
+// it is the first heartbeat heard from the peer
+func (self *FailureDetector) Heartbeat(peer string, now time.Time, rtt time.Duration) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pl := self.getOrMakePeer(peer, now)
+	first := !pl.heard
+	if pl.heard {
+		pl.intervals = append(pl.intervals, now.Sub(pl.last))
+		if len(pl.intervals) > HEARTBEAT_WINDOW {
+			pl.intervals = pl.intervals[1:]
+		}
+	}
+	pl.last = now
+	pl.heard = true
+	pl.rtt = rtt
+	pl.missed = 0
+	return first
+}
+
+// Record a heartbeat to a peer that was not answered
+func (self *FailureDetector) Missed(peer string, now time.Time) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.getOrMakePeer(peer, now).missed++
+}
+
+// Suspicion level of a peer. Must be called with lock held.
+func (self *FailureDetector) phi(pl *peerLiveness, now time.Time) float64 {
+	mean := self.Interval
+	if len(pl.intervals) > 0 {
+		var sum time.Duration
+		for _, interval := range pl.intervals {
+			sum += interval
+		}
+		// heartbeats are never expected more often than they are sent
+		if avg := sum / time.Duration(len(pl.intervals)); avg > mean {
+			mean = avg
+		}
+	}
+	// -log10 of the probability that the next heartbeat arrives even later
+	return now.Sub(pl.last).Seconds() / mean.Seconds() * math.Log10(math.E)
+}
+
+// Must be called with lock held
+func (self *FailureDetector) state(pl *peerLiveness, phi float64) pb.PeerStatus_State {
+	switch {
+	case phi >= self.PhiDead:
+		return pb.PeerStatus_DEAD
+	case !pl.heard:
+		return pb.PeerStatus_UNKNOWN
+	case phi >= self.PhiSuspect:
+		return pb.PeerStatus_SUSPECTED
+	}
+	return pb.PeerStatus_ALIVE
+}
+
+// Must be called with lock held
+func (self *FailureDetector) status(peer string, addr string, pl *peerLiveness, now time.Time) *pb.PeerStatus {
+	phi := self.phi(pl, now)
+	status := &pb.PeerStatus{
+		Peer:   &pb.Peer{Id: peer, Addr: addr},
+		State:  self.state(pl, phi),
+		Phi:    phi,
+		Rtt:    float64(pl.rtt) / float64(time.Millisecond),
+		Missed: pl.missed,
+	}
+	if pl.heard {
+		status.LastHeartbeat, _ = ptypes.TimestampProto(pl.last)
+	}
+	return status
+}
+
+// Check if a peer may be alive. Peers that have not been heard from yet are
+// given the benefit of the doubt until they are considered dead.
+func (self *FailureDetector) Alive(peer string) bool {
+	now := time.Now()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pl, ok := self.peers[peer]
+	if !ok {
+		return true
+	}
+	return self.state(pl, self.phi(pl, now)) != pb.PeerStatus_DEAD
+}
+
+// Status of all the peers that are monitored, ordered by id
+func (self *FailureDetector) GetStatus() []*pb.PeerStatus {
+	now := time.Now()
+	peers := self.exchange.GetPeers()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	var statuses []*pb.PeerStatus
+	for peer, pl := range self.peers {
+		statuses = append(statuses, self.status(peer, peers[peer], pl, now))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Peer.Id < statuses[j].Peer.Id
+	})
+	return statuses
+}
+
+func (self *FailureDetector) ping(peer string) {
+	defer self.running.Done()
+	t1 := time.Now()
+	_, err := self.exchange.Ping(peer)
+	now := time.Now()
+	if _, ok := self.exchange.getPeerAddr(peer); !ok {
+		return // left while the heartbeat was in flight
+	}
+	if err != nil {
+		du.LogD(dtag, "missed heartbeat from %s: %s", peer, err)
+		self.Missed(peer, now)
+	} else if self.Heartbeat(peer, now, now.Sub(t1)) {
+		self.exchange.resubscribe(peer) // it may have missed my subscriptions
+	}
+	self.mu.Lock()
+	if pl, ok := self.peers[peer]; ok {
+		pl.inflight = false
+	}
+	self.mu.Unlock()
+}
+
+// Stop monitoring a peer that left
+func (self *FailureDetector) Forget(peer string) {
+	self.mu.Lock()
+	delete(self.peers, peer)
+	self.mu.Unlock()
+}
+
+// Send heartbeats to the peers that are not still answering the previous
+// one, and evaluate the state of all peers
+func (self *FailureDetector) round() {
+	now := time.Now()
+	var changed []*pb.PeerStatus
+	var recovered []string
+	peers := self.exchange.GetPeers()
+	self.mu.Lock()
+	for peer, addr := range peers {
+		if peer == self.exchange.Id {
+			continue
+		}
+		pl := self.getOrMakePeer(peer, now)
+		if !pl.inflight {
+			pl.inflight = true
+			self.running.Add(1)
+			go self.ping(peer)
+		}
+		status := self.status(peer, addr, pl, now)
+		if status.State == pl.state && now.Sub(pl.reported) < STATUS_REFRESH {
+			continue
+		}
+		if status.State != pl.state {
+			du.LogI(dtag, "%s is %s (phi %.2f)", peer, status.State, status.Phi)
+			if pl.state == pb.PeerStatus_DEAD {
+				recovered = append(recovered, peer)
+			}
+		}
+		pl.state = status.State
+		pl.reported = now
+		changed = append(changed, status)
+	}
+	self.mu.Unlock()
+	for _, peer := range recovered {
+		self.exchange.outbox.Delivered(peer) // replay what it missed while dead
+		self.exchange.resubscribe(peer)
+	}
+	for _, status := range changed {
+		for _, listener := range self.listeners {
+			listener.OnPeerStatus(status)
+		}
+	}
+}
+
+func (self *FailureDetector) Start() {
+	stopc := make(chan bool)
+	self.stopc = stopc
+	self.running.Add(1)
+	go func() {
+		defer self.running.Done()
+		ticker := time.NewTicker(self.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopc:
+				return
+			case <-ticker.C:
+				self.round()
+			}
+		}
+	}()
+}
+
+// Stop and wait for the heartbeats in flight
+func (self *FailureDetector) Stop() {
+	if self.stopc != nil {
+		close(self.stopc)
+		self.stopc = nil
+	}
+	self.running.Wait()
+}
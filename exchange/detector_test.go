@@ -0,0 +1,63 @@
+package exchange
+
+import (
+	"testing"
+	"time"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+func TestFailureDetector(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	config := &dt.HealthServerConfig{Id: "DHS_0", Peers: map[string]string{"DHS_0": "localhost:6688", "DHS_1": "localhost:6689"},
+		ExchangeConfig: dt.ExchangeConfig{Heartbeat: 100}}
+	exchange := newTestExchange(t, config)
+	detector := exchange.detector
+	if detector == nil || detector.Interval != 100*time.Millisecond {
+		t.Fatal("expecting a failure detector with 100ms heartbeats")
+	}
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		detector.Heartbeat("DHS_1", start.Add(time.Duration(i)*100*time.Millisecond), time.Millisecond)
+	}
+	last := start.Add(900 * time.Millisecond)
+	cases := []struct {
+		silence time.Duration
+		state   pb.PeerStatus_State
+	}{
+		{100 * time.Millisecond, pb.PeerStatus_ALIVE},
+		{1 * time.Second, pb.PeerStatus_SUSPECTED},
+		{2 * time.Second, pb.PeerStatus_DEAD},
+	}
+	for _, c := range cases {
+		pl := detector.peers["DHS_1"]
+		phi := detector.phi(pl, last.Add(c.silence))
+		if state := detector.state(pl, phi); state != c.state {
+			t.Errorf("expecting %s after %s of silence, got %s (phi %.2f)", c.state, c.silence, state, phi)
+		}
+	}
+
+	// a dead peer is skipped and the report is held in the outbox
+	detector.peers["DHS_1"].last = time.Now().Add(-time.Minute)
+	if exchange.alive("DHS_1") {
+		t.Fatal("DHS_1 should be dead")
+	}
+	report := dt.NewReport("FE_1", "TS_1", map[string]*pb.Value{"cpu": &pb.Value{Status: pb.Status_HEALTHY, Score: 100}})
+	request := &pb.LearnReportRequest{Kind: pb.LearnReportRequest_NORMAL, Source: exchange.me, Report: report}
+	skipped, err := exchange.PropagatePeer("DHS_1", false, request)
+	if !skipped || err != nil {
+		t.Errorf("expecting report to a dead peer to be skipped, got %v %v", skipped, err)
+	}
+	if len(exchange.GetQueues()) != 0 {
+		t.Error("expecting no sender to a dead peer")
+	}
+	if pending, _, _ := exchange.outbox.Stats("DHS_1"); pending != 1 {
+		t.Errorf("expecting 1 report held for DHS_1, got %d", pending)
+	}
+	detector.Heartbeat("DHS_1", time.Now(), time.Millisecond)
+	if !exchange.alive("DHS_1") {
+		t.Error("DHS_1 should be alive after a heartbeat")
+	}
+}
@@ -1,197 +1,583 @@
 package exchange
 
 import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 
 	pb "panorama/build/gen"
+	dc "panorama/client"
 	dt "panorama/types"
 	du "panorama/util"
 )
 
 const (
-	etag = "exchange"
+	etag            = "exchange"
+	MODE_BROADCAST  = "broadcast"     // send every report to every peer
+	MODE_GOSSIP     = "gossip"        // send a report to a few peers, which relay it further
+	MODE_SHARDED    = "sharded"       // send a report only to the owners of its subject
+	GOSSIP_FANOUT   = 3               // default number of peers to gossip to in each round
+	REPORT_SEEN_TTL = 5 * time.Minute // time to remember a propagated report for duplicate suppression
+	MAX_HOPS        = 16              // relays of a report after which it is dropped as looping
 )
 
-type IgnoreSet struct {
-	mu      sync.RWMutex
-	entries map[string]bool
-}
-
 type ExchangeProtocol struct {
 	Id   string // my id
 	Addr string // my addr
 
-	Peers            map[string]string     // all peers' id and address
-	SkipSubjectPeers map[string]*IgnoreSet // skip sending reports about a subject to certain peers
+	Peers map[string]string // all peers' id and address, changed with membership
+
+	Mode     string // broadcast, gossip or sharded
+	Fanout   int    // number of peers to gossip to in each round
+	Rounds   int    // number of gossip rounds
+	Replicas int    // number of owners of each subject in sharded mode
+
+	fixedRounds bool // whether the gossip rounds are configured or derived from the number of peers
+
+	Lease time.Duration // time a subscription lasts unless renewed
+
+	QueueLen    int           // number of requests to buffer for each peer
+	BatchSize   int           // maximum number of requests sent to a peer at once
+	SendTimeout time.Duration // deadline for a peer to learn a batch
 
-	Clients map[string]pb.HealthServiceClient // clients to all peers
+	leases     *LeaseTable      // subscriptions of the peers to subjects
+	outbox     *Outbox          // failed requests to be retried
+	detector   *FailureDetector // liveness of peers from heartbeats, nil if disabled
+	summarizer *Summarizer      // healthy repeats held for summaries, nil if disabled
 
-	me *pb.Peer
-	mu sync.RWMutex
+	me        *pb.Peer
+	members   map[string]*pb.Member // latest membership change of each peer
+	ring      *HashRing             // owners of subjects in sharded mode
+	peerMu    sync.RWMutex
+	transport dc.Transport      // connections to the peers
+	options   []grpc.DialOption // options to dial the peers, e.g., credentials and token
+	authority bool              // whether the certificates of the peers are issued to their ids
+	tlsErr    error             // why the TLS credentials to reach the peers failed to load
+	subjects  map[string]bool   // subjects I subscribe to, to subscribe the new peers
+	mu        sync.RWMutex
+	seq       uint64               // sequence for the ids of propagated reports
+	seen      map[string]time.Time // ids of the propagated reports learned recently
+	seenMu    sync.Mutex
+	lastPrune time.Time
+	senders   map[string]*PeerSender
+	sendersMu sync.Mutex
+	stopped   bool // no senders are made once stopped
 }
 
 var _ dt.HealthExchange = new(ExchangeProtocol)
 
-func NewIgnoreSet() *IgnoreSet {
-	return &IgnoreSet{
-		entries: make(map[string]bool),
+func NewExchangeProtocol(config *dt.HealthServerConfig) *ExchangeProtocol {
+	exchange := &ExchangeProtocol{
+		Id:          config.Id,
+		Addr:        config.Addr,
+		Peers:       make(map[string]string),
+		Mode:        MODE_BROADCAST,
+		Fanout:      GOSSIP_FANOUT,
+		Replicas:    SHARD_REPLICAS,
+		Lease:       LEASE_DURATION,
+		QueueLen:    SENDER_QUEUE_LEN,
+		BatchSize:   SENDER_BATCH_SIZE,
+		SendTimeout: SEND_TIMEOUT,
+		leases:      NewLeaseTable(),
+		subjects:    make(map[string]bool),
+		me:          &pb.Peer{Id: string(config.Id), Addr: config.Addr},
+		seq:         uint64(time.Now().UnixNano()), // avoid reusing ids after restart
+		seen:        make(map[string]time.Time),
+		lastPrune:   time.Now(),
+		senders:     make(map[string]*PeerSender),
+		members:     make(map[string]*pb.Member),
+	}
+	for id, addr := range config.Peers {
+		// the configured peers are older than any membership change
+		exchange.Peers[id] = addr
+		exchange.members[id] = &pb.Member{Peer: &pb.Peer{Id: id, Addr: addr}, Time: &timestamp.Timestamp{}}
+	}
+	ec := config.ExchangeConfig
+	if ec.Mode == MODE_GOSSIP || ec.Mode == MODE_SHARDED {
+		exchange.Mode = ec.Mode
+	} else if len(ec.Mode) > 0 && ec.Mode != MODE_BROADCAST {
+		du.LogE(etag, "Unknown exchange mode %s, use %s", ec.Mode, MODE_BROADCAST)
+	}
+	if ec.Fanout > 0 {
+		exchange.Fanout = ec.Fanout
+	}
+	if ec.Replicas > 0 {
+		exchange.Replicas = ec.Replicas
+	}
+	if exchange.Mode == MODE_SHARDED {
+		exchange.ring = NewHashRing(exchange.Peers, RING_VNODES)
+		du.LogI(etag, "send reports to %d owners of each subject", exchange.Replicas)
+	}
+	if ec.Rounds > 0 {
+		exchange.Rounds = ec.Rounds
+		exchange.fixedRounds = true
+	} else {
+		exchange.Rounds = GossipRounds(len(config.Peers), exchange.Fanout)
+	}
+	if ec.LeaseDuration > 0 {
+		exchange.Lease = time.Duration(ec.LeaseDuration) * time.Second
+	}
+	if ec.QueueLen > 0 {
+		exchange.QueueLen = ec.QueueLen
+	}
+	if ec.BatchSize > 0 {
+		exchange.BatchSize = ec.BatchSize
+	}
+	if ec.SendTimeout > 0 {
+		exchange.SendTimeout = time.Duration(ec.SendTimeout) * time.Millisecond
+	}
+	option := grpc.WithInsecure()
+	tc := config.TLSConfig
+	if len(tc.CertFile) > 0 {
+		// the peers present certificates issued to their ids
+		creds, err := dc.ClientTLS(tc.CertFile, tc.KeyFile, tc.CAFile, "")
+		if err != nil {
+			du.LogE(etag, "Fail to set up TLS to the peers: %s", err)
+			exchange.tlsErr = err
+		} else {
+			option = grpc.WithTransportCredentials(creds)
+		}
 	}
+	options := []grpc.DialOption{option}
+	if len(config.AccessConfig.Token) > 0 {
+		options = append(options, dc.WithToken(config.AccessConfig.Token))
+	}
+	exchange.options = options
+	exchange.authority = len(tc.CertFile) > 0
+	conns := dc.NewConnManager(options...)
+	conns.TargetAuthority = exchange.authority
+	if ec.DialTimeout > 0 {
+		conns.DialTimeout = time.Duration(ec.DialTimeout) * time.Millisecond
+	}
+	if ec.IdleTimeout > 0 {
+		conns.IdleTimeout = time.Duration(ec.IdleTimeout) * time.Second
+	}
+	exchange.transport = conns
+	freshness := OUTBOX_FRESH
+	if ec.Freshness > 0 {
+		freshness = time.Duration(ec.Freshness) * time.Second
+	}
+	qlen := OUTBOX_LEN
+	if ec.OutboxLen > 0 {
+		qlen = ec.OutboxLen
+	}
+	exchange.outbox = NewOutbox(exchange, qlen, freshness, ec.OutboxFile)
+	if ec.Heartbeat >= 0 {
+		interval := HEARTBEAT_INTERVAL
+		if ec.Heartbeat > 0 {
+			interval = time.Duration(ec.Heartbeat) * time.Millisecond
+		}
+		suspect, dead := PHI_SUSPECT, PHI_DEAD
+		if ec.PhiSuspect > 0 {
+			suspect = ec.PhiSuspect
+		}
+		if ec.PhiDead > 0 {
+			dead = ec.PhiDead
+		}
+		if dead < suspect {
+			du.LogE(etag, "Dead threshold %.2f is lower than suspect threshold %.2f", dead, suspect)
+			dead = suspect
+		}
+		exchange.detector = NewFailureDetector(exchange, interval, suspect, dead)
+	}
+	if ec.SummaryInterval >= 0 {
+		// set summary interval to negative to send every report right away
+		interval := SUMMARY_INTERVAL
+		if ec.SummaryInterval > 0 {
+			interval = time.Duration(ec.SummaryInterval) * time.Second
+		}
+		exchange.summarizer = NewSummarizer(interval, exchange.propagate)
+	}
+	if exchange.Mode == MODE_GOSSIP {
+		du.LogI(etag, "gossip reports to %d peers for %d rounds", exchange.Fanout, exchange.Rounds)
+	}
+	return exchange
 }
 
-func NewExchangeProtocol(config *dt.HealthServerConfig) *ExchangeProtocol {
-	return &ExchangeProtocol{
-		Id:               config.Id,
-		Addr:             config.Addr,
-		Peers:            config.Peers,
-		SkipSubjectPeers: make(map[string]*IgnoreSet),
-		Clients:          make(map[string]pb.HealthServiceClient),
-		me:               &pb.Peer{Id: string(config.Id), Addr: config.Addr},
+// Number of rounds for a report to reach all n peers with high probability
+// when each round gossips it to fanout peers
+func GossipRounds(n int, fanout int) int {
+	if n <= 1 || fanout <= 1 {
+		return 1
 	}
+	return int(math.Ceil(math.Log(float64(n))/math.Log(float64(fanout)))) + 1
 }
 
-func (self *IgnoreSet) Test(peer string) bool {
-	self.mu.RLock()
-	_, ok := self.entries[peer]
-	self.mu.RUnlock()
-	return ok
+func (self *ExchangeProtocol) Start() error {
+	self.sendersMu.Lock()
+	self.stopped = false
+	self.sendersMu.Unlock()
+	self.transport.Start()
+	if self.summarizer != nil {
+		self.summarizer.Start()
+	}
+	if self.detector != nil {
+		self.detector.Start()
+	}
+	return self.outbox.Start()
 }
 
-func (self *IgnoreSet) Set(peer string) {
-	self.mu.Lock()
-	self.entries[peer] = true
-	self.mu.Unlock()
+func (self *ExchangeProtocol) Stop() error {
+	if self.detector != nil {
+		self.detector.Stop()
+	}
+	if self.summarizer != nil {
+		self.summarizer.Stop()
+	}
+	self.sendersMu.Lock()
+	self.stopped = true
+	for peer, sender := range self.senders {
+		sender.Halt()
+		delete(self.senders, peer)
+	}
+	self.sendersMu.Unlock()
+	err := self.outbox.Stop()
+	self.transport.Close()
+	return err
 }
 
-func (self *IgnoreSet) Remove(subject string, peer string) {
-	self.mu.Lock()
-	_, ok := self.entries[peer]
-	delete(self.entries, peer) // remove peer from the ignoreset
-	if ok {
-		du.LogD(etag, "removing %s from the ignoreset of peer %s", subject, peer)
+// Check if a peer may be alive according to the failure detector
+func (self *ExchangeProtocol) alive(peer string) bool {
+	return self.detector == nil || self.detector.Alive(peer)
+}
+
+func (self *ExchangeProtocol) GetPeerStatus() []*pb.PeerStatus {
+	var statuses []*pb.PeerStatus
+	if self.detector != nil {
+		statuses = self.detector.GetStatus()
+	} else {
+		for peer, addr := range self.GetPeers() {
+			if peer != self.Id {
+				statuses = append(statuses, &pb.PeerStatus{Peer: &pb.Peer{Id: peer, Addr: addr}})
+			}
+		}
+		sort.Slice(statuses, func(i, j int) bool {
+			return statuses[i].Peer.Id < statuses[j].Peer.Id
+		})
 	}
-	self.mu.Unlock()
+	health := self.transport.Health()
+	for _, status := range statuses {
+		if h, ok := health[status.Peer.Id]; ok {
+			status.Connection = h.State.String()
+			status.ConnFailures = uint32(h.Failures)
+		}
+	}
+	return statuses
 }
 
-func (self *ExchangeProtocol) Subscribe(subject string) error {
+func (self *ExchangeProtocol) AddPeerListener(listener dt.PeerStatusListener) {
+	if self.detector != nil {
+		self.detector.AddListener(listener)
+	}
+}
+
+func (self *ExchangeProtocol) subscription(subject string) *pb.LearnReportRequest {
 	report := &pb.Report{Observer: self.me.Id, Subject: subject}
-	request := &pb.LearnReportRequest{Kind: pb.LearnReportRequest_SUBSCRIPTION, Source: self.me, Report: report}
-	du.LogI(etag, "subscribe to reports about for %s", report.Subject)
-	return self.PropagateAll(request)
+	return &pb.LearnReportRequest{Kind: pb.LearnReportRequest_SUBSCRIPTION, Source: self.me, Report: report,
+		Lease: uint32(self.Lease / time.Second)}
+}
+
+// Ask the peers for a lease on the reports about a subject, or renew it
+func (self *ExchangeProtocol) Subscribe(subject string) error {
+	self.mu.Lock()
+	self.subjects[subject] = true
+	self.mu.Unlock()
+	du.LogD(etag, "subscribe to reports about %s for %s", subject, self.Lease)
+	return self.PropagateAll(self.subscription(subject))
+}
+
+// Subscribe a peer that just joined or came back to my subjects right away
+// instead of waiting for the next renewal
+func (self *ExchangeProtocol) resubscribe(peer string) {
+	self.mu.RLock()
+	subjects := make([]string, 0, len(self.subjects))
+	for subject := range self.subjects {
+		subjects = append(subjects, subject)
+	}
+	self.mu.RUnlock()
+	if len(subjects) > 0 {
+		du.LogD(etag, "subscribe %s to reports about %d subjects", peer, len(subjects))
+	}
+	for _, subject := range subjects {
+		self.PropagatePeer(peer, false, self.subscription(subject))
+	}
 }
 
 func (self *ExchangeProtocol) Unsubscribe(subject string) error {
+	self.mu.Lock()
+	delete(self.subjects, subject)
+	self.mu.Unlock()
 	report := &pb.Report{Observer: self.me.Id, Subject: subject}
 	request := &pb.LearnReportRequest{Kind: pb.LearnReportRequest_UNSUBSCRIPTION, Source: self.me, Report: report}
 	du.LogI(etag, "unsubscribe to reports about for %s", report.Subject)
 	return self.PropagateAll(request)
 }
 
+func (self *ExchangeProtocol) PropagateSilence(silence *pb.Silence) error {
+	report := &pb.Report{Observer: silence.Observer, Subject: silence.Subject}
+	request := &pb.LearnReportRequest{Kind: pb.LearnReportRequest_SILENCE, Source: self.me, Report: report, Silence: silence}
+	du.LogI(etag, "propagate silence %s", silence.Id)
+	return self.PropagateAll(request)
+}
+
 func (self *ExchangeProtocol) Propagate(report *pb.Report) error {
-	request := &pb.LearnReportRequest{Kind: pb.LearnReportRequest_NORMAL, Source: self.me, Report: report}
+	if self.summarizer != nil && !self.summarizer.Offer(report) {
+		du.LogD(etag, "hold healthy report about %s from %s for the next summary", report.Subject, report.Observer)
+		return nil
+	}
+	return self.propagate(report)
+}
+
+func (self *ExchangeProtocol) propagate(report *pb.Report) error {
+	request := &pb.LearnReportRequest{
+		Kind:   pb.LearnReportRequest_NORMAL,
+		Source: self.me,
+		Report: report,
+		Id:     fmt.Sprintf("%s-%d", self.Id, atomic.AddUint64(&self.seq, 1)),
+		Origin: self.me,
+	}
+	self.Seen(request) // don't learn my own report when it is relayed back
+	if self.Mode == MODE_GOSSIP {
+		self.peerMu.RLock()
+		request.Rounds = uint32(self.Rounds)
+		self.peerMu.RUnlock()
+		du.LogI(etag, "about to gossip report %s about %s", request.Id, report.Subject)
+		return self.gossip(request, "")
+	}
+	if self.Mode == MODE_SHARDED {
+		owners := make(map[string]string)
+		peers := self.GetPeers()
+		for _, owner := range self.Owners(report.Subject) {
+			owners[owner] = peers[owner]
+		}
+		du.LogI(etag, "about to forward report about %s to its owners", report.Subject)
+		return self.propagateTo(owners, false, request)
+	}
 	du.LogI(etag, "about to propagate report about %s", report.Subject)
 	return self.PropagateAll(request)
 }
 
+// Send my inference about a subject to the peers interested in it
+func (self *ExchangeProtocol) PropagateInference(inference *pb.Inference) error {
+	report := &pb.Report{Observer: self.me.Id, Subject: inference.Subject}
+	request := &pb.LearnReportRequest{Kind: pb.LearnReportRequest_INFERENCE, Source: self.me, Report: report, Inference: inference}
+	du.LogD(etag, "about to propagate inference about %s", inference.Subject)
+	return self.PropagateAll(request)
+}
+
+// Reports and inferences are only sent to the peers interested in their subjects
+func interestBased(request *pb.LearnReportRequest) bool {
+	return request.Kind == pb.LearnReportRequest_NORMAL || request.Kind == pb.LearnReportRequest_INFERENCE
+}
+
+// Check if a report was learned before, either relayed back to me or
+// delivered again by a retry. Reports from old peers without an id are never
+// considered as seen.
+func (self *ExchangeProtocol) Seen(request *pb.LearnReportRequest) bool {
+	if len(request.Id) == 0 {
+		return false
+	}
+	now := time.Now()
+	self.seenMu.Lock()
+	defer self.seenMu.Unlock()
+	if now.Sub(self.lastPrune) > REPORT_SEEN_TTL {
+		for id, ts := range self.seen {
+			if now.Sub(ts) > REPORT_SEEN_TTL {
+				delete(self.seen, id)
+			}
+		}
+		self.lastPrune = now
+	}
+	if _, ok := self.seen[request.Id]; ok {
+		return true
+	}
+	self.seen[request.Id] = now
+	return false
+}
+
+func (self *ExchangeProtocol) Relay(request *pb.LearnReportRequest) error {
+	if request.Rounds <= 1 {
+		return nil
+	}
+	if request.Hops >= MAX_HOPS {
+		du.LogE(etag, "report %s from %s was relayed %d times, stop relaying", request.Id, request.Origin.GetId(), request.Hops)
+		return nil
+	}
+	relay := &pb.LearnReportRequest{
+		Kind:   request.Kind,
+		Source: self.me,
+		Report: request.Report,
+		Id:     request.Id,
+		Rounds: request.Rounds - 1,
+		Origin: request.Origin,
+		Hops:   request.Hops + 1,
+	}
+	du.LogD(etag, "relaying report %s from %s with %d rounds left", request.Id, request.Source.Id, relay.Rounds)
+	return self.gossip(relay, request.Source.Id)
+}
+
+// Gossip a report to a random subset of the peers that are interested in it,
+// excluding the peer the report comes from
+func (self *ExchangeProtocol) gossip(request *pb.LearnReportRequest, from string) error {
+	peers := self.GetPeers()
+	now := time.Now()
+	var candidates []string
+	for peer := range peers {
+		if peer == self.Id || peer == from {
+			continue
+		}
+		if !self.leases.Delivers(request.Report.Subject, peer, now) {
+			continue
+		}
+		if !self.alive(peer) {
+			continue
+		}
+		candidates = append(candidates, peer)
+	}
+	targets := make(map[string]string)
+	for _, i := range rand.Perm(len(candidates)) {
+		if len(targets) >= self.Fanout {
+			break
+		}
+		targets[candidates[i]] = peers[candidates[i]]
+	}
+	return self.propagateTo(targets, false, request)
+}
+
 // Propagate something to a peer. This something could be a normal report or a
-// subscription/unsubscription request. In the former case, we should check
-// if the receiver peer is interested in knowing the report. If not, we
-// should stop propagating the report to the receiver in the future until
-// it becomes interested in the report again.
-func (self *ExchangeProtocol) PropagatePeer(peer string, addr string, ignoreset *IgnoreSet, request *pb.LearnReportRequest) (bool, error, time.Duration) {
+// subscription/unsubscription request. In the former case, the request is
+// leased and only sent if the receiver peer holds a lease on the subject of
+// the report, i.e., it subscribed to the subject and keeps renewing it, or
+// never subscribed to anything and did not ignore the subject. The request
+// is queued to the sender of the peer, return whether it is skipped.
+func (self *ExchangeProtocol) PropagatePeer(peer string, leased bool, request *pb.LearnReportRequest) (bool, error) {
 	if peer == self.Id {
 		du.LogD(etag, "skip propagating to self")
-		return true, nil, 0 // skip send to self
+		return true, nil // skip send to self
 	}
 	report := request.Report
-	if ignoreset != nil {
-		if ignoreset.Test(peer) {
-			du.LogI(etag, "skip propagating report about %s to %s", report.Subject, peer)
-			return true, nil, 0
-		}
+	if leased && !self.leases.Delivers(report.Subject, peer, time.Now()) {
+		du.LogD(etag, "skip propagating report about %s to %s without a lease", report.Subject, peer)
+		return true, nil
 	}
-	du.LogD(etag, "propagating report about %s to %s", report.Subject, peer)
-	client, err := self.getOrMakeClient(peer)
-	if err != nil {
-		du.LogE(etag, "failed to get client for %s", peer)
-		return false, err, 0
+	if !self.alive(peer) {
+		// keep it until the peer comes back instead of waiting for timeouts
+		du.LogD(etag, "%s is dead, hold report about %s in outbox", peer, report.Subject)
+		self.outbox.Add(peer, []*pb.LearnReportRequest{request}, false)
+		return true, nil
+	}
+	sender := self.getOrMakeSender(peer)
+	if sender == nil {
+		du.LogD(etag, "%s is no longer a peer, skip report about %s", peer, report.Subject)
+		return true, nil
 	}
-	t1 := time.Now()
-	reply, err := client.LearnReport(context.Background(), request)
-	duration := time.Since(t1)
+	du.LogD(etag, "queueing report about %s to %s", report.Subject, peer)
+	err := sender.Send(request)
 	if err != nil {
-		du.LogE(etag, "failed to propagate report about %s to %s", report.Subject, peer)
-		return false, err, duration
-	}
-	if request.Kind == pb.LearnReportRequest_NORMAL && reply.Result == pb.LearnReportReply_IGNORED {
-		if ignoreset == nil {
-			ignoreset = NewIgnoreSet()
-			self.mu.Lock()
-			self.SkipSubjectPeers[report.Subject] = ignoreset
-			self.mu.Unlock()
+		du.LogE(etag, "failed to propagate report about %s: %s", report.Subject, err)
+		self.outbox.Add(peer, []*pb.LearnReportRequest{request}, false)
+	}
+	return false, err
+}
+
+// Handle the reply of a peer to a propagated request
+func (self *ExchangeProtocol) handleReply(peer string, request *pb.LearnReportRequest, reply *pb.LearnReportReply) {
+	report := request.Report
+	if interestBased(request) && reply.Result == pb.LearnReportReply_IGNORED {
+		// the peer no longer watches the subject, stop until it subscribes again
+		if self.leases.Revoke(report.Subject, peer) {
+			du.LogI(etag, "stop propgating report on subject %s to %s in the future", report.Subject, peer)
 		}
-		ignoreset.Set(peer)
-		du.LogI(etag, "stop propgating report on subject %s to %s in the future", report.Subject, peer)
-		return true, nil, duration
 	} else {
-		du.LogI(etag, "propagated report about %s to %s at %s in %s", report.Subject, peer, addr, duration)
-		return false, nil, duration
+		du.LogD(etag, "propagated report about %s to %s", report.Subject, peer)
 	}
 }
 
 func (self *ExchangeProtocol) PropagateAll(request *pb.LearnReportRequest) error {
+	return self.propagateTo(self.GetPeers(), interestBased(request), request)
+}
+
+func (self *ExchangeProtocol) propagateTo(peers map[string]string, leased bool, request *pb.LearnReportRequest) error {
 	var ferr error
-	var serial_prop_latency time.Duration
 	var prop_subjects int
 	var ignore_subjects int
-	var wg sync.WaitGroup
-	var mu sync.Mutex // local mutex for updating stats in the parallelized loop
+	var drop_subjects int
 
-	self.mu.RLock()
-	report := request.Report
-	ignoreset, ok := self.SkipSubjectPeers[report.Subject]
-	if !ok {
-		ignoreset = nil
+	// Senders of the peers deliver the request in the background and log
+	// the propagation latency including the time spent in their queues
+	for peer := range peers {
+		ignored, err := self.PropagatePeer(peer, leased, request)
+		if err != nil {
+			ferr = err
+			drop_subjects++
+		} else if ignored {
+			ignore_subjects++
+		} else {
+			prop_subjects++
+		}
 	}
-	self.mu.RUnlock()
-	du.LogD(etag, "ignoreset about %s: %v", report.Subject, ignoreset)
-
-	wg.Add(len(self.Peers))
-	t1 := time.Now()
-	for peer, addr := range self.Peers {
-		// The propagation is now parallelized, blazing fast...
-		go func(peer string, addr string) {
-			defer wg.Done()
-			ignored, err, duration := self.PropagatePeer(peer, addr, ignoreset, request)
-			if err != nil {
-				ferr = err
-			} else {
-				mu.Lock()
-				if ignored {
-					ignore_subjects++
-				} else {
-					prop_subjects++
-				}
-				// Count the duration into propagation latency even if the reply
-				// is ignored. Presumably, the next time, it won't even be tried (duration=0)
-				// This gives us a sense on how fast the propagation can converge
-				serial_prop_latency += duration
-				mu.Unlock()
-			}
-		}(peer, addr)
+	if request.Rounds > 0 {
+		du.LogI(etag, "gossiping report %s to %d subjects, ignored %d subjects, dropped %d subjects, %d rounds left",
+			request.Id, prop_subjects, ignore_subjects, drop_subjects, request.Rounds-1)
+	} else {
+		du.LogI(etag, "propagating report to %d subjects, ignored %d subjects, dropped %d subjects",
+			prop_subjects, ignore_subjects, drop_subjects)
 	}
-	wg.Wait()
-	parallel_prop_latency := time.Since(t1)
-	du.LogI(etag, "propagated report to %d subjects in %s (serial latency %s), ignored %d subjects",
-		prop_subjects, parallel_prop_latency, serial_prop_latency, ignore_subjects)
 	return ferr
 }
 
+// Queue depth and counters of the senders to all peers
+func (self *ExchangeProtocol) GetQueues() map[string]*pb.PeerQueue {
+	self.sendersMu.Lock()
+	defer self.sendersMu.Unlock()
+	queues := make(map[string]*pb.PeerQueue)
+	for peer, sender := range self.senders {
+		queue := sender.Stats()
+		queue.Outbox, queue.Expired, queue.OutboxDropped = self.outbox.Stats(peer)
+		queues[peer] = queue
+	}
+	return queues
+}
+
+// Get the sender to a peer, nil if it is not a peer or I am stopped
+func (self *ExchangeProtocol) getOrMakeSender(peer string) *PeerSender {
+	self.sendersMu.Lock()
+	defer self.sendersMu.Unlock()
+	if self.stopped {
+		return nil
+	}
+	sender, ok := self.senders[peer]
+	if !ok {
+		if _, ok = self.getPeerAddr(peer); !ok {
+			return nil
+		}
+		sender = NewPeerSender(self, peer, self.QueueLen, self.BatchSize, self.SendTimeout)
+		sender.Start()
+		self.senders[peer] = sender
+	}
+	return sender
+}
+
+func (self *ExchangeProtocol) Sync(peer string, request *pb.SyncRequest) (*pb.SyncReply, error) {
+	client, err := self.getOrMakeClient(peer)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), self.SendTimeout)
+	defer cancel()
+	return client.Sync(ctx, request)
+}
+
 func (self *ExchangeProtocol) Ping(peer string) (*pb.PingReply, error) {
 	client, err := self.getOrMakeClient(peer)
 	if err != nil {
@@ -204,7 +590,9 @@ func (self *ExchangeProtocol) Ping(peer string) (*pb.PingReply, error) {
 	}
 	request := &pb.PingRequest{Source: self.me, Time: pnow}
 	du.LogD(etag, "ping %s at %s", peer, now)
-	reply, err := client.Ping(context.Background(), request)
+	ctx, cancel := context.WithTimeout(context.Background(), self.SendTimeout)
+	defer cancel()
+	reply, err := client.Ping(ctx, request)
 	if err != nil {
 		return nil, err
 	}
@@ -215,7 +603,7 @@ func (self *ExchangeProtocol) Ping(peer string) (*pb.PingReply, error) {
 func (self *ExchangeProtocol) PingAll() (map[string]*pb.PingReply, error) {
 	var ferr error
 	result := make(map[string]*pb.PingReply)
-	for peer, _ := range self.Peers {
+	for peer := range self.GetPeers() {
 		if peer == self.Id {
 			continue
 		}
@@ -229,41 +617,54 @@ func (self *ExchangeProtocol) PingAll() (map[string]*pb.PingReply, error) {
 	return result, ferr
 }
 
-func (self *ExchangeProtocol) Interested(peer string, subject string) bool {
-	self.mu.Lock()
-	defer self.mu.Unlock()
-	ignoreset, ok := self.SkipSubjectPeers[subject]
-	if !ok { // no ignoreset yet, great
-		return false
+// Grant or renew the lease of a peer on a subject
+func (self *ExchangeProtocol) Interested(peer string, subject string, lease time.Duration) bool {
+	if lease <= 0 {
+		lease = self.Lease
 	}
-	ignoreset.Remove(subject, peer)
+	self.leases.Grant(subject, peer, time.Now().Add(lease))
+	du.LogD(etag, "notify %s about health of %s for %s", peer, subject, lease)
 	return true
 }
 
+// Revoke the lease of a peer on a subject
 func (self *ExchangeProtocol) Uninterested(peer string, subject string) bool {
-	self.mu.Lock()
-	defer self.mu.Unlock()
-	ignoreset, ok := self.SkipSubjectPeers[subject]
-	if !ok {
-		ignoreset = NewIgnoreSet()
-		self.SkipSubjectPeers[subject] = ignoreset
-	}
-	ignoreset.Set(peer)
 	du.LogD(etag, "stop notifying %s about health of %s in the future", peer, subject)
-	return true
+	return self.leases.Revoke(subject, peer)
+}
+
+func (self *ExchangeProtocol) SetDB(db dt.HealthDB) {
+	self.leases.SetDB(db)
+	self.leases.Load()
+}
+
+func (self *ExchangeProtocol) GetLeases() []*pb.Lease {
+	return self.leases.List()
+}
+
+func (self *ExchangeProtocol) ExpireLeases() int {
+	return self.leases.Expire(time.Now())
+}
+
+// Reach the peers through another transport than gRPC over TCP, must be
+// called before Start. The transport dials with my credentials and token.
+func (self *ExchangeProtocol) SetTransport(transport dc.Transport) {
+	transport.SetDefaultOptions(self.authority, self.options...)
+	self.transport = transport
+}
+
+func (self *ExchangeProtocol) Client(peer string) (pb.HealthServiceClient, error) {
+	return self.getOrMakeClient(peer)
 }
 
 func (self *ExchangeProtocol) getOrMakeClient(peer string) (pb.HealthServiceClient, error) {
-	client, ok := self.Clients[peer]
-	if ok {
-		return client, nil
+	addr, ok := self.getPeerAddr(peer)
+	if !ok {
+		return nil, fmt.Errorf("Unknown peer %s", peer)
 	}
-	addr := self.Peers[peer]
-	conn, err := grpc.Dial(addr, grpc.WithInsecure())
-	if err != nil {
-		return nil, err
+	if self.tlsErr != nil {
+		// never fall back to an insecure connection
+		return nil, self.tlsErr
 	}
-	client = pb.NewHealthServiceClient(conn)
-	self.Clients[peer] = client
-	return client, nil
+	return self.transport.Get(peer, addr)
 }
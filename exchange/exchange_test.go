@@ -0,0 +1,229 @@
+package exchange
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+// Make an exchange that is stopped when the test ends, so that its senders
+// and connections don't outlive the test
+func newTestExchange(t *testing.T, config *dt.HealthServerConfig) *ExchangeProtocol {
+	exchange := NewExchangeProtocol(config)
+	t.Cleanup(func() { exchange.Stop() })
+	return exchange
+}
+
+// Serve a peer on a local port until the test ends, return its address
+func servePeer(t *testing.T, peer pb.HealthServiceServer) string {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return servePeerOn(t, lis, peer)
+}
+
+func servePeerOn(t *testing.T, lis net.Listener, peer pb.HealthServiceServer) string {
+	server := grpc.NewServer()
+	pb.RegisterHealthServiceServer(server, peer)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return lis.Addr().String()
+}
+
+func TestGossipRounds(t *testing.T) {
+	cases := []struct {
+		n, fanout, rounds int
+	}{
+		{1, 3, 1},
+		{3, 3, 2},
+		{10, 3, 4},
+		{100, 3, 6},
+		{100, 10, 3},
+	}
+	for _, c := range cases {
+		if rounds := GossipRounds(c.n, c.fanout); rounds != c.rounds {
+			t.Errorf("expecting %d rounds for %d peers with fanout %d, got %d", c.rounds, c.n, c.fanout, rounds)
+		}
+	}
+}
+
+func TestSeen(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	config := &dt.HealthServerConfig{Id: "DHS_0", Peers: map[string]string{"DHS_0": "localhost:6688"},
+		ExchangeConfig: dt.ExchangeConfig{Mode: MODE_GOSSIP}}
+	exchange := newTestExchange(t, config)
+	if exchange.Mode != MODE_GOSSIP || exchange.Fanout != GOSSIP_FANOUT {
+		t.Errorf("unexpected gossip setting %s fanout %d", exchange.Mode, exchange.Fanout)
+	}
+	request := &pb.LearnReportRequest{Id: "DHS_1-1", Rounds: 2}
+	if exchange.Seen(request) {
+		t.Error("first copy of a report should not be seen")
+	}
+	if !exchange.Seen(request) {
+		t.Error("second copy of a report should be suppressed")
+	}
+	if exchange.Seen(&pb.LearnReportRequest{}) || exchange.Seen(&pb.LearnReportRequest{}) {
+		t.Error("report without an id should never be suppressed")
+	}
+}
+
+func TestPropagateId(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	config := &dt.HealthServerConfig{Id: "DHS_0", Peers: map[string]string{"DHS_0": "localhost:6688"},
+		ExchangeConfig: dt.ExchangeConfig{Heartbeat: -1}}
+	exchange := newTestExchange(t, config)
+	exchange.Propagate(dt.NewReport("FE_1", "TS_1", map[string]*pb.Value{"cpu": &pb.Value{Status: pb.Status_HEALTHY, Score: 100}}))
+	id := fmt.Sprintf("DHS_0-%d", exchange.seq)
+	if !exchange.Seen(&pb.LearnReportRequest{Id: id}) {
+		t.Errorf("expecting broadcast report %s to be suppressed when relayed back", id)
+	}
+}
+
+// A peer that blocks in LearnReports until released
+type stubPeer struct {
+	pb.HealthServiceServer
+	release chan bool
+	batches chan int
+}
+
+func (self *stubPeer) LearnReports(ctx context.Context, in *pb.LearnReportsRequest) (*pb.LearnReportsReply, error) {
+	<-self.release
+	self.batches <- len(in.Requests)
+	reply := &pb.LearnReportsReply{}
+	for range in.Requests {
+		reply.Replies = append(reply.Replies, &pb.LearnReportReply{Result: pb.LearnReportReply_ACCEPTED})
+	}
+	return reply, nil
+}
+
+func TestPeerSender(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	peer := &stubPeer{release: make(chan bool), batches: make(chan int, 10)}
+	addr := servePeer(t, peer)
+
+	config := &dt.HealthServerConfig{
+		Id:             "DHS_0",
+		Peers:          map[string]string{"DHS_0": "localhost:0", "DHS_1": addr},
+		ExchangeConfig: dt.ExchangeConfig{QueueLen: 5},
+	}
+	exchange := newTestExchange(t, config)
+	exchange.Interested("DHS_1", ANY_SUBJECT, time.Minute)
+	exchange.Propagate(dt.NewReport("FE_1", "TS_1", nil))
+	time.Sleep(200 * time.Millisecond) // wait for the first request to be in flight
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 19; i++ {
+		exchange.Propagate(dt.NewReport("FE_1", "TS_1", nil))
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > goroutines+10 {
+		t.Errorf("hung peer should not pile up goroutines, %d before and %d after", goroutines, n)
+	}
+	queue := exchange.GetQueues()["DHS_1"]
+	// one request is in flight, the queue is full and the rest are dropped
+	if queue == nil || queue.Depth != 5 || queue.Dropped != 14 {
+		t.Errorf("expecting 5 queued and 14 dropped requests, got %v", queue)
+	}
+	close(peer.release)
+	if n := <-peer.batches; n != 1 {
+		t.Errorf("expecting the first batch to have 1 request, got %d", n)
+	}
+	if n := <-peer.batches; n != 5 {
+		t.Errorf("expecting the queued requests to be sent in one batch, got %d", n)
+	}
+}
+
+func TestStopSenders(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	peer := &stubPeer{release: make(chan bool), batches: make(chan int, 10)}
+	addr := servePeer(t, peer)
+
+	config := &dt.HealthServerConfig{
+		Id:             "DHS_0",
+		Peers:          map[string]string{"DHS_0": "localhost:0", "DHS_1": addr},
+		ExchangeConfig: dt.ExchangeConfig{Heartbeat: -1},
+	}
+	exchange := newTestExchange(t, config)
+	exchange.Start()
+	exchange.Interested("DHS_1", ANY_SUBJECT, time.Minute)
+	exchange.Propagate(dt.NewReport("FE_1", "TS_1", nil))
+	time.Sleep(200 * time.Millisecond) // wait for the first request to be in flight
+	for i := 0; i < 3; i++ {
+		exchange.Propagate(dt.NewReport("FE_1", "TS_1", nil))
+	}
+	stopped := make(chan bool)
+	go func() {
+		exchange.Stop()
+		close(stopped)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(peer.release)
+	<-stopped
+	if n := <-peer.batches; n != 1 {
+		t.Errorf("expecting the batch in flight to be sent, got %d requests", n)
+	}
+	select {
+	case n := <-peer.batches:
+		t.Errorf("expecting no batch to be sent after stopping, got %d requests", n)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if len(exchange.GetQueues()) != 0 {
+		t.Error("expecting the senders to be dropped when stopping")
+	}
+	if depth, _, _ := exchange.outbox.Stats("DHS_1"); depth != 3 {
+		t.Errorf("expecting the queued requests to be kept in the outbox, got %d", depth)
+	}
+}
+
+// A peer that records the requests it learns
+type recordingPeer struct {
+	pb.HealthServiceServer
+	requests chan *pb.LearnReportRequest
+}
+
+func (self *recordingPeer) LearnReports(ctx context.Context, in *pb.LearnReportsRequest) (*pb.LearnReportsReply, error) {
+	reply := &pb.LearnReportsReply{}
+	for _, request := range in.Requests {
+		self.requests <- request
+		reply.Replies = append(reply.Replies, &pb.LearnReportReply{Result: pb.LearnReportReply_ACCEPTED})
+	}
+	return reply, nil
+}
+
+func TestResubscribe(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	peer := &recordingPeer{requests: make(chan *pb.LearnReportRequest, 10)}
+	addr := servePeer(t, peer)
+
+	config := &dt.HealthServerConfig{Id: "DHS_0", Peers: map[string]string{"DHS_0": "localhost:0"},
+		ExchangeConfig: dt.ExchangeConfig{Heartbeat: -1}}
+	exchange := newTestExchange(t, config)
+	exchange.Start()
+	exchange.Subscribe("TS_1")
+	exchange.Unsubscribe("TS_2")
+	ts, _ := ptypes.TimestampProto(time.Now())
+	exchange.UpdateMember(&pb.Member{Peer: &pb.Peer{Id: "DHS_1", Addr: addr}, Time: ts})
+	select {
+	case request := <-peer.requests:
+		if request.Kind != pb.LearnReportRequest_SUBSCRIPTION || request.Report.Subject != "TS_1" {
+			t.Errorf("expecting a subscription to TS_1, got %v", request)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expecting a peer that joined to be subscribed right away")
+	}
+	select {
+	case request := <-peer.requests:
+		t.Errorf("expecting only one subscription, got %v", request)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,213 @@
+package exchange
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+const (
+	LEASE_DURATION = 60 * time.Second // default time a subscription lasts unless renewed
+	ANY_SUBJECT    = "*"              // subscription to the reports about all subjects
+)
+
+// Subscriptions of peers to the reports about subjects. A subscription is a
+// lease the peer renews periodically, so a lost unsubscription or a peer that
+// went away only keeps the reports flowing until the lease expires. The
+// leases are persisted to survive a restart. A peer that never subscribed,
+// e.g., running an older version, gets the reports about all subjects but
+// the ones it ignored.
+type LeaseTable struct {
+	leases      map[string]map[string]time.Time // expiry of the lease of each peer on each subject
+	subscribers map[string]bool                 // peers that subscribed at least once
+	ignored     map[string]map[string]bool      // subjects ignored by the peers that never subscribed
+	db          dt.HealthDB
+	mu          sync.RWMutex
+}
+
+func NewLeaseTable() *LeaseTable {
+	return &LeaseTable{
+		leases:      make(map[string]map[string]time.Time),
+		subscribers: make(map[string]bool),
+		ignored:     make(map[string]map[string]bool),
+	}
+}
+
+func (self *LeaseTable) SetDB(db dt.HealthDB) {
+	self.db = db
+}
+
+// Load the leases that have not expired from the database
+func (self *LeaseTable) Load() int {
+	if self.db == nil {
+		return 0
+	}
+	now := time.Now()
+	loaded := 0
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, lease := range self.db.ReadLeases() {
+		expires, err := ptypes.Timestamp(lease.Expires)
+		if err != nil || !expires.After(now) {
+			continue
+		}
+		self.set(lease.Subject, lease.Peer, expires)
+		loaded++
+	}
+	du.LogI(etag, "loaded %d leases", loaded)
+	return loaded
+}
+
+func (self *LeaseTable) set(subject string, peer string, expires time.Time) {
+	peers, ok := self.leases[subject]
+	if !ok {
+		peers = make(map[string]time.Time)
+		self.leases[subject] = peers
+	}
+	peers[peer] = expires
+	self.subscribers[peer] = true
+	if ignored, ok := self.ignored[subject]; ok {
+		delete(ignored, peer)
+	}
+}
+
+// Grant or renew the lease of a peer on a subject
+func (self *LeaseTable) Grant(subject string, peer string, expires time.Time) {
+	self.mu.Lock()
+	self.set(subject, peer, expires)
+	self.mu.Unlock()
+	if self.db != nil {
+		pexpires, _ := ptypes.TimestampProto(expires)
+		self.db.InsertLease(&pb.Lease{Subject: subject, Peer: peer, Expires: pexpires})
+	}
+}
+
+// Revoke the lease of a peer on a subject, return whether it was held. The
+// subject is ignored from now on if the peer never subscribed.
+func (self *LeaseTable) Revoke(subject string, peer string) bool {
+	self.mu.Lock()
+	if !self.subscribers[peer] {
+		ignored, ok := self.ignored[subject]
+		if !ok {
+			ignored = make(map[string]bool)
+			self.ignored[subject] = ignored
+		}
+		held := !ignored[peer]
+		ignored[peer] = true
+		self.mu.Unlock()
+		return held
+	}
+	peers, ok := self.leases[subject]
+	if ok {
+		_, ok = peers[peer]
+		delete(peers, peer)
+		if len(peers) == 0 {
+			delete(self.leases, subject)
+		}
+	}
+	self.mu.Unlock()
+	if ok && self.db != nil {
+		self.db.DeleteLease(subject, peer)
+	}
+	return ok
+}
+
+// Check if a peer holds a lease on a subject, or on all subjects, at a time
+func (self *LeaseTable) Holds(subject string, peer string, now time.Time) bool {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.holds(subject, peer, now)
+}
+
+// Check if the reports about a subject go to a peer at a time, i.e., it holds
+// a lease on the subject, or never subscribed and did not ignore the subject
+func (self *LeaseTable) Delivers(subject string, peer string, now time.Time) bool {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if !self.subscribers[peer] {
+		return !self.ignored[subject][peer]
+	}
+	return self.holds(subject, peer, now)
+}
+
+// Must be called with lock held
+func (self *LeaseTable) holds(subject string, peer string, now time.Time) bool {
+	for _, s := range []string{subject, ANY_SUBJECT} {
+		if expires, ok := self.leases[s][peer]; ok && expires.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Revoke all the leases of a peer and forget about it
+func (self *LeaseTable) RemovePeer(peer string) {
+	var subjects []string
+	self.mu.RLock()
+	for subject, peers := range self.leases {
+		if _, ok := peers[peer]; ok {
+			subjects = append(subjects, subject)
+		}
+	}
+	self.mu.RUnlock()
+	for _, subject := range subjects {
+		self.Revoke(subject, peer)
+	}
+	self.mu.Lock()
+	delete(self.subscribers, peer)
+	for _, ignored := range self.ignored {
+		delete(ignored, peer)
+	}
+	self.mu.Unlock()
+}
+
+// Drop the leases that expired before a time, return the number dropped
+func (self *LeaseTable) Expire(now time.Time) int {
+	var expired []*pb.Lease
+	self.mu.Lock()
+	for subject, peers := range self.leases {
+		for peer, expires := range peers {
+			if !expires.After(now) {
+				expired = append(expired, &pb.Lease{Subject: subject, Peer: peer})
+				delete(peers, peer)
+			}
+		}
+		if len(peers) == 0 {
+			delete(self.leases, subject)
+		}
+	}
+	self.mu.Unlock()
+	for _, lease := range expired {
+		du.LogD(etag, "lease of %s on %s expired", lease.Peer, lease.Subject)
+		if self.db != nil {
+			self.db.DeleteLease(lease.Subject, lease.Peer)
+		}
+	}
+	return len(expired)
+}
+
+// All the leases ordered by subject and peer
+func (self *LeaseTable) List() []*pb.Lease {
+	var leases []*pb.Lease
+	self.mu.RLock()
+	for subject, peers := range self.leases {
+		for peer, expires := range peers {
+			pexpires, _ := ptypes.TimestampProto(expires)
+			leases = append(leases, &pb.Lease{Subject: subject, Peer: peer, Expires: pexpires})
+		}
+	}
+	self.mu.RUnlock()
+	sort.Slice(leases, func(i, j int) bool {
+		if leases[i].Subject != leases[j].Subject {
+			return leases[i].Subject < leases[j].Subject
+		}
+		return leases[i].Peer < leases[j].Peer
+	})
+	return leases
+}
@@ -0,0 +1,87 @@
+package exchange
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"panorama/store"
+	du "panorama/util"
+)
+
+func TestLeaseTable(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	dir, err := ioutil.TempDir("", "lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := store.NewHealthDBStorage(filepath.Join(dir, "lease.db"))
+	if _, err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	leases := NewLeaseTable()
+	leases.SetDB(db)
+	leases.Grant("TS_1", "DHS_1", now.Add(time.Minute))
+	leases.Grant(ANY_SUBJECT, "DHS_2", now.Add(time.Minute))
+	leases.Grant("TS_2", "DHS_1", now.Add(time.Second))
+	if !leases.Holds("TS_1", "DHS_1", now) || leases.Holds("TS_3", "DHS_1", now) {
+		t.Error("expecting DHS_1 to hold a lease on TS_1 only")
+	}
+	if !leases.Holds("TS_3", "DHS_2", now) {
+		t.Error("expecting DHS_2 to hold a lease on all subjects")
+	}
+	if leases.Holds("TS_2", "DHS_1", now.Add(2*time.Second)) {
+		t.Error("an expired lease should not be held")
+	}
+	if n := leases.Expire(now.Add(2 * time.Second)); n != 1 {
+		t.Errorf("expecting 1 expired lease, got %d", n)
+	}
+
+	// the leases survive a restart
+	restarted := NewLeaseTable()
+	restarted.SetDB(db)
+	if n := restarted.Load(); n != 2 {
+		t.Fatalf("expecting 2 leases loaded, got %d", n)
+	}
+	if list := restarted.List(); list[0].Subject != ANY_SUBJECT || list[1].Subject != "TS_1" {
+		t.Errorf("unexpected leases %v", list)
+	}
+	if !restarted.Revoke("TS_1", "DHS_1") || restarted.Revoke("TS_1", "DHS_1") {
+		t.Error("expecting the lease of DHS_1 on TS_1 to be revoked once")
+	}
+	restarted.RemovePeer("DHS_2")
+	if len(restarted.List()) != 0 || len(db.ReadLeases()) != 0 {
+		t.Error("expecting no lease left")
+	}
+}
+
+func TestLeaseFallback(t *testing.T) {
+	now := time.Now()
+	leases := NewLeaseTable()
+	if !leases.Delivers("TS_1", "DHS_1", now) {
+		t.Error("expecting the reports to go to a peer that never subscribed")
+	}
+	if !leases.Revoke("TS_1", "DHS_1") || leases.Revoke("TS_1", "DHS_1") {
+		t.Error("expecting TS_1 to be ignored by DHS_1 once")
+	}
+	if leases.Delivers("TS_1", "DHS_1", now) || !leases.Delivers("TS_2", "DHS_1", now) {
+		t.Error("expecting only the reports about TS_1 to stop going to DHS_1")
+	}
+	leases.Grant("TS_2", "DHS_1", now.Add(time.Minute))
+	if !leases.Delivers("TS_2", "DHS_1", now) || leases.Delivers("TS_3", "DHS_1", now) {
+		t.Error("expecting the reports to go to a subscriber only on its leases")
+	}
+	if leases.Delivers("TS_2", "DHS_1", now.Add(2*time.Minute)) {
+		t.Error("expecting the reports to stop going to a subscriber when its lease expires")
+	}
+	leases.RemovePeer("DHS_1")
+	if !leases.Delivers("TS_1", "DHS_1", now) {
+		t.Error("expecting a peer that left to be forgotten")
+	}
+}
@@ -0,0 +1,180 @@
+package exchange
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/net/context"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+// Check if a membership change is newer than the known one. A removal wins
+// over an addition made at the same time.
+func newerMember(member *pb.Member, known *pb.Member) bool {
+	cmp := dt.CompareTimestamp(member.Time, known.Time)
+	return cmp > 0 || (cmp == 0 && member.Removed && !known.Removed)
+}
+
+func (self *ExchangeProtocol) GetPeers() map[string]string {
+	self.peerMu.RLock()
+	defer self.peerMu.RUnlock()
+	peers := make(map[string]string, len(self.Peers))
+	for id, addr := range self.Peers {
+		peers[id] = addr
+	}
+	return peers
+}
+
+func (self *ExchangeProtocol) getPeerAddr(peer string) (string, bool) {
+	self.peerMu.RLock()
+	defer self.peerMu.RUnlock()
+	addr, ok := self.Peers[peer]
+	return addr, ok
+}
+
+func (self *ExchangeProtocol) GetMembers(removed bool) []*pb.Member {
+	self.peerMu.RLock()
+	var members []*pb.Member
+	for _, member := range self.members {
+		if removed || !member.Removed {
+			members = append(members, member)
+		}
+	}
+	self.peerMu.RUnlock()
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Peer.Id < members[j].Peer.Id
+	})
+	return members
+}
+
+func (self *ExchangeProtocol) UpdateMember(member *pb.Member) bool {
+	if member.Peer == nil || len(member.Peer.Id) == 0 {
+		return false
+	}
+	id := member.Peer.Id
+	self.peerMu.Lock()
+	if known, ok := self.members[id]; ok && !newerMember(member, known) {
+		self.peerMu.Unlock()
+		return false
+	}
+	self.members[id] = member
+	addr, wasPeer := self.Peers[id]
+	if member.Removed {
+		delete(self.Peers, id)
+	} else {
+		self.Peers[id] = member.Peer.Addr
+	}
+	if !self.fixedRounds {
+		self.Rounds = GossipRounds(len(self.Peers), self.Fanout)
+	}
+	if self.ring != nil {
+		self.ring = NewHashRing(self.Peers, RING_VNODES)
+	}
+	self.peerMu.Unlock()
+
+	if member.Removed {
+		if wasPeer {
+			du.LogI(etag, "peer %s at %s left", id, addr)
+			self.forget(id)
+		}
+	} else if !wasPeer {
+		du.LogI(etag, "peer %s at %s joined", id, member.Peer.Addr)
+		self.resubscribe(id)
+	} else if addr != member.Peer.Addr {
+		du.LogI(etag, "peer %s moved from %s to %s", id, addr, member.Peer.Addr)
+		self.disconnect(id)
+	}
+	return true
+}
+
+// Close the connection to a peer, it is reconnected on demand
+func (self *ExchangeProtocol) disconnect(peer string) {
+	self.transport.Remove(peer)
+}
+
+// Drop everything about a peer that left
+func (self *ExchangeProtocol) forget(peer string) {
+	self.sendersMu.Lock()
+	if sender, ok := self.senders[peer]; ok {
+		sender.Stop()
+		delete(self.senders, peer)
+	}
+	self.sendersMu.Unlock()
+	self.disconnect(peer)
+	self.leases.RemovePeer(peer)
+	self.outbox.Remove(peer)
+	if self.detector != nil {
+		self.detector.Forget(peer)
+	}
+}
+
+func (self *ExchangeProtocol) Sharded() bool {
+	return self.Mode == MODE_SHARDED
+}
+
+func (self *ExchangeProtocol) Owners(subject string) []string {
+	self.peerMu.RLock()
+	defer self.peerMu.RUnlock()
+	if self.ring == nil {
+		return nil
+	}
+	return self.ring.Owners(subject, self.Replicas)
+}
+
+func (self *ExchangeProtocol) IsOwner(subject string) bool {
+	if !self.Sharded() {
+		return true
+	}
+	for _, owner := range self.Owners(subject) {
+		if owner == self.Id {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *ExchangeProtocol) OwnerClient(subject string) (string, pb.HealthServiceClient, error) {
+	if self.IsOwner(subject) {
+		return "", nil, nil
+	}
+	owners := self.Owners(subject)
+	for _, owner := range owners {
+		if !self.alive(owner) {
+			continue
+		}
+		client, err := self.getOrMakeClient(owner)
+		if err == nil {
+			return owner, client, nil
+		}
+	}
+	return "", nil, fmt.Errorf("No owner of %s is reachable among %v", subject, owners)
+}
+
+func (self *ExchangeProtocol) PropagateMember(member *pb.Member) error {
+	report := &pb.Report{Observer: self.me.Id, Subject: member.Peer.Id}
+	request := &pb.LearnReportRequest{Kind: pb.LearnReportRequest_MEMBERSHIP, Source: self.me, Report: report, Member: member}
+	du.LogI(etag, "propagate membership change of %s", member.Peer.Id)
+	return self.PropagateAll(request)
+}
+
+func (self *ExchangeProtocol) Join(addr string) ([]*pb.Member, error) {
+	if self.tlsErr != nil {
+		return nil, self.tlsErr
+	}
+	client, err := self.transport.Get(addr, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer self.transport.Remove(addr)
+	ctx, cancel := context.WithTimeout(context.Background(), self.SendTimeout)
+	defer cancel()
+	reply, err := client.Join(ctx, self.me)
+	if err != nil {
+		return nil, fmt.Errorf("Fail to join through %s: %s", addr, err)
+	}
+	du.LogI(etag, "joined cluster of %d members through %s", len(reply.Members), addr)
+	return reply.Members, nil
+}
@@ -0,0 +1,70 @@
+package exchange
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+func TestMembership(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	config := &dt.HealthServerConfig{Id: "DHS_0", Peers: map[string]string{"DHS_0": "localhost:6688", "DHS_1": "localhost:6689"},
+		ExchangeConfig: dt.ExchangeConfig{Heartbeat: -1}}
+	exchange := newTestExchange(t, config)
+	now := time.Now()
+	t1, _ := ptypes.TimestampProto(now)
+	t2, _ := ptypes.TimestampProto(now.Add(time.Second))
+
+	if !exchange.UpdateMember(&pb.Member{Peer: &pb.Peer{Id: "DHS_2", Addr: "localhost:6690"}, Time: t1}) {
+		t.Error("expecting DHS_2 to join")
+	}
+	if peers := exchange.GetPeers(); len(peers) != 3 || peers["DHS_2"] != "localhost:6690" {
+		t.Errorf("expecting 3 peers, got %v", peers)
+	}
+	if len(config.Peers) != 2 {
+		t.Error("the configured peers should not change")
+	}
+
+	// DHS_1 subscribed to a subject
+	exchange.Interested("DHS_1", "TS_1", time.Minute)
+	if exchange.getOrMakeSender("DHS_1") == nil {
+		t.Fatal("expecting a sender to DHS_1")
+	}
+	if !exchange.UpdateMember(&pb.Member{Peer: &pb.Peer{Id: "DHS_1"}, Removed: true, Time: t1}) {
+		t.Error("expecting DHS_1 to leave")
+	}
+	if _, ok := exchange.GetPeers()["DHS_1"]; ok {
+		t.Error("DHS_1 should no longer be a peer")
+	}
+	if exchange.getOrMakeSender("DHS_1") != nil || len(exchange.GetQueues()) != 0 {
+		t.Error("expecting no sender to a removed peer")
+	}
+	if exchange.leases.Holds("TS_1", "DHS_1", time.Now()) {
+		t.Error("the leases of a removed peer should be dropped")
+	}
+	report := dt.NewReport("FE_1", "TS_2", map[string]*pb.Value{"cpu": &pb.Value{Status: pb.Status_HEALTHY, Score: 100}})
+	request := &pb.LearnReportRequest{Kind: pb.LearnReportRequest_NORMAL, Source: exchange.me, Report: report}
+	if skipped, _ := exchange.PropagatePeer("DHS_1", false, request); !skipped {
+		t.Error("expecting report to a removed peer to be skipped")
+	}
+
+	// an older change arriving late is ignored
+	if exchange.UpdateMember(&pb.Member{Peer: &pb.Peer{Id: "DHS_1", Addr: "localhost:6689"}, Time: t1}) {
+		t.Error("addition at the same time as the removal should be ignored")
+	}
+	if !exchange.UpdateMember(&pb.Member{Peer: &pb.Peer{Id: "DHS_1", Addr: "localhost:7689"}, Time: t2}) {
+		t.Error("expecting DHS_1 to join again")
+	}
+	if members := exchange.GetMembers(false); len(members) != 3 || members[1].Peer.Addr != "localhost:7689" {
+		t.Errorf("unexpected members %v", members)
+	}
+	exchange.UpdateMember(&pb.Member{Peer: &pb.Peer{Id: "DHS_2"}, Removed: true, Time: t2})
+	if len(exchange.GetMembers(false)) != 2 || len(exchange.GetMembers(true)) != 3 {
+		t.Error("expecting the removed member to be kept only as a tombstone")
+	}
+}
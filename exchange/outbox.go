@@ -0,0 +1,303 @@
+package exchange
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	pb "panorama/build/gen"
+	du "panorama/util"
+)
+
+const (
+	otag            = "outbox"
+	OUTBOX_LEN      = 1000            // default number of failed requests to keep for each peer
+	OUTBOX_FRESH    = 5 * time.Minute // default time after which a report is too stale to deliver
+	OUTBOX_INTERVAL = 1 * time.Second // frequency to check for retries and save the outbox
+	RETRY_INITIAL   = 1 * time.Second // initial backoff after a failure
+	RETRY_MAX       = 1 * time.Minute // maximum backoff between retries
+)
+
+type outboxEntry struct {
+	request *pb.LearnReportRequest
+	expires time.Time
+}
+
+type peerOutbox struct {
+	entries []*outboxEntry
+	backoff time.Duration
+	next    time.Time // time of the next retry
+	expired uint64
+	dropped uint64
+}
+
+// Requests that failed to be delivered to peers, kept to be retried with
+// exponential backoff until they are delivered or become stale. A successful
+// delivery to a peer means it is reachable again, so its backlog is replayed
+// right away. The outbox is optionally saved to a file to survive restarts.
+type Outbox struct {
+	Len       int
+	Freshness time.Duration
+	File      string
+
+	exchange *ExchangeProtocol
+	peers    map[string]*peerOutbox
+	dirty    bool
+	mu       *sync.Mutex
+	stopc    chan bool
+	running  sync.WaitGroup
+}
+
+func NewOutbox(exchange *ExchangeProtocol, qlen int, freshness time.Duration, file string) *Outbox {
+	return &Outbox{
+		Len:       qlen,
+		Freshness: freshness,
+		File:      file,
+		exchange:  exchange,
+		peers:     make(map[string]*peerOutbox),
+		mu:        &sync.Mutex{},
+	}
+}
+
+// Time after which the request is too stale to deliver. For a report, it is
+// counted from the time of its observation, otherwise from now.
+func (self *Outbox) expiry(request *pb.LearnReportRequest, now time.Time) time.Time {
+	if request.Kind == pb.LearnReportRequest_NORMAL {
+		if ts, err := ptypes.Timestamp(request.Report.GetObservation().GetTs()); err == nil {
+			return ts.Add(self.Freshness)
+		}
+	}
+	return now.Add(self.Freshness)
+}
+
+func (self *Outbox) getOrMakePeer(peer string) *peerOutbox {
+	po, ok := self.peers[peer]
+	if !ok {
+		po = &peerOutbox{backoff: RETRY_INITIAL}
+		self.peers[peer] = po
+	}
+	return po
+}
+
+// Keep the requests that could not be delivered to a peer. If the delivery
+// failed, as opposed to not being attempted, back off the next retry.
+func (self *Outbox) Add(peer string, requests []*pb.LearnReportRequest, failed bool) {
+	now := time.Now()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	po := self.getOrMakePeer(peer)
+	for _, request := range requests {
+		expires := self.expiry(request, now)
+		if expires.Before(now) {
+			po.expired++
+			continue
+		}
+		po.entries = append(po.entries, &outboxEntry{request: request, expires: expires})
+	}
+	if over := len(po.entries) - self.Len; over > 0 {
+		// the oldest reports are the least useful
+		po.entries = po.entries[over:]
+		po.dropped += uint64(over)
+		du.LogE(otag, "outbox to %s is full, dropped %d oldest requests", peer, over)
+	}
+	if failed {
+		po.next = now.Add(po.backoff)
+		du.LogD(otag, "retry %d requests to %s in %s", len(po.entries), peer, po.backoff)
+		po.backoff *= 2
+		if po.backoff > RETRY_MAX {
+			po.backoff = RETRY_MAX
+		}
+	}
+	self.dirty = true
+}
+
+// A peer is reachable again, replay its backlog right away
+func (self *Outbox) Delivered(peer string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	po, ok := self.peers[peer]
+	if !ok {
+		return
+	}
+	if po.backoff > RETRY_INITIAL && len(po.entries) > 0 {
+		du.LogI(otag, "%s is reachable again, replay %d requests", peer, len(po.entries))
+	}
+	po.backoff = RETRY_INITIAL
+	po.next = time.Time{}
+}
+
+// Take the fresh requests to a peer that are due for retry. Must be called with lock held.
+func (self *Outbox) due(peer string, po *peerOutbox, now time.Time) []*pb.LearnReportRequest {
+	if len(po.entries) == 0 || now.Before(po.next) {
+		return nil
+	}
+	var requests []*pb.LearnReportRequest
+	for _, entry := range po.entries {
+		if entry.expires.Before(now) {
+			po.expired++
+			continue
+		}
+		requests = append(requests, entry.request)
+	}
+	if expired := len(po.entries) - len(requests); expired > 0 {
+		du.LogI(otag, "discarded %d stale requests to %s", expired, peer)
+	}
+	po.entries = nil
+	// hold off until the replay succeeds or fails
+	po.next = now.Add(RETRY_MAX)
+	self.dirty = true
+	return requests
+}
+
+func (self *Outbox) retry() {
+	now := time.Now()
+	replay := make(map[string][]*pb.LearnReportRequest)
+	self.mu.Lock()
+	for peer, po := range self.peers {
+		if !self.exchange.alive(peer) {
+			continue // replayed when the peer comes back
+		}
+		if requests := self.due(peer, po, now); len(requests) > 0 {
+			replay[peer] = requests
+		}
+	}
+	self.mu.Unlock()
+	for peer, requests := range replay {
+		du.LogD(otag, "retrying %d requests to %s", len(requests), peer)
+		sender := self.exchange.getOrMakeSender(peer)
+		if sender == nil {
+			du.LogI(otag, "%s is no longer a peer, discarded %d requests", peer, len(requests))
+			continue
+		}
+		for i, request := range requests {
+			if err := sender.Send(request); err != nil {
+				// put the rest back and try again later
+				self.Add(peer, requests[i:], true)
+				break
+			}
+		}
+	}
+}
+
+func (self *Outbox) Start() error {
+	if len(self.File) > 0 {
+		if err := self.Load(); err != nil {
+			du.LogE(otag, "Fail to load outbox from %s: %s", self.File, err)
+		}
+	}
+	stopc := make(chan bool)
+	self.stopc = stopc
+	self.running.Add(1)
+	go func() {
+		defer self.running.Done()
+		ticker := time.NewTicker(OUTBOX_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopc:
+				return
+			case <-ticker.C:
+				self.retry()
+				if len(self.File) > 0 {
+					self.Save()
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (self *Outbox) Stop() error {
+	if self.stopc != nil {
+		close(self.stopc)
+		self.stopc = nil
+	}
+	self.running.Wait()
+	if len(self.File) > 0 {
+		return self.Save()
+	}
+	return nil
+}
+
+// Save the outbox to file if it has changed
+func (self *Outbox) Save() error {
+	self.mu.Lock()
+	if !self.dirty {
+		self.mu.Unlock()
+		return nil
+	}
+	snapshot := &pb.OutboxSnapshot{}
+	for peer, po := range self.peers {
+		for _, entry := range po.entries {
+			expires, _ := ptypes.TimestampProto(entry.expires)
+			snapshot.Entries = append(snapshot.Entries, &pb.OutboxEntry{Peer: peer, Request: entry.request, Expires: expires})
+		}
+	}
+	self.dirty = false
+	self.mu.Unlock()
+	data, err := proto.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so a crash does not leave a partial outbox
+	tmp := self.File + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		du.LogE(otag, "Fail to save outbox: %s", err)
+		return err
+	}
+	return os.Rename(tmp, self.File)
+}
+
+func (self *Outbox) Load() error {
+	data, err := ioutil.ReadFile(self.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	snapshot := &pb.OutboxSnapshot{}
+	if err = proto.Unmarshal(data, snapshot); err != nil {
+		return err
+	}
+	now := time.Now()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	loaded := 0
+	for _, entry := range snapshot.Entries {
+		expires, err := ptypes.Timestamp(entry.Expires)
+		if err != nil || expires.Before(now) || entry.Request == nil {
+			continue
+		}
+		po := self.getOrMakePeer(entry.Peer)
+		po.entries = append(po.entries, &outboxEntry{request: entry.Request, expires: expires})
+		loaded++
+	}
+	du.LogI(otag, "Loaded %d requests from outbox %s", loaded, self.File)
+	return nil
+}
+
+// Discard the requests to a peer that left
+func (self *Outbox) Remove(peer string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if _, ok := self.peers[peer]; ok {
+		delete(self.peers, peer)
+		self.dirty = true
+	}
+}
+
+// Number of pending, expired and dropped requests to a peer
+func (self *Outbox) Stats(peer string) (uint32, uint64, uint64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	po, ok := self.peers[peer]
+	if !ok {
+		return 0, 0, 0
+	}
+	return uint32(len(po.entries)), po.expired, po.dropped
+}
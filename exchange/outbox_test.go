@@ -0,0 +1,86 @@
+package exchange
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+func TestOutboxReplay(t *testing.T) {
+	du.SetLogLevel(du.FatalLevel)
+	// reserve an address for a peer that is down for now
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	config := &dt.HealthServerConfig{
+		Id:             "DHS_0",
+		Peers:          map[string]string{"DHS_0": "localhost:0", "DHS_1": addr},
+		ExchangeConfig: dt.ExchangeConfig{Heartbeat: -1},
+	}
+	exchange := newTestExchange(t, config)
+	exchange.Start()
+	exchange.Interested("DHS_1", "TS_1", time.Minute)
+	exchange.Propagate(dt.NewReport("FE_1", "TS_1", nil))
+	time.Sleep(500 * time.Millisecond)
+	if queue := exchange.GetQueues()["DHS_1"]; queue == nil || queue.Failed != 1 || queue.Outbox != 1 {
+		t.Fatalf("expecting the failed report in outbox, got %v", queue)
+	}
+
+	lis, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("Fail to listen again on %s: %s", addr, err)
+	}
+	peer := &stubPeer{release: make(chan bool), batches: make(chan int, 10)}
+	close(peer.release)
+	servePeerOn(t, lis, peer)
+	select {
+	case n := <-peer.batches:
+		if n != 1 {
+			t.Errorf("expecting 1 replayed report, got %d", n)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("failed report is not replayed")
+	}
+}
+
+func TestOutboxFreshness(t *testing.T) {
+	du.SetLogLevel(du.FatalLevel)
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "outbox")
+	exchange := newTestExchange(t, &dt.HealthServerConfig{Id: "DHS_0"})
+	outbox := NewOutbox(exchange, 2, time.Minute, file)
+
+	fresh := &pb.LearnReportRequest{Report: dt.NewReport("FE_1", "TS_1", nil)}
+	stale := &pb.LearnReportRequest{Report: dt.NewReport("FE_1", "TS_2", nil)}
+	stale.Report.Observation = dt.NewObservation(time.Now().Add(-2 * time.Minute))
+	outbox.Add("DHS_1", []*pb.LearnReportRequest{fresh, stale, fresh, fresh}, true)
+	pending, expired, dropped := outbox.Stats("DHS_1")
+	if pending != 2 || expired != 1 || dropped != 1 {
+		t.Errorf("expecting 2 pending, 1 expired and 1 dropped, got %d, %d, %d", pending, expired, dropped)
+	}
+	if err = outbox.Save(); err != nil {
+		t.Fatalf("Fail to save outbox: %s", err)
+	}
+	loaded := NewOutbox(exchange, 2, time.Minute, file)
+	if err = loaded.Load(); err != nil {
+		t.Fatalf("Fail to load outbox: %s", err)
+	}
+	if pending, _, _ = loaded.Stats("DHS_1"); pending != 2 {
+		t.Errorf("expecting 2 pending requests after reload, got %d", pending)
+	}
+}
@@ -0,0 +1,141 @@
+package exchange
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+const (
+	SUMMARY_INTERVAL = 10 * time.Second // default time between summaries of healthy repeats
+)
+
+// Priority classes of reports. Failure evidence and status changes are
+// urgent and sent right away. Repeats of a healthy status only confirm what
+// the peers already know, so they are held and merged into a summary of each
+// (observer, subject) sent periodically.
+type Summarizer struct {
+	Interval time.Duration
+
+	last    map[string]pb.Status  // last status sent of each (observer, subject, metric)
+	held    map[string]*pb.Report // healthy repeats to summarize of each (observer, subject)
+	merged  uint64                // healthy repeats merged into the held summaries
+	send    func(report *pb.Report) error
+	mu      sync.Mutex
+	stopc   chan bool
+	flushMu sync.Mutex
+	running sync.WaitGroup
+}
+
+func NewSummarizer(interval time.Duration, send func(report *pb.Report) error) *Summarizer {
+	return &Summarizer{
+		Interval: interval,
+		last:     make(map[string]pb.Status),
+		held:     make(map[string]*pb.Report),
+		send:     send,
+	}
+}
+
+func metricKey(report *pb.Report, metric string) string {
+	return report.Observer + "\x00" + report.Subject + "\x00" + metric
+}
+
+// Check if a report has to be sent right away, otherwise hold it for the next
+// summary. A report is urgent if any of its metrics is unhealthy or changed
+// its status since the last report of the observer about the subject.
+func (self *Summarizer) Offer(report *pb.Report) bool {
+	if report.Observation == nil || len(report.Observation.Metrics) == 0 {
+		return true
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	urgent := false
+	for name, metric := range report.Observation.Metrics {
+		if metric.Value == nil {
+			urgent = true
+			continue
+		}
+		key := metricKey(report, name)
+		if last, ok := self.last[key]; !ok || last != metric.Value.Status || metric.Value.Status != pb.Status_HEALTHY {
+			urgent = true
+		}
+		self.last[key] = metric.Value.Status
+	}
+	key := report.Observer + "\x00" + report.Subject
+	if urgent {
+		// the older healthy repeats are superseded
+		delete(self.held, key)
+		return true
+	}
+	held, ok := self.held[key]
+	if !ok {
+		self.held[key] = report
+		return false
+	}
+	self.merged++
+	if dt.CompareTimestamp(report.Observation.Ts, held.Observation.Ts) < 0 {
+		held, report = report, held
+	}
+	// the latest observation of each metric
+	summary := proto.Clone(report).(*pb.Report)
+	for name, metric := range held.Observation.Metrics {
+		if _, ok := summary.Observation.Metrics[name]; !ok {
+			summary.Observation.Metrics[name] = metric
+		}
+	}
+	self.held[key] = summary
+	return false
+}
+
+// Send the summaries of the healthy repeats held so far
+func (self *Summarizer) Flush() {
+	self.flushMu.Lock()
+	defer self.flushMu.Unlock()
+	self.mu.Lock()
+	held := self.held
+	self.held = make(map[string]*pb.Report)
+	merged := self.merged
+	self.merged = 0
+	self.mu.Unlock()
+	if len(held) == 0 {
+		return
+	}
+	for _, report := range held {
+		self.send(report)
+	}
+	du.LogI(etag, "sent %d summaries of %d healthy reports", len(held), uint64(len(held))+merged)
+}
+
+func (self *Summarizer) Start() {
+	stopc := make(chan bool)
+	self.stopc = stopc
+	self.running.Add(1)
+	go func() {
+		defer self.running.Done()
+		ticker := time.NewTicker(self.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopc:
+				return
+			case <-ticker.C:
+				self.Flush()
+			}
+		}
+	}()
+}
+
+func (self *Summarizer) Stop() {
+	if self.stopc != nil {
+		close(self.stopc)
+		self.stopc = nil
+	}
+	self.running.Wait()
+	// don't lose the repeats held since the last flush
+	self.Flush()
+}
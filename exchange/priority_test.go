@@ -0,0 +1,68 @@
+package exchange
+
+import (
+	"testing"
+	"time"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+func TestSummarizer(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	var sent []*pb.Report
+	summarizer := NewSummarizer(time.Hour, func(report *pb.Report) error {
+		sent = append(sent, report)
+		return nil
+	})
+	healthy := func(metrics ...string) *pb.Report {
+		time.Sleep(time.Millisecond) // distinct timestamps
+		values := make(map[string]*pb.Value)
+		for _, metric := range metrics {
+			values[metric] = &pb.Value{Status: pb.Status_HEALTHY, Score: 100}
+		}
+		return dt.NewReport("FE_1", "TS_1", values)
+	}
+	if !summarizer.Offer(healthy("cpu", "disk")) {
+		t.Error("expecting the first report of a metric to be urgent")
+	}
+	if summarizer.Offer(healthy("cpu")) {
+		t.Error("expecting a healthy repeat to be held")
+	}
+	summarizer.Offer(healthy("disk"))
+	last := healthy("cpu")
+	if summarizer.Offer(last) {
+		t.Error("expecting a healthy repeat to be held")
+	}
+	summarizer.Flush()
+	if len(sent) != 1 {
+		t.Fatalf("expecting one summary of FE_1->TS_1, got %d", len(sent))
+	}
+	summary := sent[0]
+	if dt.CompareTimestamp(summary.Observation.Ts, last.Observation.Ts) != 0 || len(summary.Observation.Metrics) != 2 {
+		t.Errorf("expecting the summary to carry the latest observation of cpu and disk, got %s",
+			dt.ObservationString(summary.Observation))
+	}
+
+	sent = nil
+	summarizer.Offer(healthy("cpu"))
+	unhealthy := dt.NewReport("FE_1", "TS_1", map[string]*pb.Value{"cpu": &pb.Value{Status: pb.Status_UNHEALTHY, Score: 10}})
+	if !summarizer.Offer(unhealthy) || !summarizer.Offer(unhealthy) {
+		t.Error("expecting unhealthy reports to be urgent")
+	}
+	if !summarizer.Offer(healthy("cpu")) {
+		t.Error("expecting a recovery to be urgent")
+	}
+	summarizer.Flush()
+	if len(sent) != 0 {
+		t.Errorf("expecting the held repeats to be superseded by the urgent reports, got %d summaries", len(sent))
+	}
+
+	summarizer.Start()
+	summarizer.Offer(healthy("cpu"))
+	summarizer.Stop()
+	if len(sent) != 1 {
+		t.Errorf("expecting the held repeat to be sent when stopping, got %d summaries", len(sent))
+	}
+}
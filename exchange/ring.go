@@ -0,0 +1,72 @@
+package exchange
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+const (
+	RING_VNODES    = 64 // number of points of each peer on the ring
+	SHARD_REPLICAS = 3  // default number of owners of a subject
+)
+
+type ringPoint struct {
+	hash uint32
+	peer string
+}
+
+// A consistent hash ring over the peers. Each peer is placed at several
+// points on the ring, and the owners of a subject are the first distinct
+// peers found clockwise from the hash of the subject. Adding or removing a
+// peer only moves the subjects next to its points.
+type HashRing struct {
+	points []ringPoint
+	npeers int
+}
+
+func ringHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func NewHashRing(peers map[string]string, vnodes int) *HashRing {
+	ring := &HashRing{npeers: len(peers)}
+	for peer := range peers {
+		for i := 0; i < vnodes; i++ {
+			ring.points = append(ring.points, ringPoint{hash: ringHash(fmt.Sprintf("%s#%d", peer, i)), peer: peer})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		if ring.points[i].hash != ring.points[j].hash {
+			return ring.points[i].hash < ring.points[j].hash
+		}
+		return ring.points[i].peer < ring.points[j].peer
+	})
+	return ring
+}
+
+// The n peers that own a subject, the primary owner first
+func (self *HashRing) Owners(subject string, n int) []string {
+	if n > self.npeers {
+		n = self.npeers
+	}
+	if n == 0 {
+		return nil
+	}
+	h := ringHash(subject)
+	start := sort.Search(len(self.points), func(i int) bool {
+		return self.points[i].hash >= h
+	})
+	var owners []string
+	picked := make(map[string]bool)
+	for i := 0; len(owners) < n; i++ {
+		point := self.points[(start+i)%len(self.points)]
+		if !picked[point.peer] {
+			picked[point.peer] = true
+			owners = append(owners, point.peer)
+		}
+	}
+	return owners
+}
@@ -0,0 +1,78 @@
+package exchange
+
+import (
+	"fmt"
+	"testing"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+func TestHashRing(t *testing.T) {
+	peers := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		peers[fmt.Sprintf("DHS_%d", i)] = fmt.Sprintf("localhost:%d", 6688+i)
+	}
+	ring := NewHashRing(peers, RING_VNODES)
+	owned := make(map[string]int)
+	before := make(map[string][]string)
+	for i := 0; i < 1000; i++ {
+		subject := fmt.Sprintf("TS_%d", i)
+		owners := ring.Owners(subject, 3)
+		if len(owners) != 3 || owners[0] == owners[1] || owners[1] == owners[2] || owners[0] == owners[2] {
+			t.Fatalf("expecting 3 distinct owners of %s, got %v", subject, owners)
+		}
+		owned[owners[0]]++
+		before[subject] = owners
+	}
+	for peer, n := range owned {
+		// 100 subjects each on average
+		if n < 40 || n > 200 {
+			t.Errorf("unbalanced ring: %s is the primary owner of %d subjects", peer, n)
+		}
+	}
+	if owners := ring.Owners("TS_1", 20); len(owners) != 10 {
+		t.Errorf("expecting at most as many owners as peers, got %d", len(owners))
+	}
+
+	// removing a peer only moves the subjects it owned
+	delete(peers, "DHS_3")
+	ring = NewHashRing(peers, RING_VNODES)
+	for subject, owners := range before {
+		if owners[0] == "DHS_3" {
+			continue
+		}
+		if primary := ring.Owners(subject, 3)[0]; primary != owners[0] {
+			t.Errorf("primary owner of %s moved from %s to %s", subject, owners[0], primary)
+		}
+	}
+}
+
+func TestShardedPropagate(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	peers := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		peers[fmt.Sprintf("DHS_%d", i)] = fmt.Sprintf("localhost:%d", 6688+i)
+	}
+	config := &dt.HealthServerConfig{Id: "DHS_0", Peers: peers,
+		ExchangeConfig: dt.ExchangeConfig{Mode: MODE_SHARDED, Replicas: 2, Heartbeat: -1, QueueLen: 100}}
+	exchange := newTestExchange(t, config)
+	var subject string
+	for i := 0; ; i++ {
+		subject = fmt.Sprintf("TS_%d", i)
+		if !exchange.IsOwner(subject) {
+			break
+		}
+	}
+	exchange.Propagate(dt.NewReport("FE_1", subject, map[string]*pb.Value{"cpu": &pb.Value{Status: pb.Status_HEALTHY, Score: 100}}))
+	queues := exchange.GetQueues()
+	if len(queues) != 2 {
+		t.Errorf("expecting the report to be sent to 2 owners only, got %d peers", len(queues))
+	}
+	for _, owner := range exchange.Owners(subject) {
+		if _, ok := queues[owner]; !ok {
+			t.Errorf("expecting the report to be sent to owner %s", owner)
+		}
+	}
+}
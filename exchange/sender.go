@@ -0,0 +1,219 @@
+package exchange
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "panorama/build/gen"
+	du "panorama/util"
+)
+
+const (
+	SENDER_QUEUE_LEN  = 1000            // default number of requests to buffer for each peer
+	SENDER_BATCH_SIZE = 50              // default maximum number of requests in one batch
+	SEND_TIMEOUT      = 5 * time.Second // default deadline for a peer to learn a batch
+)
+
+type outgoing struct {
+	request *pb.LearnReportRequest
+	queued  time.Time
+}
+
+// A long-lived sender that delivers the requests to a peer in order. The
+// requests are buffered in a bounded queue, and the ones queued up while the
+// previous batch is in flight are sent together in one LearnReports call.
+// When the peer is slow or hung, the queue fills up and new requests are
+// dropped instead of piling up goroutines.
+type PeerSender struct {
+	Peer      string
+	BatchSize int
+	Timeout   time.Duration
+
+	exchange *ExchangeProtocol
+	queue    chan *outgoing
+	batch    bool // whether the peer supports LearnReports
+	stopped  bool
+	halted   bool          // the queued requests are kept in the outbox instead of sent
+	done     chan struct{} // closed when the sender exits
+	mu       sync.RWMutex
+
+	sent    uint64
+	dropped uint64
+	failed  uint64
+	batches uint64
+}
+
+func NewPeerSender(exchange *ExchangeProtocol, peer string, qlen int, batchSize int, timeout time.Duration) *PeerSender {
+	return &PeerSender{
+		Peer:      peer,
+		BatchSize: batchSize,
+		Timeout:   timeout,
+		exchange:  exchange,
+		queue:     make(chan *outgoing, qlen),
+		batch:     true,
+		done:      make(chan struct{}),
+	}
+}
+
+// Queue a request without blocking, return error if the queue is full
+func (self *PeerSender) Send(request *pb.LearnReportRequest) error {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if self.stopped {
+		return fmt.Errorf("sender to %s is stopped", self.Peer)
+	}
+	select {
+	case self.queue <- &outgoing{request: request, queued: time.Now()}:
+		return nil
+	default:
+		dropped := atomic.AddUint64(&self.dropped, 1)
+		return fmt.Errorf("queue to %s is full, dropped %d requests so far", self.Peer, dropped)
+	}
+}
+
+func (self *PeerSender) Start() {
+	go self.run()
+}
+
+// Stop the sender after the queued requests are sent
+func (self *PeerSender) Stop() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if !self.stopped {
+		self.stopped = true
+		close(self.queue)
+	}
+}
+
+// Stop the sender without sending the queued requests, which are kept in the
+// outbox instead, and wait for the batch in flight
+func (self *PeerSender) Halt() {
+	self.mu.Lock()
+	self.halted = true
+	self.mu.Unlock()
+	self.Stop()
+	<-self.done
+}
+
+func (self *PeerSender) isHalted() bool {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.halted
+}
+
+func (self *PeerSender) run() {
+	defer close(self.done)
+	for item := range self.queue {
+		batch := []*outgoing{item}
+		closed := false
+	collect:
+		for len(batch) < self.BatchSize {
+			select {
+			case item, ok := <-self.queue:
+				if !ok {
+					closed = true
+					break collect
+				}
+				batch = append(batch, item)
+			default:
+				break collect
+			}
+		}
+		if self.isHalted() {
+			self.keep(batch)
+			continue
+		}
+		self.send(batch)
+		if closed {
+			return
+		}
+	}
+}
+
+// Keep the requests in the outbox, which saves them for after a restart
+func (self *PeerSender) keep(batch []*outgoing) {
+	requests := make([]*pb.LearnReportRequest, len(batch))
+	for i, item := range batch {
+		requests[i] = item.request
+	}
+	self.exchange.outbox.Add(self.Peer, requests, false)
+}
+
+func (self *PeerSender) send(batch []*outgoing) {
+	requests := make([]*pb.LearnReportRequest, len(batch))
+	for i, item := range batch {
+		requests[i] = item.request
+	}
+	client, err := self.exchange.getOrMakeClient(self.Peer)
+	if err != nil {
+		du.LogE(etag, "failed to get client for %s", self.Peer)
+		atomic.AddUint64(&self.failed, uint64(len(batch)))
+		self.exchange.outbox.Add(self.Peer, requests, true)
+		return
+	}
+	t1 := time.Now()
+	replies, err := self.learn(client, requests)
+	duration := time.Since(t1)
+	if err != nil {
+		du.LogE(etag, "failed to propagate %d reports to %s: %s", len(batch), self.Peer, err)
+		atomic.AddUint64(&self.failed, uint64(len(batch)))
+		// the requests before the failed one have been learned
+		self.exchange.outbox.Add(self.Peer, requests[len(replies):], true)
+		return
+	}
+	self.exchange.outbox.Delivered(self.Peer)
+	atomic.AddUint64(&self.sent, uint64(len(batch)))
+	atomic.AddUint64(&self.batches, 1)
+	for i, request := range requests {
+		if i < len(replies) {
+			self.exchange.handleReply(self.Peer, request, replies[i])
+		}
+	}
+	// the oldest request in the batch waited the longest
+	du.LogI(etag, "propagated %d reports to %s in %s (latency up to %s, queue depth %d, dropped %d)", len(batch),
+		self.Peer, duration, time.Since(batch[0].queued), len(self.queue), atomic.LoadUint64(&self.dropped))
+}
+
+func (self *PeerSender) learn(client pb.HealthServiceClient, batch []*pb.LearnReportRequest) ([]*pb.LearnReportReply, error) {
+	if self.batch {
+		ctx, cancel := context.WithTimeout(context.Background(), self.Timeout)
+		reply, err := client.LearnReports(ctx, &pb.LearnReportsRequest{Source: self.exchange.me, Requests: batch})
+		cancel()
+		if err == nil {
+			return reply.Replies, nil
+		}
+		if status.Code(err) != codes.Unimplemented {
+			return nil, err
+		}
+		du.LogI(etag, "%s does not support batching, send reports one by one", self.Peer)
+		self.batch = false
+	}
+	replies := make([]*pb.LearnReportReply, len(batch))
+	for i, request := range batch {
+		ctx, cancel := context.WithTimeout(context.Background(), self.Timeout)
+		reply, err := client.LearnReport(ctx, request)
+		cancel()
+		if err != nil {
+			return replies[:i], err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+func (self *PeerSender) Stats() *pb.PeerQueue {
+	return &pb.PeerQueue{
+		Depth:    uint32(len(self.queue)),
+		Capacity: uint32(cap(self.queue)),
+		Sent:     atomic.LoadUint64(&self.sent),
+		Dropped:  atomic.LoadUint64(&self.dropped),
+		Failed:   atomic.LoadUint64(&self.failed),
+		Batches:  atomic.LoadUint64(&self.batches),
+	}
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	pb "panorama/build/gen"
+	dc "panorama/client"
+	du "panorama/util"
+)
+
+// Options of the RPC server, serving TLS if a certificate is configured and
+// authorizing the calls by the roles of the callers if enabled
+func (self *HealthGServer) serverOptions() ([]grpc.ServerOption, error) {
+	var options []grpc.ServerOption
+	if self.AccessConfig.Enable {
+		options = append(options, grpc.UnaryInterceptor(self.authorizeUnary), grpc.StreamInterceptor(self.authorizeStream))
+	}
+	tc := self.TLSConfig
+	if len(tc.CertFile) == 0 {
+		return options, nil
+	}
+	creds, err := dc.ServerTLS(tc.CertFile, tc.KeyFile, tc.CAFile, tc.Mutual)
+	if err != nil {
+		return nil, err
+	}
+	return append(options, grpc.Creds(creds)), nil
+}
+
+// Options to dial other Panorama instances, with TLS if a certificate is
+// configured and presenting my token if any
+func (self *HealthGServer) dialOptions() ([]grpc.DialOption, error) {
+	option := grpc.WithInsecure()
+	tc := self.TLSConfig
+	if len(tc.CertFile) > 0 {
+		creds, err := dc.ClientTLS(tc.CertFile, tc.KeyFile, tc.CAFile, "")
+		if err != nil {
+			return nil, err
+		}
+		option = grpc.WithTransportCredentials(creds)
+	}
+	options := []grpc.DialOption{option}
+	if len(self.AccessConfig.Token) > 0 {
+		options = append(options, dc.WithToken(self.AccessConfig.Token))
+	}
+	return options, nil
+}
+
+// With mutual TLS, a peer must be who it claims to be: the id of the source
+// of a request must be an identity in the certificate of the caller
+func (self *HealthGServer) authenticate(ctx context.Context, source *pb.Peer) error {
+	if !self.TLSConfig.Mutual {
+		return nil
+	}
+	if source == nil {
+		return status.Errorf(codes.Unauthenticated, "Source peer is missing")
+	}
+	identities := dc.PeerIdentities(ctx)
+	for _, id := range identities {
+		if id == source.Id {
+			return nil
+		}
+	}
+	du.LogE(stag, "reject request from %v claiming to be %s", identities, source.Id)
+	return status.Errorf(codes.PermissionDenied, "Certificate is not issued to %s", source.Id)
+}
+
+// With observer tokens configured, an observer must present the token of the
+// module it registers, or of the observer for all its modules
+func (self *HealthGServer) checkToken(module string, observer string, token string) bool {
+	if len(self.ObserverTokens) == 0 {
+		return true
+	}
+	expected, ok := self.ObserverTokens[observer+"/"+module]
+	if !ok {
+		expected, ok = self.ObserverTokens[observer]
+	}
+	return ok && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// Record a rejected registration or submission along with who made it
+func audit(ctx context.Context, format string, args ...interface{}) {
+	caller := "unknown"
+	if p, ok := peer.FromContext(ctx); ok {
+		caller = p.Addr.String()
+	}
+	du.LogE(stag, "audit: rejected %s from %s", fmt.Sprintf(format, args...), caller)
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "panorama/build/gen"
+	dc "panorama/client"
+	dt "panorama/types"
+)
+
+func TestObserverTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "panorama")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gs := NewHealthGServer(&dt.HealthServerConfig{
+		Addr:           "DHS_1:6688",
+		Id:             "DHS_1",
+		Peers:          map[string]string{"DHS_1": "DHS_1:6688"},
+		DBFile:         filepath.Join(dir, "DHS_1.db"),
+		ExchangeConfig: dt.ExchangeConfig{SyncInterval: -1, Heartbeat: -1},
+		ObserverTokens: map[string]string{"XFE_1": "secret1", "XFE_2/ZooKeeper": "secret2"},
+	})
+	gs.SetTransport(dc.NewMemNetwork(1).Transport("DHS_1"))
+	if err := gs.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Stop(false)
+
+	ctx := context.Background()
+	register := func(module string, observer string, token string) (uint64, error) {
+		reply, err := gs.Register(ctx, &pb.RegisterRequest{Module: module, Observer: observer, Token: token})
+		if err != nil {
+			return 0, err
+		}
+		return reply.Handle, nil
+	}
+	if _, err := register("ZooKeeper", "XFE_1", "secret2"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expecting the token of another observer to be rejected, got %v", err)
+	}
+	if _, err := register("HDFS", "XFE_2", "secret2"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expecting the token of a module to be rejected for another module, got %v", err)
+	}
+	if _, err := register("ZooKeeper", "XFE_3", ""); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expecting an observer without a token to be rejected, got %v", err)
+	}
+	handle1, err := register("ZooKeeper", "XFE_1", "secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle2, err := register("ZooKeeper", "XFE_2", "secret2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := map[string]*pb.Value{"cpu": &pb.Value{Status: pb.Status_UNHEALTHY, Score: 30}}
+	submit := func(handle uint64, observer string) error {
+		_, err := gs.SubmitReport(ctx, &pb.SubmitReportRequest{Handle: handle, Report: dt.NewReport(observer, "TS_1", metrics)})
+		return err
+	}
+	if err := submit(handle1, "XFE_1"); err != nil {
+		t.Errorf("expecting XFE_1 to submit with its handle, got %v", err)
+	}
+	if err := submit(handle2, "XFE_1"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expecting XFE_1 to be rejected with the handle of XFE_2, got %v", err)
+	}
+	// XFE_2 guesses the handle of XFE_1 from its own
+	for _, guess := range []uint64{handle2 - 1, handle2 + 1} {
+		if err := submit(guess, "XFE_1"); status.Code(err) != codes.NotFound {
+			t.Errorf("expecting a guessed handle %d to be rejected, got %v", guess, err)
+		}
+	}
+	if report := gs.storage.GetLatestReport("TS_1"); report == nil || report.Observer != "XFE_1" {
+		t.Errorf("expecting only the report of XFE_1 about TS_1, got %v", report)
+	}
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+const (
+	CLUSTER_QUERY_TIMEOUT = 5 * time.Second // deadline for the peers to answer a cluster query
+)
+
+type peerAnswer struct {
+	peer  string
+	value interface{}
+	err   error
+}
+
+// Run a query on myself and on all the peers in parallel, until all of them
+// or a quorum of them (including myself) answer. Return the answers by the
+// id of the instance, and an error if the quorum is not reached.
+func (self *HealthGServer) fanOut(ctx context.Context, quorum uint32, local func() interface{},
+	remote func(context.Context, pb.HealthServiceClient) (interface{}, error)) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, CLUSTER_QUERY_TIMEOUT)
+	defer cancel()
+	// peers answer from what they have instead of proxying to the owners
+	ctx = metadata.AppendToOutgoingContext(ctx, PROXIED_KEY, self.Id)
+	peers := self.otherPeers()
+	answers := map[string]interface{}{self.Id: local()}
+	ch := make(chan peerAnswer, len(peers))
+	for _, peer := range peers {
+		go func(peer string) {
+			client, err := self.exchange.Client(peer)
+			if err != nil {
+				ch <- peerAnswer{peer: peer, err: err}
+				return
+			}
+			value, err := remote(ctx, client)
+			ch <- peerAnswer{peer: peer, value: value, err: err}
+		}(peer)
+	}
+	for i := 0; i < len(peers); i++ {
+		if quorum > 0 && len(answers) >= int(quorum) {
+			break
+		}
+		answer := <-ch
+		if answer.err != nil {
+			du.LogE(stag, "%s did not answer cluster query: %s", answer.peer, answer.err)
+			continue
+		}
+		answers[answer.peer] = answer.value
+	}
+	if quorum > 0 && len(answers) < int(quorum) {
+		return answers, fmt.Errorf("Only %d instances answered, %d required", len(answers), quorum)
+	}
+	return answers, nil
+}
+
+func responders(answers map[string]interface{}) []string {
+	ids := make([]string, 0, len(answers))
+	for id := range answers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// A copy of my panorama of a subject, nil if there is none
+func (self *HealthGServer) copyPanorama(subject string) *pb.Panorama {
+	pano := self.storage.GetPanorama(subject)
+	if pano == nil {
+		return nil
+	}
+	pano.RLock()
+	defer pano.RUnlock()
+	return dt.MergePanorama(subject, pano.Value)
+}
+
+// Get the panorama of a subject merged from all the instances that answer
+func (self *HealthGServer) clusterPanorama(ctx context.Context, in *pb.ClusterQueryRequest) (*pb.Panorama, []string, error) {
+	if len(in.Subject) == 0 {
+		return nil, nil, fmt.Errorf("Empty subject")
+	}
+	answers, err := self.fanOut(ctx, in.Quorum, func() interface{} {
+		return self.copyPanorama(in.Subject)
+	}, func(ctx context.Context, client pb.HealthServiceClient) (interface{}, error) {
+		pano, err := client.GetPanorama(ctx, &pb.GetPanoramaRequest{Subject: in.Subject})
+		if err != nil && status.Code(err) == codes.Unknown {
+			return (*pb.Panorama)(nil), nil // the peer answered that it has no panorama
+		}
+		return pano, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var panoramas []*pb.Panorama
+	for _, answer := range answers {
+		panoramas = append(panoramas, answer.(*pb.Panorama))
+	}
+	return dt.MergePanorama(in.Subject, panoramas...), responders(answers), nil
+}
+
+func (self *HealthGServer) GetClusterPanorama(ctx context.Context, in *pb.ClusterQueryRequest) (*pb.ClusterPanoramaReply, error) {
+	pano, ids, err := self.clusterPanorama(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ClusterPanoramaReply{Panorama: pano, Responders: ids}, nil
+}
+
+func (self *HealthGServer) GetClusterInference(ctx context.Context, in *pb.ClusterQueryRequest) (*pb.ClusterInferenceReply, error) {
+	pano, ids, err := self.clusterPanorama(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	if len(pano.Views) == 0 {
+		return nil, fmt.Errorf("No instance has a panorama for %s", in.Subject)
+	}
+	inference := self.inference.InferPanorama(pano)
+	if inference == nil {
+		return nil, fmt.Errorf("Could not compute inference for %s", in.Subject)
+	}
+	return &pb.ClusterInferenceReply{Inference: inference, Responders: ids}, nil
+}
+
+func (self *HealthGServer) DumpClusterInference(ctx context.Context, in *pb.ClusterQueryRequest) (*pb.DumpClusterInferenceReply, error) {
+	selector, err := dt.ParseLabelSelector(in.Selector)
+	if err != nil {
+		return nil, err
+	}
+	answers, err := self.fanOut(ctx, in.Quorum, func() interface{} {
+		panoramas := make(map[string]*pb.Panorama)
+		for subject := range self.storage.DumpPanorama() {
+			if pano := self.copyPanorama(subject); pano != nil {
+				panoramas[subject] = pano
+			}
+		}
+		return panoramas
+	}, func(ctx context.Context, client pb.HealthServiceClient) (interface{}, error) {
+		reply, err := client.DumpPanorama(ctx, &pb.Empty{})
+		if err != nil {
+			return nil, err
+		}
+		return reply.Panoramas, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	bySubject := make(map[string][]*pb.Panorama)
+	for _, answer := range answers {
+		for subject, pano := range answer.(map[string]*pb.Panorama) {
+			bySubject[subject] = append(bySubject[subject], pano)
+		}
+	}
+	reply := &pb.DumpClusterInferenceReply{Inferences: make(map[string]*pb.Inference), Responders: responders(answers)}
+	for subject, panoramas := range bySubject {
+		if !selector.Empty() && !selector.Matches(self.labeler.GetLabels(subject)) {
+			continue
+		}
+		if inference := self.inference.InferPanorama(dt.MergePanorama(subject, panoramas...)); inference != nil {
+			reply.Inferences[subject] = inference
+		}
+	}
+	return reply, nil
+}
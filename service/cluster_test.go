@@ -0,0 +1,120 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	pb "panorama/build/gen"
+	dc "panorama/client"
+	dt "panorama/types"
+)
+
+func TestClusterQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "panorama")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	port := portstart + int(r.Intn(portend-portstart-2))
+	peers := map[string]string{
+		"DHS_1": fmt.Sprintf("localhost:%d", port),
+		"DHS_2": fmt.Sprintf("localhost:%d", port+1),
+		"DHS_3": fmt.Sprintf("localhost:%d", port+2), // never started
+	}
+	servers := make(map[string]*HealthGServer)
+	// start DHS_2 first so that DHS_1 reaches it when pinging its peers
+	for _, id := range []string{"DHS_2", "DHS_1"} {
+		config := &dt.HealthServerConfig{
+			Addr:           peers[id],
+			Id:             id,
+			Peers:          peers,
+			DBFile:         filepath.Join(dir, id+".db"),
+			ExchangeConfig: dt.ExchangeConfig{SyncInterval: -1, Heartbeat: -1},
+		}
+		gs := NewHealthGServer(config)
+		if err := gs.Start(nil); err != nil {
+			t.Fatal(err)
+		}
+		defer gs.Stop(false)
+		servers[id] = gs
+	}
+	// each instance only knows what its own observer reported
+	unhealthy := map[string]*pb.Value{"cpu": &pb.Value{Status: pb.Status_UNHEALTHY, Score: 20}}
+	servers["DHS_1"].storage.AddReport(dt.NewReport("FE_1", "TS_1", unhealthy), false)
+	servers["DHS_2"].storage.AddReport(dt.NewReport("FE_2", "TS_1", unhealthy), false)
+	servers["DHS_2"].storage.AddReport(dt.NewReport("FE_2", "TS_2", unhealthy), false)
+
+	gs := servers["DHS_1"]
+	reply, err := gs.GetClusterPanorama(context.Background(), &pb.ClusterQueryRequest{Subject: "TS_1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Panorama.Views) != 2 {
+		t.Errorf("expecting views from 2 observers, got %d", len(reply.Panorama.Views))
+	}
+	if len(reply.Responders) != 2 || reply.Responders[0] != "DHS_1" || reply.Responders[1] != "DHS_2" {
+		t.Errorf("expecting DHS_1 and DHS_2 to answer, got %v", reply.Responders)
+	}
+	inference, err := gs.GetClusterInference(context.Background(), &pb.ClusterQueryRequest{Subject: "TS_1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inference.Inference.Observers) != 2 {
+		t.Errorf("expecting the inference from 2 observers, got %v", inference.Inference.Observers)
+	}
+	dump, err := gs.DumpClusterInference(context.Background(), &pb.ClusterQueryRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dump.Inferences["TS_2"]; !ok || len(dump.Inferences) != 2 {
+		t.Errorf("expecting inferences of TS_1 and TS_2, got %d", len(dump.Inferences))
+	}
+	if _, err = gs.GetClusterPanorama(context.Background(), &pb.ClusterQueryRequest{Subject: "TS_1", Quorum: 3}); err == nil {
+		t.Error("expecting the quorum of 3 not to be reached")
+	}
+}
+
+func TestShareInferences(t *testing.T) {
+	servers, stop := startMemCluster(t, dc.NewMemNetwork(1), []string{"DHS_2", "DHS_1"},
+		dt.ExchangeConfig{SyncInterval: -1, Heartbeat: -1, ShareInferences: true})
+	defer stop()
+	// the subscription of DHS_2 reaches DHS_1 once it is up
+	subscribed := false
+	for i := 0; i < 50 && !subscribed; i++ {
+		time.Sleep(100 * time.Millisecond)
+		reply, _ := servers["DHS_1"].GetSubscriptions(context.Background(), &pb.Empty{})
+		subscribed = len(reply.Leases) == 1 && reply.Leases[0].Peer == "DHS_2"
+	}
+	if !subscribed {
+		t.Fatal("expecting DHS_2 to subscribe to the reports of DHS_1")
+	}
+	// only DHS_1 has evidence about TS_1
+	unhealthy := map[string]*pb.Value{"cpu": &pb.Value{Status: pb.Status_UNHEALTHY, Score: 20}}
+	servers["DHS_1"].storage.AddReport(dt.NewReport("FE_1", "TS_1", unhealthy), false)
+	servers["DHS_1"].inference.InferSubjectAsync("TS_1")
+
+	gs := servers["DHS_2"]
+	var reply *pb.MergedInferenceReply
+	for i := 0; i < 50 && reply == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+		reply, _ = gs.GetMergedInference(context.Background(), &pb.GetInferenceRequest{Subject: "TS_1"})
+	}
+	if reply == nil {
+		t.Fatal("expecting the inference of TS_1 to be shared by DHS_1")
+	}
+	if reply.Local != nil {
+		t.Errorf("expecting DHS_2 to have no inference of its own, got %s", dt.InferenceString(reply.Local))
+	}
+	if _, ok := reply.Remote["DHS_1"]; !ok || len(reply.Remote) != 1 {
+		t.Errorf("expecting the inference of DHS_1 only, got %v", reply.Remote)
+	}
+	if metric := dt.GetMetric(reply.Inference.Observation, "cpu"); metric == nil || metric.Value.Status != pb.Status_UNHEALTHY {
+		t.Errorf("expecting TS_1 to be unhealthy, got %s", dt.InferenceString(reply.Inference))
+	}
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "panorama/build/gen"
+	dc "panorama/client"
+	"panorama/store"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+const (
+	FEDERATION_INTERVAL = 30 * time.Second // default time between pulls from the downstream clusters
+)
+
+// A downstream Panorama cluster whose inferences are pulled as the
+// observations of one high-level observer
+type downstream struct {
+	dt.DownstreamConfig
+	current int                        // index of the instance that answered the last pull
+	latest  map[string]*tspb.Timestamp // time of the latest inference learned of each subject
+	status  *pb.DownstreamStatus
+}
+
+// The aggregator role, pulling the inferences of downstream clusters
+type federation struct {
+	clusters []*downstream
+	conns    *dc.ConnManager
+	mu       sync.Mutex
+}
+
+func newFederation(config *dt.FederationConfig) *federation {
+	if len(config.Clusters) == 0 {
+		return nil
+	}
+	fed := &federation{}
+	for _, cluster := range config.Clusters {
+		if len(cluster.Name) == 0 || len(cluster.Addrs) == 0 {
+			du.LogE(stag, "Skip downstream cluster without a name or addresses")
+			continue
+		}
+		fed.clusters = append(fed.clusters, &downstream{
+			DownstreamConfig: *cluster,
+			latest:           make(map[string]*tspb.Timestamp),
+			status:           &pb.DownstreamStatus{Name: cluster.Name},
+		})
+	}
+	return fed
+}
+
+// Pull the inferences of the downstream clusters periodically
+func (self *HealthGServer) Federate(stopc chan bool) {
+	interval := FEDERATION_INTERVAL
+	if self.FederationConfig.Interval > 0 {
+		interval = time.Duration(self.FederationConfig.Interval) * time.Second
+	}
+	options, _ := self.dialOptions() // checked when starting
+	self.federation.conns = dc.NewConnManager(options...)
+	self.federation.conns.Start()
+	defer self.federation.conns.Close()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, cluster := range self.federation.clusters {
+			self.pullCluster(cluster)
+		}
+		select {
+		case <-stopc:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Get the inferences of a downstream cluster from the first of its instances
+// that answers, starting from the one that answered last time
+func (self *HealthGServer) dumpCluster(cluster *downstream) (map[string]*pb.Inference, []string, string, error) {
+	var err error
+	for i := 0; i < len(cluster.Addrs); i++ {
+		index := (cluster.current + i) % len(cluster.Addrs)
+		addr := cluster.Addrs[index]
+		var client pb.HealthServiceClient
+		client, err = self.federation.conns.Get(addr, addr)
+		if err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*CLUSTER_QUERY_TIMEOUT)
+		var reply *pb.DumpClusterInferenceReply
+		reply, err = client.DumpClusterInference(ctx, &pb.ClusterQueryRequest{Selector: cluster.Selector})
+		if status.Code(err) == codes.Unimplemented {
+			// the cluster runs an older version, take the view of one instance
+			var old *pb.DumpInferenceReply
+			old, err = client.DumpInference(ctx, &pb.DumpInferenceRequest{Selector: cluster.Selector})
+			if err == nil {
+				reply = &pb.DumpClusterInferenceReply{Inferences: old.Inferences}
+			}
+		}
+		cancel()
+		if err != nil {
+			du.LogE(stag, "fail to pull inferences of cluster %s from %s: %s", cluster.Name, addr, err)
+			continue
+		}
+		cluster.current = index
+		return reply.Inferences, reply.Responders, addr, nil
+	}
+	return nil, nil, "", fmt.Errorf("No instance of cluster %s answered: %s", cluster.Name, err)
+}
+
+// Learn the inferences of a downstream cluster that are newer than the ones
+// learned before, as the observations of the cluster
+func (self *HealthGServer) pullCluster(cluster *downstream) {
+	inferences, responders, addr, err := self.dumpCluster(cluster)
+	now, _ := ptypes.TimestampProto(time.Now())
+	self.federation.mu.Lock()
+	cluster.status.LastPull = now
+	if err != nil {
+		cluster.status.Error = err.Error()
+		self.federation.mu.Unlock()
+		du.LogE(stag, "%s", err)
+		return
+	}
+	cluster.status.Addr = addr
+	cluster.status.Responders = responders
+	cluster.status.Subjects = uint32(len(inferences))
+	cluster.status.Error = ""
+	self.federation.mu.Unlock()
+
+	var learned int
+	for subject, inference := range inferences {
+		if inference.Observation == nil || inference.Observation.Ts == nil {
+			continue
+		}
+		if latest, ok := cluster.latest[subject]; ok && dt.CompareTimestamp(inference.Observation.Ts, latest) <= 0 {
+			continue
+		}
+		observation := proto.Clone(inference.Observation).(*pb.Observation)
+		observation.Origin = self.Id
+		report := &pb.Report{Observer: cluster.Name, Subject: subject, Observation: observation}
+		rc, err := self.storage.AddReport(report, false)
+		if err != nil {
+			du.LogE(stag, "fail to learn inference of %s from cluster %s: %s", subject, cluster.Name, err)
+			continue
+		}
+		cluster.latest[subject] = inference.Observation.Ts
+		if rc == store.REPORT_ACCEPTED {
+			learned++
+			self.AnalyzeReport(report, false)
+		}
+	}
+	du.LogI(stag, "pulled %d inferences of cluster %s from %s, %d of them new", len(inferences), cluster.Name, addr, learned)
+}
+
+func (self *HealthGServer) GetFederation(ctx context.Context, in *pb.Empty) (*pb.GetFederationReply, error) {
+	reply := &pb.GetFederationReply{}
+	if self.federation == nil {
+		return reply, nil
+	}
+	self.federation.mu.Lock()
+	defer self.federation.mu.Unlock()
+	for _, cluster := range self.federation.clusters {
+		reply.Clusters = append(reply.Clusters, proto.Clone(cluster.status).(*pb.DownstreamStatus))
+	}
+	sort.Slice(reply.Clusters, func(i, j int) bool {
+		return reply.Clusters[i].Name < reply.Clusters[j].Name
+	})
+	return reply, nil
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+)
+
+func TestFederation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "panorama")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	port := portstart + int(r.Intn(portend-portstart-1))
+	downAddr := fmt.Sprintf("localhost:%d", port)
+	down := NewHealthGServer(&dt.HealthServerConfig{
+		Addr:           downAddr,
+		Id:             "DC1_1",
+		Peers:          map[string]string{"DC1_1": downAddr},
+		DBFile:         filepath.Join(dir, "dc1.db"),
+		ExchangeConfig: dt.ExchangeConfig{SyncInterval: -1, Heartbeat: -1},
+	})
+	if err := down.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer down.Stop(false)
+	unhealthy := map[string]*pb.Value{"cpu": &pb.Value{Status: pb.Status_UNHEALTHY, Score: 20}}
+	down.storage.AddReport(dt.NewReport("FE_1", "TS_1", unhealthy), false)
+	if _, err := down.inference.InferSubject("TS_1"); err != nil {
+		t.Fatal(err)
+	}
+
+	aggAddr := fmt.Sprintf("localhost:%d", port+1)
+	agg := NewHealthGServer(&dt.HealthServerConfig{
+		Addr:           aggAddr,
+		Id:             "GLOBAL_1",
+		Peers:          map[string]string{"GLOBAL_1": aggAddr},
+		DBFile:         filepath.Join(dir, "global.db"),
+		ExchangeConfig: dt.ExchangeConfig{SyncInterval: -1, Heartbeat: -1},
+		FederationConfig: dt.FederationConfig{
+			// the first address of the cluster is down
+			Clusters: []*dt.DownstreamConfig{&dt.DownstreamConfig{Name: "dc1", Addrs: []string{"localhost:1", downAddr}}},
+			Interval: 3600,
+		},
+	})
+	if err := agg.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer agg.Stop(false)
+
+	var inference *pb.Inference
+	for i := 0; i < 50 && inference == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+		inference = agg.inference.GetInference("TS_1")
+	}
+	if inference == nil {
+		t.Fatal("expecting the inference of TS_1 to be pulled from dc1")
+	}
+	if len(inference.Observers) != 1 || inference.Observers[0] != "dc1" {
+		t.Errorf("expecting dc1 to be the only observer of TS_1, got %v", inference.Observers)
+	}
+	if metric := dt.GetMetric(inference.Observation, "cpu"); metric == nil || metric.Value.Status != pb.Status_UNHEALTHY {
+		t.Errorf("expecting TS_1 to be unhealthy globally, got %s", dt.InferenceString(inference))
+	}
+	reply, err := agg.GetFederation(context.Background(), &pb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Clusters) != 1 || reply.Clusters[0].Addr != downAddr || reply.Clusters[0].Subjects != 1 {
+		t.Errorf("unexpected status of the pull from dc1: %v", reply.Clusters)
+	}
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	pb "panorama/build/gen"
+	dc "panorama/client"
+	dt "panorama/types"
+)
+
+// Start instances one after another on a simulated network, each
+// reaching the others at "id:6688"
+func startMemCluster(t *testing.T, network *dc.MemNetwork, ids []string, ec dt.ExchangeConfig) (map[string]*HealthGServer, func()) {
+	dir, err := ioutil.TempDir("", "panorama")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := make(map[string]string)
+	for _, id := range ids {
+		peers[id] = id + ":6688"
+	}
+	servers := make(map[string]*HealthGServer)
+	stop := func() {
+		for _, gs := range servers {
+			gs.Stop(false)
+		}
+		os.RemoveAll(dir)
+	}
+	for _, id := range ids {
+		gs := NewHealthGServer(&dt.HealthServerConfig{
+			Addr:           peers[id],
+			Id:             id,
+			Peers:          peers,
+			DBFile:         filepath.Join(dir, id+".db"),
+			ExchangeConfig: ec,
+		})
+		gs.SetTransport(network.Transport(id))
+		if err := gs.Start(nil); err != nil {
+			stop()
+			t.Fatal(err)
+		}
+		servers[id] = gs
+	}
+	return servers, stop
+}
+
+// Wait until an instance sees a peer in a state
+func waitPeerState(gs *HealthGServer, peer string, state pb.PeerStatus_State, timeout time.Duration) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		reply, _ := gs.GetPeerStatus(context.Background(), &pb.Empty{})
+		for _, status := range reply.Peers {
+			if status.Peer.Id == peer && status.State == state {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestPartition(t *testing.T) {
+	network := dc.NewMemNetwork(1)
+	network.SetDefault(dc.Link{Latency: time.Millisecond, Jitter: 2 * time.Millisecond})
+	ids := []string{"DHS_1", "DHS_2", "DHS_3"}
+	servers, stop := startMemCluster(t, network, ids, dt.ExchangeConfig{SyncInterval: -1, Heartbeat: 50})
+	defer stop()
+	for _, id := range ids {
+		for _, peer := range ids {
+			if peer != id && !waitPeerState(servers[id], peer, pb.PeerStatus_ALIVE, 5*time.Second) {
+				t.Fatalf("expecting %s to see %s alive", id, peer)
+			}
+		}
+	}
+
+	// DHS_3 is cut off from the others
+	network.Partition([]string{"DHS_1", "DHS_2"}, []string{"DHS_3"})
+	for _, id := range []string{"DHS_1", "DHS_2"} {
+		if !waitPeerState(servers[id], "DHS_3", pb.PeerStatus_DEAD, 5*time.Second) {
+			t.Errorf("expecting %s to detect DHS_3 dead", id)
+		}
+		if !waitPeerState(servers["DHS_3"], id, pb.PeerStatus_DEAD, 5*time.Second) {
+			t.Errorf("expecting DHS_3 to detect %s dead", id)
+		}
+	}
+	if !waitPeerState(servers["DHS_1"], "DHS_2", pb.PeerStatus_ALIVE, time.Second) {
+		t.Error("expecting DHS_1 to still see DHS_2 alive in its partition")
+	}
+	// the liveness of a peer is an observation about it
+	dead := false
+	for i := 0; i < 50 && !dead; i++ {
+		if inference := servers["DHS_1"].inference.GetInference("DHS_3"); inference != nil {
+			metric := dt.GetMetric(inference.Observation, "liveness")
+			dead = metric != nil && metric.Value.Status == pb.Status_DEAD
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !dead {
+		t.Error("expecting DHS_1 to infer DHS_3 dead")
+	}
+
+	network.Heal()
+	if !waitPeerState(servers["DHS_1"], "DHS_3", pb.PeerStatus_ALIVE, 5*time.Second) {
+		t.Error("expecting DHS_1 to see DHS_3 alive once the partition heals")
+	}
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	dc "panorama/client"
+)
+
+const (
+	ROLE_OBSERVER = "observer" // registers and submits local reports
+	ROLE_PEER     = "peer"     // exchanges reports and membership with the other instances
+	ROLE_READER   = "reader"   // queries reports, inferences and status
+	ROLE_ADMIN    = "admin"    // changes what is observed, silences, labels and membership, and all the above
+
+	HEALTH_SERVICE = "/idl.HealthService/"
+)
+
+// Role required to call each method of the health service. Any other method,
+// e.g., one added later, requires the admin role.
+var methodRoles = map[string]string{
+	"Register":     ROLE_OBSERVER,
+	"SubmitReport": ROLE_OBSERVER,
+
+	"RenewRegistration": ROLE_OBSERVER,
+	"Deregister":        ROLE_OBSERVER,
+
+	"LearnReport":  ROLE_PEER,
+	"LearnReports": ROLE_PEER,
+	"Ping":         ROLE_PEER,
+	"Sync":         ROLE_PEER,
+	"Join":         ROLE_PEER,
+
+	"GetLatestReport":      ROLE_READER,
+	"GetPanorama":          ROLE_READER,
+	"GetView":              ROLE_READER,
+	"GetInference":         ROLE_READER,
+	"GetObservedSubjects":  ROLE_READER,
+	"DumpPanorama":         ROLE_READER,
+	"GetMergedInference":   ROLE_READER,
+	"DumpInference":        ROLE_READER,
+	"GetPeers":             ROLE_READER,
+	"GetClusterPanorama":   ROLE_READER,
+	"GetClusterInference":  ROLE_READER,
+	"DumpClusterInference": ROLE_READER,
+	"GetFederation":        ROLE_READER,
+	"GetOwners":            ROLE_READER,
+	"GetPeerStatus":        ROLE_READER,
+	"GetSubscriptions":     ROLE_READER,
+	"GetId":                ROLE_READER,
+	"ListSilences":         ROLE_READER,
+	"GetGroupInference":    ROLE_READER,
+	"GetPeerQueues":        ROLE_READER,
+	"GetIncidents":         ROLE_READER,
+	"GetRootCause":         ROLE_READER,
+	"ListRegistrations":    ROLE_READER,
+
+	"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo": ROLE_READER,
+}
+
+// Role required to call a method by its full name
+func requiredRole(method string) string {
+	role, ok := methodRoles[strings.TrimPrefix(method, HEALTH_SERVICE)]
+	if !ok {
+		return ROLE_ADMIN
+	}
+	return role
+}
+
+// Roles of the caller of an RPC by the identities in its certificate and its
+// token, on top of the ones of everyone
+func (self *HealthGServer) callerRoles(ctx context.Context) []string {
+	ac := self.AccessConfig
+	roles := append([]string{}, ac.Anonymous...)
+	for _, id := range dc.PeerIdentities(ctx) {
+		roles = append(roles, ac.Identities[id]...)
+	}
+	if token := dc.CallerToken(ctx); len(token) > 0 {
+		for known, granted := range ac.Tokens {
+			if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+				roles = append(roles, granted...)
+			}
+		}
+	}
+	return roles
+}
+
+// Check that the caller of an RPC has the role the method requires
+func (self *HealthGServer) authorize(ctx context.Context, method string) error {
+	required := requiredRole(method)
+	roles := self.callerRoles(ctx)
+	for _, role := range roles {
+		if role == required || role == ROLE_ADMIN {
+			return nil
+		}
+	}
+	audit(ctx, "call of %s without the %s role, caller %v has %v", method, required, dc.PeerIdentities(ctx), roles)
+	return status.Errorf(codes.PermissionDenied, "%s requires the %s role", method, required)
+}
+
+func (self *HealthGServer) authorizeUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := self.authorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (self *HealthGServer) authorizeStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := self.authorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
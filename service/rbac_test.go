@@ -0,0 +1,152 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "panorama/build/gen"
+	dc "panorama/client"
+	dt "panorama/types"
+)
+
+func TestRequiredRole(t *testing.T) {
+	cases := map[string]string{
+		HEALTH_SERVICE + "SubmitReport":  ROLE_OBSERVER,
+		HEALTH_SERVICE + "LearnReports":  ROLE_PEER,
+		HEALTH_SERVICE + "GetInference":  ROLE_READER,
+		HEALTH_SERVICE + "StopObserving": ROLE_ADMIN,
+		HEALTH_SERVICE + "Unknown":       ROLE_ADMIN,
+	}
+	for method, expected := range cases {
+		if role := requiredRole(method); role != expected {
+			t.Errorf("expecting %s to require %s, got %s", method, expected, role)
+		}
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "panorama")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	port := portstart + int(r.Intn(portend-portstart-1))
+	peers := map[string]string{
+		"DHS_1": fmt.Sprintf("localhost:%d", port),
+		"DHS_2": fmt.Sprintf("localhost:%d", port+1),
+	}
+	servers := make(map[string]*HealthGServer)
+	for _, id := range []string{"DHS_2", "DHS_1"} {
+		gs := NewHealthGServer(&dt.HealthServerConfig{
+			Addr:           peers[id],
+			Id:             id,
+			Peers:          peers,
+			DBFile:         filepath.Join(dir, id+".db"),
+			ExchangeConfig: dt.ExchangeConfig{SyncInterval: -1, Heartbeat: -1},
+			AccessConfig: dt.AccessConfig{
+				Enable: true,
+				Tokens: map[string][]string{
+					"peer-token":   []string{ROLE_PEER, ROLE_READER},
+					"reader-token": []string{ROLE_READER},
+					"admin-token":  []string{ROLE_ADMIN},
+				},
+				Anonymous: []string{ROLE_OBSERVER},
+				Token:     "peer-token",
+			},
+		})
+		if err := gs.Start(nil); err != nil {
+			t.Fatal(err)
+		}
+		defer gs.Stop(false)
+		servers[id] = gs
+	}
+	if _, err := servers["DHS_1"].exchange.Ping("DHS_2"); err != nil {
+		t.Fatalf("expecting DHS_1 to reach DHS_2 with its token, got %v", err)
+	}
+
+	var managers []*dc.ConnManager
+	defer func() {
+		for _, conns := range managers {
+			conns.Close()
+		}
+	}()
+	connect := func(options ...grpc.DialOption) pb.HealthServiceClient {
+		conns := dc.NewConnManager(append(options, grpc.WithInsecure())...)
+		managers = append(managers, conns)
+		client, err := conns.Get("DHS_2", peers["DHS_2"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	ctx := context.Background()
+	anonymous := connect()
+	if _, err := anonymous.Register(ctx, &pb.RegisterRequest{Module: "test", Observer: "XFE_1"}); err != nil {
+		t.Errorf("expecting anyone to register as an observer, got %v", err)
+	}
+	if _, err := anonymous.GetId(ctx, &pb.Empty{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expecting a query without a token to be denied, got %v", err)
+	}
+	if _, err := anonymous.Ping(ctx, &pb.PingRequest{Source: &pb.Peer{Id: "DHS_1"}}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expecting a ping without a token to be denied, got %v", err)
+	}
+
+	reader := connect(dc.WithToken("reader-token"))
+	if _, err := reader.GetId(ctx, &pb.Empty{}); err != nil {
+		t.Errorf("expecting a reader to query, got %v", err)
+	}
+	request := &pb.ObserveRequest{Subject: "TS_1"}
+	if _, err := reader.StopObserving(ctx, request); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expecting a reader to be denied to stop observing, got %v", err)
+	}
+
+	admin := connect(dc.WithToken("admin-token"))
+	if _, err := admin.GetId(ctx, &pb.Empty{}); err != nil {
+		t.Errorf("expecting an admin to query, got %v", err)
+	}
+	if _, err := admin.StopObserving(ctx, request); err != nil {
+		t.Errorf("expecting an admin to stop observing, got %v", err)
+	}
+}
+
+func TestAccessControlTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "panorama")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	network := dc.NewMemNetwork(1)
+	peers := map[string]string{"DHS_1": "DHS_1:6688", "DHS_2": "DHS_2:6688"}
+	servers := make(map[string]*HealthGServer)
+	for _, id := range []string{"DHS_2", "DHS_1"} {
+		gs := NewHealthGServer(&dt.HealthServerConfig{
+			Addr:           peers[id],
+			Id:             id,
+			Peers:          peers,
+			DBFile:         filepath.Join(dir, id+".db"),
+			ExchangeConfig: dt.ExchangeConfig{SyncInterval: -1, Heartbeat: -1},
+			AccessConfig: dt.AccessConfig{
+				Enable: true,
+				Tokens: map[string][]string{"peer-token": []string{ROLE_PEER, ROLE_READER}},
+				Token:  "peer-token",
+			},
+		})
+		gs.SetTransport(network.Transport(id))
+		if err := gs.Start(nil); err != nil {
+			t.Fatal(err)
+		}
+		defer gs.Stop(false)
+		servers[id] = gs
+	}
+	if _, err := servers["DHS_1"].exchange.Ping("DHS_2"); err != nil {
+		t.Errorf("expecting DHS_1 to present its token over the simulated network, got %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package service
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "panorama/build/gen"
+	"panorama/store"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+const (
+	REGISTRATION_LEASE = 10 * time.Minute // default time a registration lasts without submissions or renewals
+
+	FEATURE_RENEW         = "renew"          // registrations are renewed by RenewRegistration
+	FEATURE_DEREGISTER    = "deregister"     // handles are released by Deregister
+	FEATURE_OBSERVER_INFO = "observer_info"  // the info of the observers is kept
+	FEATURE_TOKENS        = "tokens"         // observers must present their tokens to register
+	FEATURE_ACCESS        = "access_control" // calls require the roles of their callers
+)
+
+// Time a registration lasts without submissions or renewals, 0 for ever
+func (self *HealthGServer) lease() time.Duration {
+	if self.RegistrationLease > 0 {
+		return time.Duration(self.RegistrationLease) * time.Second
+	}
+	if self.RegistrationLease < 0 {
+		return 0
+	}
+	return REGISTRATION_LEASE
+}
+
+func (self *HealthGServer) leaseSeconds() uint32 {
+	return uint32(self.lease() / time.Second)
+}
+
+// Extend the lease of a registration. Must hold regMu.
+func (self *HealthGServer) renew(registration *dt.Registration, now time.Time) {
+	if lease := self.lease(); lease > 0 {
+		registration.Expires = now.Add(lease)
+	}
+}
+
+// Move a registration made before a restart back into the registrations.
+// Must hold regMu.
+func (self *HealthGServer) restore(registration *dt.Registration) {
+	delete(self.old_registrations, registration.Handle)
+	delete(self.old_handles, registration.ObserverModule)
+	self.registrations[registration.Handle] = registration
+	self.handles[registration.ObserverModule] = registration.Handle
+	// add this observer into watch list
+	self.storage.AddSubject(registration.Observer)
+	self.renew(registration, time.Now())
+	du.LogI(stag, "Restored an registration from %s in the old registrations", registration.Observer)
+}
+
+// Restore the registration of an observer made before a restart, if any.
+// Must hold regMu.
+func (self *HealthGServer) restoreObserver(observer dt.ObserverModule) *dt.Registration {
+	handle, ok := self.old_handles[observer]
+	if !ok {
+		return nil
+	}
+	registration := self.old_registrations[handle]
+	self.restore(registration)
+	return registration
+}
+
+// Allocate a random handle, so that an observer cannot guess the handles of
+// the others. Handles fit in the signed INTEGER column of the database and 0
+// is never a handle. Must hold regMu.
+func (self *HealthGServer) newHandle() (uint64, error) {
+	max := big.NewInt(math.MaxInt64)
+	for {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return 0, fmt.Errorf("Fail to allocate a handle: %s", err)
+		}
+		handle := n.Uint64() + 1
+		_, registered := self.registrations[handle]
+		_, old := self.old_registrations[handle]
+		if !registered && !old {
+			return handle, nil
+		}
+	}
+}
+
+// Registration of a handle, which must be registered for the observer. If we
+// just crashed and forgot about the handles we allocated, the handle may be
+// in the old registrations. Must hold regMu.
+func (self *HealthGServer) checkHandle(ctx context.Context, handle uint64, observer string, action string) (*dt.Registration, error) {
+	registration, ok := self.registrations[handle]
+	if !ok {
+		registration, ok = self.old_registrations[handle]
+		if ok && registration.Observer == observer {
+			self.restore(registration)
+		}
+	}
+	if !ok {
+		audit(ctx, "%s from %s with unknown handle %d", action, observer, handle)
+		return nil, status.Errorf(codes.NotFound, "Invalid submission handle")
+	}
+	// a handle is only used by the observer it is registered for
+	if registration.Observer != observer {
+		audit(ctx, "%s from %s with handle %d of %s", action, observer, handle, registration.Observer)
+		return nil, status.Errorf(codes.PermissionDenied, "Submission handle is not registered for %s", observer)
+	}
+	return registration, nil
+}
+
+// What I support and the limits that apply to the reports of the observers
+func (self *HealthGServer) capabilities() *pb.ServerCapabilities {
+	capabilities := &pb.ServerCapabilities{
+		Id:                self.Id,
+		Features:          []string{FEATURE_RENEW, FEATURE_DEREGISTER, FEATURE_OBSERVER_INFO},
+		MaxReportsPerView: store.MaxReportPerView,
+	}
+	if len(self.ObserverTokens) > 0 {
+		capabilities.Features = append(capabilities.Features, FEATURE_TOKENS)
+	}
+	if self.AccessConfig.Enable {
+		capabilities.Features = append(capabilities.Features, FEATURE_ACCESS)
+	}
+	if gc_frequency > 0 {
+		capabilities.Retention = uint32(gc_threshold / time.Second)
+	}
+	return capabilities
+}
+
+func (self *HealthGServer) registerReply(handle uint64) *pb.RegisterReply {
+	return &pb.RegisterReply{Handle: handle, Lease: self.leaseSeconds(), Capabilities: self.capabilities()}
+}
+
+func (self *HealthGServer) RenewRegistration(ctx context.Context, in *pb.HandleRequest) (*pb.RegisterReply, error) {
+	self.regMu.Lock()
+	defer self.regMu.Unlock()
+	registration, err := self.checkHandle(ctx, in.Handle, in.Observer, "renewal")
+	if err != nil {
+		return nil, err
+	}
+	self.renew(registration, time.Now())
+	return &pb.RegisterReply{Handle: in.Handle, Lease: self.leaseSeconds()}, nil
+}
+
+func (self *HealthGServer) Deregister(ctx context.Context, in *pb.HandleRequest) (*pb.DeregisterReply, error) {
+	self.regMu.Lock()
+	defer self.regMu.Unlock()
+	registration, err := self.checkHandle(ctx, in.Handle, in.Observer, "deregistration")
+	if err != nil {
+		return nil, err
+	}
+	self.forgetRegistration(registration)
+	du.LogI(stag, "deregistered (%s,%s) with handle %d", registration.Module, registration.Observer, in.Handle)
+	return &pb.DeregisterReply{Success: true}, nil
+}
+
+// Free the handle of a registration. Must hold regMu.
+func (self *HealthGServer) forgetRegistration(registration *dt.Registration) {
+	delete(self.registrations, registration.Handle)
+	delete(self.old_registrations, registration.Handle)
+	if self.handles[registration.ObserverModule] == registration.Handle {
+		delete(self.handles, registration.ObserverModule)
+	}
+	if self.old_handles[registration.ObserverModule] == registration.Handle {
+		delete(self.old_handles, registration.ObserverModule)
+	}
+	if self.db != nil {
+		self.db.DeleteRegistration(registration.Handle)
+	}
+}
+
+func (self *HealthGServer) ListRegistrations(ctx context.Context, in *pb.Empty) (*pb.ListRegistrationsReply, error) {
+	self.regMu.Lock()
+	defer self.regMu.Unlock()
+	reply := &pb.ListRegistrationsReply{}
+	for _, registration := range self.registrations {
+		reply.Registrations = append(reply.Registrations, registrationProto(registration))
+	}
+	// handles are random, list the observers in the order they registered
+	sort.Slice(reply.Registrations, func(i, j int) bool {
+		if c := dt.CompareTimestamp(reply.Registrations[i].Time, reply.Registrations[j].Time); c != 0 {
+			return c < 0
+		}
+		return reply.Registrations[i].Handle < reply.Registrations[j].Handle
+	})
+	return reply, nil
+}
+
+func registrationProto(registration *dt.Registration) *pb.Registration {
+	reg := &pb.Registration{
+		Handle:   registration.Handle,
+		Module:   registration.Module,
+		Observer: registration.Observer,
+		Info:     registration.Info,
+	}
+	reg.Time, _ = ptypes.TimestampProto(registration.Time)
+	if !registration.LastSubmission.IsZero() {
+		reg.LastSubmission, _ = ptypes.TimestampProto(registration.LastSubmission)
+	}
+	if !registration.Expires.IsZero() {
+		reg.Expires, _ = ptypes.TimestampProto(registration.Expires)
+	}
+	return reg
+}
+
+// Free the handles of the registrations whose leases ran out, including the
+// ones made before a restart that were never used again
+func (self *HealthGServer) expireRegistrations(now time.Time) int {
+	self.regMu.Lock()
+	defer self.regMu.Unlock()
+	var expired []*dt.Registration
+	for _, registrations := range []map[uint64]*dt.Registration{self.registrations, self.old_registrations} {
+		for _, registration := range registrations {
+			if !registration.Expires.IsZero() && registration.Expires.Before(now) {
+				expired = append(expired, registration)
+			}
+		}
+	}
+	for _, registration := range expired {
+		du.LogI(stag, "registration of (%s,%s) with handle %d expired", registration.Module, registration.Observer, registration.Handle)
+		self.forgetRegistration(registration)
+	}
+	return len(expired)
+}
+
+func (self *HealthGServer) ExpireRegistrations(stopc chan bool) {
+	lease := self.lease()
+	if lease == 0 {
+		return
+	}
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopc:
+			return
+		case <-ticker.C:
+			self.expireRegistrations(time.Now())
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "panorama/build/gen"
+	dc "panorama/client"
+	dt "panorama/types"
+)
+
+// Start a lone instance keeping its registrations in dir
+func startRegistrar(t *testing.T, dir string) *HealthGServer {
+	gs := NewHealthGServer(&dt.HealthServerConfig{
+		Addr:              "DHS_1:6688",
+		Id:                "DHS_1",
+		Peers:             map[string]string{"DHS_1": "DHS_1:6688"},
+		DBFile:            filepath.Join(dir, "DHS_1.db"),
+		ExchangeConfig:    dt.ExchangeConfig{SyncInterval: -1, Heartbeat: -1},
+		RegistrationLease: 60,
+	})
+	gs.SetTransport(dc.NewMemNetwork(1).Transport("DHS_1"))
+	if err := gs.Start(nil); err != nil {
+		t.Fatal(err)
+	}
+	return gs
+}
+
+func TestRegistrationLifecycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "panorama")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gs := startRegistrar(t, dir)
+	ctx := context.Background()
+	register := func(observer string) uint64 {
+		reply, err := gs.Register(ctx, &pb.RegisterRequest{Module: "test", Observer: observer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Lease != 60 {
+			t.Errorf("expecting a lease of 60 seconds, got %d", reply.Lease)
+		}
+		return reply.Handle
+	}
+	metrics := map[string]*pb.Value{"cpu": &pb.Value{Status: pb.Status_UNHEALTHY, Score: 30}}
+	submit := func(handle uint64, observer string) error {
+		_, err := gs.SubmitReport(ctx, &pb.SubmitReportRequest{Handle: handle, Report: dt.NewReport(observer, "TS_1", metrics)})
+		return err
+	}
+
+	handle1 := register("XFE_1")
+	if handle := register("XFE_1"); handle != handle1 {
+		t.Errorf("expecting XFE_1 to keep handle %d, got %d", handle1, handle)
+	}
+	handle2 := register("XFE_2")
+	if err := submit(handle1, "XFE_1"); err != nil {
+		t.Fatal(err)
+	}
+	list, _ := gs.ListRegistrations(ctx, &pb.Empty{})
+	if len(list.Registrations) != 2 || list.Registrations[0].Handle != handle1 || list.Registrations[1].Handle != handle2 {
+		t.Fatalf("expecting the registrations of XFE_1 and XFE_2, got %v", list.Registrations)
+	}
+	if list.Registrations[0].LastSubmission == nil || list.Registrations[1].LastSubmission != nil {
+		t.Errorf("expecting only XFE_1 to have submitted, got %v", list.Registrations)
+	}
+
+	request := &pb.HandleRequest{Handle: handle2, Observer: "XFE_1"}
+	if _, err := gs.Deregister(ctx, request); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expecting XFE_1 to be denied to deregister XFE_2, got %v", err)
+	}
+	request.Observer = "XFE_2"
+	if _, err := gs.Deregister(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+	if err := submit(handle2, "XFE_2"); status.Code(err) != codes.NotFound {
+		t.Errorf("expecting the handle of XFE_2 to be freed, got %v", err)
+	}
+
+	// XFE_1 renews its registration, but neither submits nor renews after
+	if _, err := gs.RenewRegistration(ctx, &pb.HandleRequest{Handle: handle1, Observer: "XFE_1"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := gs.expireRegistrations(time.Now()); n != 0 {
+		t.Errorf("expecting no registration to expire yet, %d did", n)
+	}
+	if n := gs.expireRegistrations(time.Now().Add(2 * time.Minute)); n != 1 {
+		t.Errorf("expecting the registration of XFE_1 to expire, %d did", n)
+	}
+	if err := submit(handle1, "XFE_1"); status.Code(err) != codes.NotFound {
+		t.Errorf("expecting the handle of XFE_1 to be freed, got %v", err)
+	}
+
+	handle3 := register("XFE_3")
+	if handle3 == handle1 || handle3 == handle2 {
+		t.Errorf("expecting a new handle, got %d", handle3)
+	}
+	handle4 := register("XFE_4")
+	gs.Deregister(ctx, &pb.HandleRequest{Handle: handle4, Observer: "XFE_4"})
+	gs.Stop(false)
+
+	gs = startRegistrar(t, dir)
+	defer gs.Stop(false)
+	if err := submit(handle3, "XFE_3"); err != nil {
+		t.Errorf("expecting the registration of XFE_3 to survive the restart, got %v", err)
+	}
+	if handle := register("XFE_5"); handle == handle3 || handle == handle4 {
+		t.Errorf("expecting the handles to be never reused, got %d", handle)
+	}
+}
+
+func TestRegistrationInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "panorama")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gs := startRegistrar(t, dir)
+	ctx := context.Background()
+	info := &pb.ObserverInfo{
+		Host:    "host1",
+		Process: "prober",
+		Pid:     42,
+		Version: "1.0",
+		Kind:    pb.ObserverInfo_PROBER,
+		Metrics: []string{"latency", "reachability"},
+	}
+	reply, err := gs.Register(ctx, &pb.RegisterRequest{Module: "probe", Observer: "XFE_1", Info: info})
+	if err != nil {
+		t.Fatal(err)
+	}
+	capabilities := reply.Capabilities
+	if capabilities == nil || capabilities.Id != "DHS_1" || capabilities.MaxReportsPerView == 0 {
+		t.Fatalf("expecting the capabilities of DHS_1, got %v", capabilities)
+	}
+	if len(capabilities.Features) == 0 || capabilities.Features[0] != FEATURE_RENEW {
+		t.Errorf("expecting registrations to be renewable, got %v", capabilities.Features)
+	}
+
+	// the prober restarts with a new version
+	info = &pb.ObserverInfo{Host: "host1", Process: "prober", Pid: 43, Version: "1.1", Kind: pb.ObserverInfo_PROBER}
+	if _, err := gs.Register(ctx, &pb.RegisterRequest{Module: "probe", Observer: "XFE_1", Info: info}); err != nil {
+		t.Fatal(err)
+	}
+	gs.Stop(false)
+
+	gs = startRegistrar(t, dir)
+	defer gs.Stop(false)
+	if _, err := gs.Register(ctx, &pb.RegisterRequest{Module: "probe", Observer: "XFE_1"}); err != nil {
+		t.Fatal(err)
+	}
+	list, _ := gs.ListRegistrations(ctx, &pb.Empty{})
+	if len(list.Registrations) != 1 || !proto.Equal(list.Registrations[0].Info, info) {
+		t.Errorf("expecting the latest info of XFE_1 to survive the restart, got %v", list.Registrations)
+	}
+}
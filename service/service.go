@@ -2,17 +2,25 @@ package service
 
 import (
 	"fmt"
+	"math/rand"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	tspb "github.com/golang/protobuf/ptypes/timestamp"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 
+	"panorama/alert"
 	pb "panorama/build/gen"
+	dc "panorama/client"
 	"panorama/decision"
 	"panorama/exchange"
 	"panorama/store"
@@ -22,13 +30,18 @@ import (
 
 const (
 	stag           = "service"
-	HANDLE_START   = 10000
 	GC_FREQUENCY   = 3 * time.Minute // frequency to invoke garbage collection
 	GC_THRESHOLD   = 5 * time.Minute // TTL threshold
 	GC_RELATIVE    = true            // garbage collect based on relative timestamp
 	HOLD_TIME      = 3 * time.Minute // time to hold ignored reports
 	HOLD_LIST_LEN  = 60              // number of items to hold at most for each subject
 	DEFAULT_DBFILE = "deephealth.db" // default database file for storing local observations
+
+	SYNC_INTERVAL    = 30 * time.Second // default time between anti-entropy rounds
+	SYNC_MAX_REPORTS = 1000             // default maximum number of observations to pull at once
+	SYNC_MAX_ROUNDS  = 10               // maximum number of pulls from a peer in one round
+
+	PROXIED_KEY = "panorama-proxied-by" // metadata of a query proxied to the owner of its subject
 )
 
 var (
@@ -42,17 +55,28 @@ type HealthGServer struct {
 	storage     dt.HealthStorage
 	db          dt.HealthDB
 	inference   dt.HealthInference
+	silencer    dt.HealthSilencer
+	labeler     dt.HealthLabeler
+	remote      dt.HealthRemoteInference
 	exchange    dt.HealthExchange
+	alerts      *alert.AlertManager
+	incidents   *alert.IncidentDetector
+	deps        *decision.DependencyGraph
 	hold_buffer *store.CacheList
+	federation  *federation  // nil unless aggregating downstream clusters
+	transport   dc.Transport // how the peers reach me, gRPC over TCP if nil
 
 	// registrations from prior run (e.g., instance restarted)
 	old_registrations map[uint64]*dt.Registration
+	old_handles       map[dt.ObserverModule]uint64 // handle of each observer in the old registrations
 	registrations     map[uint64]*dt.Registration
-	next_handle       uint64
+	handles           map[dt.ObserverModule]uint64 // handle of each registered observer
 	regMu             *sync.Mutex
 
-	l net.Listener
-	s *grpc.Server
+	l     net.Listener
+	s     *grpc.Server
+	stopc chan bool       // closed when the server stops
+	loops *sync.WaitGroup // background loops that run until the server stops
 }
 
 func NewHealthGServer(config *dt.HealthServerConfig) *HealthGServer {
@@ -61,8 +85,9 @@ func NewHealthGServer(config *dt.HealthServerConfig) *HealthGServer {
 	storage := store.NewRawHealthStorage(config.Subjects...)
 	gs.storage = storage
 	gs.registrations = make(map[uint64]*dt.Registration)
+	gs.handles = make(map[dt.ObserverModule]uint64)
 	gs.regMu = &sync.Mutex{}
-	gs.next_handle = HANDLE_START
+	gs.loops = &sync.WaitGroup{}
 	// hold ignored entries for 3 minutes
 	if config.BufConfig.HoldTime > 0 {
 		gs.hold_buffer = store.NewCacheList(time.Duration(config.BufConfig.HoldTime)*time.Second,
@@ -83,7 +108,41 @@ func NewHealthGServer(config *dt.HealthServerConfig) *HealthGServer {
 	var majority decision.SimpleMajorityInference
 	infs := store.NewHealthInferenceStorage(storage, majority)
 	gs.inference = infs
+	gs.silencer = store.NewSilenceStorage()
+	infs.SetSilencer(gs.silencer)
+	gs.labeler = store.NewLabelStorage(config.SubjectLabels)
+	gs.remote = store.NewRemoteInferenceStorage()
+	gs.deps = decision.NewDependencyGraph(config.Dependencies)
 	gs.exchange = exchange.NewExchangeProtocol(config)
+	gs.exchange.AddPeerListener(gs)
+	gs.federation = newFederation(&config.FederationConfig)
+	if config.ExchangeConfig.ShareInferences {
+		infs.AddListener(gs)
+	}
+	if len(config.IncidentConfig.Domains) > 0 {
+		incidents, err := alert.NewIncidentDetector(&config.IncidentConfig, gs.labeler)
+		if err != nil {
+			du.LogE(stag, "Fail to set up incident detection: %s", err)
+		} else {
+			gs.incidents = incidents
+			incidents.SetSilencer(gs.silencer)
+			// must see an inference before the alert manager to absorb its alert
+			infs.AddListener(incidents)
+		}
+	}
+	if len(config.AlertConfig.Rules) > 0 {
+		alerts, err := alert.NewAlertManager(&config.AlertConfig)
+		if err != nil {
+			du.LogE(stag, "Fail to set up alerts: %s", err)
+		} else {
+			gs.alerts = alerts
+			alerts.SetSilencer(gs.silencer)
+			if gs.incidents != nil {
+				alerts.SetIncidentDetector(gs.incidents)
+			}
+			infs.AddListener(alerts)
+		}
+	}
 	return gs
 }
 
@@ -91,17 +150,31 @@ func (self *HealthGServer) Start(errch chan error) error {
 	if self.s != nil {
 		return fmt.Errorf("HealthGServer is already started\n")
 	}
-	lis, err := net.Listen("tcp", self.Addr)
+	options, err := self.serverOptions()
+	if err != nil {
+		return fmt.Errorf("Fail to set up TLS: %s", err)
+	}
+	if _, err = self.dialOptions(); err != nil {
+		return fmt.Errorf("Fail to set up TLS: %s", err)
+	}
+	var lis net.Listener
+	if self.transport != nil {
+		lis, err = self.transport.Listen(self.Addr)
+	} else {
+		lis, err = net.Listen("tcp", self.Addr)
+	}
 	if err != nil {
 		return fmt.Errorf("Fail to register RPC server at %s\n", self.Addr)
 	}
 	self.l = lis
-	self.s = grpc.NewServer()
+	self.stopc = make(chan bool)
+	self.s = grpc.NewServer(options...)
 	pb.RegisterHealthServiceServer(self.s, self)
 	// Register reflection service on gRPC server.
 	reflection.Register(self.s)
+	s := self.s // may be stopped before serving
 	go func() {
-		if err := self.s.Serve(self.l); err != nil {
+		if err := s.Serve(lis); err != nil {
 			if errch != nil {
 				errch <- err
 			}
@@ -116,18 +189,77 @@ func (self *HealthGServer) Start(errch chan error) error {
 	if err == nil {
 		self.storage.SetDB(self.db)
 		self.inference.SetDB(self.db)
-		// read old registrations
-		self.old_registrations, _ = self.db.ReadRegistrations()
+		self.silencer.SetDB(self.db)
+		self.silencer.Load()
+		self.labeler.SetDB(self.db)
+		self.labeler.Load()
+		// the peers subscribed before a restart
+		self.exchange.SetDB(self.db)
+		// read old registrations, their handles are never reused
+		old_registrations, _ := self.db.ReadRegistrations()
+		self.regMu.Lock()
+		self.old_registrations = old_registrations
+		self.old_handles = make(map[dt.ObserverModule]uint64)
+		for handle, registration := range self.old_registrations {
+			self.old_handles[registration.ObserverModule] = handle
+			self.renew(registration, time.Now()) // the observers have a lease to come back
+		}
+		self.regMu.Unlock()
+		// membership changes made after the config was generated
+		for _, member := range self.db.ReadMembers() {
+			self.exchange.UpdateMember(member)
+		}
+	}
+	for _, addr := range self.Seeds {
+		members, err := self.exchange.Join(addr)
+		if err != nil {
+			du.LogE(stag, "%s", err)
+			continue
+		}
+		for _, member := range members {
+			self.learnMember(member)
+		}
+		break
 	}
 	self.inference.Start()
+	self.exchange.Start()
+	if self.alerts != nil {
+		self.alerts.Start()
+	}
 	self.exchange.PingAll()
 	if gc_frequency > 0 {
 		// set GC frequency to negative to disable GC
 		go self.GC()
 	}
+	if self.ExchangeConfig.SyncInterval >= 0 {
+		// set sync interval to negative to disable anti-entropy
+		self.loop(self.AntiEntropy)
+	}
+	if self.federation != nil {
+		self.loop(self.Federate)
+	}
+	self.loop(self.RenewSubscriptions)
+	self.loop(self.ExpireRegistrations)
 	return nil
 }
 
+// Run a loop in the background until the server stops, which waits for it
+func (self *HealthGServer) loop(run func(stopc chan bool)) {
+	stopc := self.stopc
+	self.loops.Add(1)
+	go func() {
+		defer self.loops.Done()
+		run(stopc)
+	}()
+}
+
+// Serve and reach the peers through another transport than gRPC over TCP,
+// e.g., a simulated network. Must be called before Start.
+func (self *HealthGServer) SetTransport(transport dc.Transport) {
+	self.transport = transport
+	self.exchange.SetTransport(transport)
+}
+
 func (self *HealthGServer) Stop(graceful bool) error {
 	if self.s == nil {
 		return fmt.Errorf("HealthGServer has not started\n")
@@ -139,7 +271,13 @@ func (self *HealthGServer) Stop(graceful bool) error {
 	}
 	self.s = nil
 	self.l = nil
+	close(self.stopc)
+	self.loops.Wait()
 	self.inference.Stop()
+	self.exchange.Stop()
+	if self.alerts != nil {
+		self.alerts.Stop()
+	}
 	if self.db != nil {
 		self.db.Close()
 	}
@@ -147,77 +285,69 @@ func (self *HealthGServer) Stop(graceful bool) error {
 }
 
 func (self *HealthGServer) Register(ctx context.Context, in *pb.RegisterRequest) (*pb.RegisterReply, error) {
+	if !self.checkToken(in.Module, in.Observer, in.Token) {
+		audit(ctx, "registration of (%s,%s) with a wrong token", in.Module, in.Observer)
+		return nil, status.Errorf(codes.PermissionDenied, "Wrong token for observer %s", in.Observer)
+	}
 	self.regMu.Lock()
 	defer self.regMu.Unlock()
-	var max_handle uint64 = 0
-	for handle, registration := range self.registrations {
-		if registration.Module == in.Module && registration.Observer == in.Observer {
-			return &pb.RegisterReply{Handle: handle}, nil
-		}
-		if handle > max_handle {
-			max_handle = handle
+	now := time.Now()
+	observer := dt.ObserverModule{Module: in.Module, Observer: in.Observer}
+	var registration *dt.Registration
+	if handle, ok := self.handles[observer]; ok {
+		registration = self.registrations[handle]
+		self.renew(registration, now)
+	} else {
+		registration = self.restoreObserver(observer)
+	}
+	if registration != nil {
+		if in.Info != nil && !proto.Equal(in.Info, registration.Info) {
+			// e.g., the observer restarted with a new version
+			registration.Info = in.Info
+			if self.db != nil {
+				self.db.InsertRegistration(registration)
+			}
 		}
+		return self.registerReply(registration.Handle), nil
 	}
-	if self.next_handle > max_handle {
-		max_handle = self.next_handle
-	} else {
-		max_handle = max_handle + 1
+	handle, err := self.newHandle()
+	if err != nil {
+		return nil, err
 	}
-	self.storage.AddSubject(in.Observer) // should include this local observer into watch list
-	now := time.Now()
-	observer := dt.ObserverModule{Module: in.Module, Observer: in.Observer}
-	registration := &dt.Registration{ObserverModule: observer, Handle: max_handle, Time: now}
-	self.registrations[max_handle] = registration
-	du.LogD(stag, "received register request from (%s,%s), assigned handle %d", in.Module, in.Observer, max_handle)
+	// should include this local observer into watch list
+	if self.storage.AddSubject(in.Observer) && self.FilterSubmission {
+		go self.exchange.Subscribe(in.Observer)
+	}
+	registration = &dt.Registration{ObserverModule: observer, Handle: handle, Time: now, Info: in.Info}
+	self.renew(registration, now)
+	self.registrations[handle] = registration
+	self.handles[observer] = handle
+	du.LogD(stag, "received register request from (%s,%s), assigned handle %d", in.Module, in.Observer, handle)
 	if self.db != nil {
 		self.db.InsertRegistration(registration)
 	}
-	self.next_handle = max_handle + 1
-	return &pb.RegisterReply{Handle: max_handle}, nil
+	return self.registerReply(handle), nil
 }
 
 func (self *HealthGServer) SubmitReport(ctx context.Context, in *pb.SubmitReportRequest) (*pb.SubmitReportReply, error) {
+	if in.Report == nil {
+		return nil, fmt.Errorf("Missing report")
+	}
 	self.regMu.Lock()
-	_, ok := self.registrations[in.Handle]
-	var valid bool = false
-	if !ok {
-		if self.old_registrations != nil {
-			// If we have old registrations, we might have just crashed and forgot
-			// about the handles we allocated. So we should check the old registrations
-			// if we cannot find the handle in the new registrations
-			du.LogD(stag, "Tried to check old registrations %v for handle %d", self.old_registrations, in.Handle)
-			old_reg, ok := self.old_registrations[in.Handle]
-			if ok {
-				if old_reg.Observer == in.Report.Observer {
-					// Yes, the old registrations have a record for this handle and it matches
-					// Insert it into the new registrations
-					self.registrations[in.Handle] = old_reg
-					// add this observer into watch list
-					self.storage.AddSubject(old_reg.Observer)
-					valid = true
-					du.LogI(stag, "Restored an registration from %s in the old registrations", old_reg.Observer)
-				} else {
-					du.LogI(stag, "Found handle in old registrations but observer does not match: %s vs. %s ", old_reg.Observer, in.Report.Observer)
-				}
-			} else {
-				du.LogI(stag, "Could not find old registration either for handle %d", in.Handle)
-			}
-		}
-		if !valid {
-			self.regMu.Unlock()
-			return nil, fmt.Errorf("Invalid submission handle")
-		}
-	} else {
-		// FIXIT: here we should also check if the Observer identity matches
-		// because there is a potential race condition between we restore
-		// an old registration and accept a new registration. Therefore
-		// The old observer may be using a handle allocated to a new observer.
-		// But for now, it does not really cause an issue as the Observer identity
-		// is used directly from the Report instead of the Registration table.
+	registration, err := self.checkHandle(ctx, in.Handle, in.Report.Observer, "submission")
+	if err != nil {
+		self.regMu.Unlock()
+		return nil, err
 	}
+	now := time.Now()
+	registration.LastSubmission = now
+	self.renew(registration, now)
 	self.regMu.Unlock()
 
 	report := in.Report
+	if report.Observation != nil {
+		report.Observation.Origin = self.Id // I am the first to ingest it
+	}
 	var result pb.SubmitReportReply_Status
 	du.LogD(stag, "submitting report about %s", report.Subject)
 	rc, err := self.storage.AddReport(report, false) // never ignore local reports
@@ -232,18 +362,52 @@ func (self *HealthGServer) SubmitReport(ctx context.Context, in *pb.SubmitReport
 		go self.AnalyzeReport(report, true)
 		du.LogD(stag, "propagating report about %s", report.Subject)
 		go self.exchange.Propagate(report)
+	case store.REPORT_DUPLICATE:
+		// a retry of a report I already have, which was analyzed and propagated
+		result = pb.SubmitReportReply_ACCEPTED
 	}
 	return &pb.SubmitReportReply{Result: result}, err
 }
 
 func (self *HealthGServer) LearnReport(ctx context.Context, in *pb.LearnReportRequest) (*pb.LearnReportReply, error) {
+	if err := self.authenticate(ctx, in.Source); err != nil {
+		return nil, err
+	}
 	report := in.Report
 	switch in.Kind {
 	case pb.LearnReportRequest_NORMAL:
 		{
+			if self.exchange.Seen(in) {
+				du.LogD(stag, "already learned report %s about %s", in.Id, report.Subject)
+				return &pb.LearnReportReply{Result: pb.LearnReportReply_DUPLICATE}, nil
+			}
+			if in.Hops > exchange.MAX_HOPS {
+				du.LogE(stag, "drop report %s about %s relayed %d times", in.Id, report.Subject, in.Hops)
+				return &pb.LearnReportReply{Result: pb.LearnReportReply_DUPLICATE}, nil
+			}
+			if report.Observation != nil && len(report.Observation.Origin) == 0 {
+				// reports from old peers don't carry the origin in the observation
+				if in.Origin != nil {
+					report.Observation.Origin = in.Origin.Id
+				} else {
+					report.Observation.Origin = in.Source.Id
+				}
+			}
+			if in.Rounds > 0 {
+				if ts, err := ptypes.Timestamp(report.GetObservation().GetTs()); err == nil {
+					du.LogI(stag, "learned gossiped report %s about %s from %s at %s in %s", in.Id, report.Subject,
+						report.Observer, in.Source.Id, time.Since(ts))
+				}
+				go self.exchange.Relay(in)
+			}
 			du.LogD(stag, "learning report about %s from %s at %s", report.Subject, report.Observer, in.Source.Id)
 			var result pb.LearnReportReply_Status
-			rc, err := self.storage.AddReport(report, self.FilterSubmission)
+			filter := self.FilterSubmission
+			if self.exchange.Sharded() {
+				// the report is forwarded to me because I own its subject
+				filter = !self.exchange.IsOwner(report.Subject)
+			}
+			rc, err := self.storage.AddReport(report, filter)
 			switch rc {
 			case store.REPORT_IGNORED:
 				result = pb.LearnReportReply_IGNORED
@@ -254,15 +418,32 @@ func (self *HealthGServer) LearnReport(ctx context.Context, in *pb.LearnReportRe
 			case store.REPORT_ACCEPTED:
 				result = pb.LearnReportReply_ACCEPTED
 				du.LogD(stag, "accepted report %s from %s at %s", report.Subject, report.Observer, in.Source.Id)
-				self.exchange.Interested(in.Source.Id, report.Subject)
 				go self.AnalyzeReport(report, false)
+			case store.REPORT_DUPLICATE:
+				result = pb.LearnReportReply_DUPLICATE
 			}
 			return &pb.LearnReportReply{Result: result}, err
 		}
+	case pb.LearnReportRequest_INFERENCE:
+		{
+			if in.Inference == nil {
+				return &pb.LearnReportReply{Result: pb.LearnReportReply_FAILED}, fmt.Errorf("Empty inference")
+			}
+			if self.FilterSubmission {
+				if _, ok := self.storage.GetSubjects()[in.Inference.Subject]; !ok {
+					du.LogD(stag, "ignored inference about %s from %s", in.Inference.Subject, in.Source.Id)
+					return &pb.LearnReportReply{Result: pb.LearnReportReply_IGNORED}, nil
+				}
+			}
+			if !self.remote.AddInference(in.Source.Id, in.Inference) {
+				return &pb.LearnReportReply{Result: pb.LearnReportReply_DUPLICATE}, nil
+			}
+			return &pb.LearnReportReply{Result: pb.LearnReportReply_ACCEPTED}, nil
+		}
 	case pb.LearnReportRequest_SUBSCRIPTION:
 		{
-			du.LogI(stag, "got a subscription request about %s from %s at %s", report.Subject, report.Observer, in.Source.Id)
-			self.exchange.Interested(in.Source.Id, report.Subject)
+			du.LogD(stag, "got a subscription request about %s from %s at %s", report.Subject, report.Observer, in.Source.Id)
+			self.exchange.Interested(in.Source.Id, report.Subject, time.Duration(in.Lease)*time.Second)
 			return &pb.LearnReportReply{Result: pb.LearnReportReply_ACCEPTED}, nil
 		}
 	case pb.LearnReportRequest_UNSUBSCRIPTION:
@@ -271,11 +452,56 @@ func (self *HealthGServer) LearnReport(ctx context.Context, in *pb.LearnReportRe
 			self.exchange.Uninterested(in.Source.Id, report.Subject)
 			return &pb.LearnReportReply{Result: pb.LearnReportReply_ACCEPTED}, nil
 		}
+	case pb.LearnReportRequest_MEMBERSHIP:
+		{
+			if in.Member == nil || in.Member.Peer == nil {
+				return &pb.LearnReportReply{Result: pb.LearnReportReply_FAILED}, fmt.Errorf("Empty member")
+			}
+			du.LogI(stag, "got membership change of %s from %s", in.Member.Peer.Id, in.Source.Id)
+			if !self.learnMember(in.Member) {
+				return &pb.LearnReportReply{Result: pb.LearnReportReply_IGNORED}, nil
+			}
+			return &pb.LearnReportReply{Result: pb.LearnReportReply_ACCEPTED}, nil
+		}
+	case pb.LearnReportRequest_SILENCE:
+		{
+			if in.Silence == nil {
+				return &pb.LearnReportReply{Result: pb.LearnReportReply_FAILED}, fmt.Errorf("Empty silence")
+			}
+			du.LogI(stag, "got silence %s from %s", in.Silence.Id, in.Source.Id)
+			if !self.silencer.AddSilence(in.Silence) {
+				return &pb.LearnReportReply{Result: pb.LearnReportReply_IGNORED}, nil
+			}
+			go self.reinfer(in.Silence)
+			return &pb.LearnReportReply{Result: pb.LearnReportReply_ACCEPTED}, nil
+		}
 	}
 	return &pb.LearnReportReply{Result: pb.LearnReportReply_FAILED}, nil
 }
 
+func (self *HealthGServer) LearnReports(ctx context.Context, in *pb.LearnReportsRequest) (*pb.LearnReportsReply, error) {
+	if err := self.authenticate(ctx, in.Source); err != nil {
+		return nil, err
+	}
+	reply := &pb.LearnReportsReply{Replies: make([]*pb.LearnReportReply, len(in.Requests))}
+	for i, request := range in.Requests {
+		if request.Source == nil {
+			request.Source = in.Source
+		}
+		r, err := self.LearnReport(ctx, request)
+		if err != nil {
+			du.LogE(stag, "failed to learn report from %s: %s", in.Source.Id, err)
+			r = &pb.LearnReportReply{Result: pb.LearnReportReply_FAILED}
+		}
+		reply.Replies[i] = r
+	}
+	return reply, nil
+}
+
 func (self *HealthGServer) GetLatestReport(ctx context.Context, in *pb.GetReportRequest) (*pb.Report, error) {
+	if pctx, client := self.proxy(ctx, in.Subject); client != nil {
+		return client.GetLatestReport(pctx, in)
+	}
 	report := self.storage.GetLatestReport(in.Subject)
 	if report == nil {
 		return nil, fmt.Errorf("No report for %s", in.Subject)
@@ -284,6 +510,9 @@ func (self *HealthGServer) GetLatestReport(ctx context.Context, in *pb.GetReport
 }
 
 func (self *HealthGServer) GetPanorama(ctx context.Context, in *pb.GetPanoramaRequest) (*pb.Panorama, error) {
+	if pctx, client := self.proxy(ctx, in.Subject); client != nil {
+		return client.GetPanorama(pctx, in)
+	}
 	pano := self.storage.GetPanorama(in.Subject)
 	if pano == nil {
 		return nil, fmt.Errorf("No panorama for %s", in.Subject)
@@ -292,6 +521,9 @@ func (self *HealthGServer) GetPanorama(ctx context.Context, in *pb.GetPanoramaRe
 }
 
 func (self *HealthGServer) GetView(ctx context.Context, in *pb.GetViewRequest) (*pb.View, error) {
+	if pctx, client := self.proxy(ctx, in.Subject); client != nil {
+		return client.GetView(pctx, in)
+	}
 	view := self.storage.GetView(in.Subject, in.Observer)
 	if view == nil {
 		return nil, fmt.Errorf("No view for %s", in.Subject)
@@ -300,6 +532,9 @@ func (self *HealthGServer) GetView(ctx context.Context, in *pb.GetViewRequest) (
 }
 
 func (self *HealthGServer) GetInference(ctx context.Context, in *pb.GetInferenceRequest) (*pb.Inference, error) {
+	if pctx, client := self.proxy(ctx, in.Subject); client != nil {
+		return client.GetInference(pctx, in)
+	}
 	inference := self.inference.GetInference(in.Subject)
 	if inference == nil {
 		return nil, fmt.Errorf("inference does not exist for view")
@@ -307,6 +542,28 @@ func (self *HealthGServer) GetInference(ctx context.Context, in *pb.GetInference
 	return inference, nil
 }
 
+// Merge my inference of a subject with the ones shared by peers, taking the
+// verdict of each instance as the observation of one observer
+func (self *HealthGServer) GetMergedInference(ctx context.Context, in *pb.GetInferenceRequest) (*pb.MergedInferenceReply, error) {
+	local := self.inference.GetInference(in.Subject)
+	remote := self.remote.GetInferences(in.Subject)
+	pano := &pb.Panorama{Subject: in.Subject, Views: make(map[string]*pb.View)}
+	if local != nil {
+		pano.Views[self.Id] = &pb.View{Observer: self.Id, Subject: in.Subject, Observations: []*pb.Observation{local.Observation}}
+	}
+	for peer, inference := range remote {
+		pano.Views[peer] = &pb.View{Observer: peer, Subject: in.Subject, Observations: []*pb.Observation{inference.Observation}}
+	}
+	if len(pano.Views) == 0 {
+		return nil, fmt.Errorf("No inference of %s", in.Subject)
+	}
+	merged := self.inference.InferPanorama(pano)
+	if merged == nil {
+		return nil, fmt.Errorf("Could not merge inferences of %s", in.Subject)
+	}
+	return &pb.MergedInferenceReply{Inference: merged, Local: local, Remote: remote}, nil
+}
+
 func (self *HealthGServer) Observe(ctx context.Context, in *pb.ObserveRequest) (*pb.ObserveReply, error) {
 	ok := self.storage.AddSubject(in.Subject)
 	go self.exchange.Subscribe(in.Subject) // tell others I'd like to subscribe to subject
@@ -319,28 +576,62 @@ func (self *HealthGServer) StopObserving(ctx context.Context, in *pb.ObserveRequ
 	return &pb.ObserveReply{Success: ok}, nil
 }
 
-func (self *HealthGServer) GetObservedSubjects(ctx context.Context, in *pb.Empty) (*pb.GetObservedSubjectsReply, error) {
+func (self *HealthGServer) GetObservedSubjects(ctx context.Context, in *pb.GetObservedSubjectsRequest) (*pb.GetObservedSubjectsReply, error) {
+	selector, err := dt.ParseLabelSelector(in.Selector)
+	if err != nil {
+		return nil, err
+	}
 	watchList := self.storage.GetSubjects()
 	result := make(map[string]*tspb.Timestamp)
+	labels := make(map[string]*pb.Labels)
 	for subject, ts := range watchList {
+		sl := self.labeler.GetLabels(subject)
+		if !selector.Matches(sl) {
+			continue
+		}
 		pts, err := ptypes.TimestampProto(ts)
 		if err != nil {
 			return nil, err
 		}
 		result[subject] = pts
+		if len(sl) > 0 {
+			labels[subject] = &pb.Labels{Labels: sl}
+		}
 	}
-	return &pb.GetObservedSubjectsReply{Subjects: result}, nil
+	return &pb.GetObservedSubjectsReply{Subjects: result, Labels: labels}, nil
 }
 
 func (self *HealthGServer) DumpPanorama(ctx context.Context, in *pb.Empty) (*pb.DumpPanoramaReply, error) {
 	return &pb.DumpPanoramaReply{Panoramas: self.storage.DumpPanorama()}, nil
 }
 
-func (self *HealthGServer) DumpInference(ctx context.Context, in *pb.Empty) (*pb.DumpInferenceReply, error) {
-	return &pb.DumpInferenceReply{Inferences: self.inference.DumpInference()}, nil
+func (self *HealthGServer) DumpInference(ctx context.Context, in *pb.DumpInferenceRequest) (*pb.DumpInferenceReply, error) {
+	selector, err := dt.ParseLabelSelector(in.Selector)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DumpInferenceReply{Inferences: self.selectInference(selector)}, nil
+}
+
+// Inferences of the subjects whose labels match the selector
+func (self *HealthGServer) selectInference(selector dt.LabelSelector) map[string]*pb.Inference {
+	inferences := self.inference.DumpInference()
+	if selector.Empty() {
+		return inferences
+	}
+	result := make(map[string]*pb.Inference)
+	for subject, inference := range inferences {
+		if selector.Matches(self.labeler.GetLabels(subject)) {
+			result[subject] = inference
+		}
+	}
+	return result
 }
 
 func (self *HealthGServer) Ping(ctx context.Context, in *pb.PingRequest) (*pb.PingReply, error) {
+	if err := self.authenticate(ctx, in.Source); err != nil {
+		return nil, err
+	}
 	ts, err := ptypes.Timestamp(in.Time)
 	if err != nil {
 		return nil, err
@@ -354,6 +645,120 @@ func (self *HealthGServer) Ping(ctx context.Context, in *pb.PingRequest) (*pb.Pi
 	return &pb.PingReply{Result: pb.PingReply_GOOD, Time: pnow}, nil
 }
 
+func (self *HealthGServer) Silence(ctx context.Context, in *pb.SilenceRequest) (*pb.SilenceReply, error) {
+	silence := in.Silence
+	if silence == nil {
+		return nil, fmt.Errorf("Empty silence")
+	}
+	if len(silence.Id) == 0 {
+		silence.Id = fmt.Sprintf("%s-%d", self.Id, time.Now().UnixNano())
+	}
+	if silence.Start == nil {
+		silence.Start, _ = ptypes.TimestampProto(time.Now())
+	}
+	if len(silence.Creator) == 0 {
+		silence.Creator = self.Id
+	}
+	if !self.silencer.AddSilence(silence) {
+		return nil, fmt.Errorf("Invalid silence %s", silence.Id)
+	}
+	go self.reinfer(silence)
+	go self.exchange.PropagateSilence(silence)
+	return &pb.SilenceReply{Success: true, Id: silence.Id}, nil
+}
+
+func (self *HealthGServer) Unsilence(ctx context.Context, in *pb.UnsilenceRequest) (*pb.SilenceReply, error) {
+	silence := self.silencer.EndSilence(in.Id)
+	if silence == nil {
+		return nil, fmt.Errorf("No silence %s", in.Id)
+	}
+	go self.reinfer(silence)
+	go self.exchange.PropagateSilence(silence)
+	return &pb.SilenceReply{Success: true, Id: silence.Id}, nil
+}
+
+func (self *HealthGServer) ListSilences(ctx context.Context, in *pb.Empty) (*pb.ListSilencesReply, error) {
+	return &pb.ListSilencesReply{Silences: self.silencer.GetSilences()}, nil
+}
+
+func (self *HealthGServer) LabelSubject(ctx context.Context, in *pb.LabelSubjectRequest) (*pb.LabelSubjectReply, error) {
+	if len(in.Subject) == 0 {
+		return nil, fmt.Errorf("Empty subject")
+	}
+	labels := self.labeler.SetLabels(in.Subject, in.Labels, in.Remove, in.Replace)
+	return &pb.LabelSubjectReply{Labels: labels}, nil
+}
+
+func (self *HealthGServer) GetGroupInference(ctx context.Context, in *pb.GetGroupInferenceRequest) (*pb.GetGroupInferenceReply, error) {
+	selector, err := dt.ParseLabelSelector(in.Selector)
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string]map[string]*pb.Inference)
+	for subject, inference := range self.selectInference(selector) {
+		var value string
+		if len(in.GroupBy) > 0 {
+			var ok bool
+			value, ok = self.labeler.GetLabels(subject)[in.GroupBy]
+			if !ok {
+				// subjects without the label do not belong to any group
+				continue
+			}
+		}
+		members, ok := groups[value]
+		if !ok {
+			members = make(map[string]*pb.Inference)
+			groups[value] = members
+		}
+		members[subject] = inference
+	}
+	reply := &pb.GetGroupInferenceReply{}
+	for value, members := range groups {
+		group := decision.InferGroup(in.GroupBy, value, members, in.Severity)
+		if in.MinUnhealthy > 0 && group.UnhealthyRatio <= in.MinUnhealthy {
+			continue
+		}
+		reply.Groups = append(reply.Groups, group)
+	}
+	sort.Slice(reply.Groups, func(i, j int) bool {
+		if reply.Groups[i].UnhealthyRatio != reply.Groups[j].UnhealthyRatio {
+			return reply.Groups[i].UnhealthyRatio > reply.Groups[j].UnhealthyRatio
+		}
+		return reply.Groups[i].Value < reply.Groups[j].Value
+	})
+	return reply, nil
+}
+
+func (self *HealthGServer) GetPeerQueues(ctx context.Context, in *pb.Empty) (*pb.GetPeerQueuesReply, error) {
+	return &pb.GetPeerQueuesReply{Queues: self.exchange.GetQueues()}, nil
+}
+
+func (self *HealthGServer) GetIncidents(ctx context.Context, in *pb.GetIncidentsRequest) (*pb.GetIncidentsReply, error) {
+	if self.incidents == nil {
+		return &pb.GetIncidentsReply{}, nil
+	}
+	return &pb.GetIncidentsReply{Incidents: self.incidents.GetIncidents(in.Resolved)}, nil
+}
+
+func (self *HealthGServer) GetRootCause(ctx context.Context, in *pb.GetRootCauseRequest) (*pb.GetRootCauseReply, error) {
+	if len(in.Subject) == 0 {
+		return nil, fmt.Errorf("Empty subject")
+	}
+	causes := self.deps.RankRootCause(in.Subject, self.inference.DumpInference())
+	return &pb.GetRootCauseReply{Causes: causes}, nil
+}
+
+// Recompute the inference for subjects affected by a maintenance window
+func (self *HealthGServer) reinfer(silence *pb.Silence) {
+	if len(silence.Observer) == 0 {
+		self.inference.InferSubjectAsync(silence.Subject)
+		return
+	}
+	for subject := range self.storage.DumpPanorama() {
+		self.inference.InferSubjectAsync(subject)
+	}
+}
+
 func (self *HealthGServer) GC() {
 	for self.s != nil {
 		time.Sleep(gc_frequency)
@@ -370,6 +775,166 @@ func (self *HealthGServer) GC() {
 	}
 }
 
+// Repair the divergence from peers caused by lost or dropped reports. Pull
+// the missing observations from all peers on startup, then from a random
+// peer periodically.
+func (self *HealthGServer) AntiEntropy(stopc chan bool) {
+	interval := SYNC_INTERVAL
+	if self.ExchangeConfig.SyncInterval > 0 {
+		interval = time.Duration(self.ExchangeConfig.SyncInterval) * time.Second
+	}
+	for _, peer := range self.otherPeers() {
+		self.syncPeer(peer)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopc:
+			return
+		case <-ticker.C:
+			// the peers may have changed since the last round
+			if peers := self.otherPeers(); len(peers) > 0 {
+				self.syncPeer(peers[rand.Intn(len(peers))])
+			}
+		}
+	}
+}
+
+// Renew my subscriptions to the subjects I watch before the leases the peers
+// granted expire, and drop the leases of the peers that stopped renewing
+func (self *HealthGServer) RenewSubscriptions(stopc chan bool) {
+	interval := exchange.LEASE_DURATION
+	if self.ExchangeConfig.LeaseDuration > 0 {
+		interval = time.Duration(self.ExchangeConfig.LeaseDuration) * time.Second
+	}
+	interval /= 3 // a lost renewal is not fatal
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n := self.exchange.ExpireLeases(); n > 0 {
+			du.LogI(stag, "dropped %d expired leases", n)
+		}
+		for _, subject := range self.subscribed() {
+			self.exchange.Subscribe(subject)
+		}
+		select {
+		case <-stopc:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Subjects I subscribe to, all subjects unless submissions are filtered
+func (self *HealthGServer) subscribed() []string {
+	if !self.FilterSubmission {
+		return []string{exchange.ANY_SUBJECT}
+	}
+	var subjects []string
+	for subject := range self.storage.GetSubjects() {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+	return subjects
+}
+
+func (self *HealthGServer) GetSubscriptions(ctx context.Context, in *pb.Empty) (*pb.GetSubscriptionsReply, error) {
+	return &pb.GetSubscriptionsReply{Leases: self.exchange.GetLeases(), Subscribed: self.subscribed()}, nil
+}
+
+// Ids of the current peers except myself
+func (self *HealthGServer) otherPeers() []string {
+	var peers []string
+	for id := range self.exchange.GetPeers() {
+		if id != self.Id {
+			peers = append(peers, id)
+		}
+	}
+	return peers
+}
+
+// Pull the observations missing from my view from a peer
+func (self *HealthGServer) syncPeer(peer string) {
+	request := &pb.SyncRequest{Source: &pb.Peer{Id: self.Id, Addr: self.Addr}}
+	var subjects []string
+	filter := self.FilterSubmission
+	if self.exchange.Sharded() {
+		request.Owned = true
+		filter = false
+	} else if self.FilterSubmission {
+		for subject := range self.storage.GetSubjects() {
+			subjects = append(subjects, subject)
+		}
+		if len(subjects) == 0 {
+			return
+		}
+		request.Subjects = subjects
+	} else {
+		request.All = true
+	}
+	learned := 0
+	request.Digest = self.storage.GetDigest(subjects)
+	for round := 0; round < SYNC_MAX_ROUNDS; round++ {
+		reply, err := self.exchange.Sync(peer, request)
+		if err != nil {
+			du.LogE(stag, "fail to sync with %s: %s", peer, err)
+			break
+		}
+		// the filtered reports are not stored, but asking for them again
+		// would keep the next round from getting the rest
+		request.Digest = advanceDigest(request.Digest, reply.Reports)
+		updated := make(map[string]bool)
+		for _, report := range reply.Reports {
+			rc, err := self.storage.AddReport(report, filter)
+			if err == nil && rc == store.REPORT_ACCEPTED {
+				updated[report.Subject] = true
+				learned++
+			}
+		}
+		for subject := range updated {
+			self.inference.InferSubjectAsync(subject)
+		}
+		if !reply.Truncated {
+			break
+		}
+	}
+	if learned > 0 {
+		du.LogI(stag, "learned %d missing observations from %s", learned, peer)
+	} else {
+		du.LogD(stag, "in sync with %s", peer)
+	}
+}
+
+// Move a digest forward over the reports returned by a peer
+func advanceDigest(digest []*pb.DigestEntry, reports []*pb.Report) []*pb.DigestEntry {
+	type viewKey struct {
+		subject  string
+		observer string
+	}
+	entries := make(map[viewKey]*pb.DigestEntry)
+	for _, entry := range digest {
+		entries[viewKey{entry.Subject, entry.Observer}] = entry
+	}
+	for _, report := range reports {
+		ts := report.Observation.GetTs()
+		if ts == nil {
+			continue
+		}
+		key := viewKey{report.Subject, report.Observer}
+		entry, ok := entries[key]
+		if !ok {
+			entry = &pb.DigestEntry{Subject: report.Subject, Observer: report.Observer}
+			entries[key] = entry
+			digest = append(digest, entry)
+		}
+		if entry.Latest == nil || dt.CompareTimestamp(ts, entry.Latest) > 0 {
+			entry.Latest = ts
+		}
+	}
+	return digest
+}
+
 func (self *HealthGServer) AnalyzeReport(report *pb.Report, check_hold bool) {
 	if check_hold {
 		items := self.hold_buffer.Get(report.Subject)
@@ -392,14 +957,179 @@ func (self *HealthGServer) AnalyzeReport(report *pb.Report, check_hold bool) {
 	self.inference.InferReportAsync(report)
 }
 
+func (self *HealthGServer) Sync(ctx context.Context, in *pb.SyncRequest) (*pb.SyncReply, error) {
+	if err := self.authenticate(ctx, in.Source); err != nil {
+		return nil, err
+	}
+	if in.Owned && in.Source != nil {
+		in.Subjects = self.ownedBy(in.Source.Id)
+	}
+	if !in.All && len(in.Subjects) == 0 {
+		return &pb.SyncReply{}, nil
+	}
+	max := SYNC_MAX_REPORTS
+	if self.ExchangeConfig.SyncMaxReports > 0 {
+		max = self.ExchangeConfig.SyncMaxReports
+	}
+	reports, truncated := self.storage.GetMissing(in.Digest, in.Subjects, max)
+	if in.Source != nil {
+		// the peer subscribes to the new reports on its own
+		du.LogD(stag, "sent %d missing observations to %s", len(reports), in.Source.Id)
+	}
+	return &pb.SyncReply{Reports: reports, Truncated: truncated}, nil
+}
+
+// Subjects I have observations about that are owned by a peer
+func (self *HealthGServer) ownedBy(peer string) []string {
+	var subjects []string
+	checked := make(map[string]bool)
+	for _, entry := range self.storage.GetDigest(nil) {
+		if checked[entry.Subject] {
+			continue
+		}
+		checked[entry.Subject] = true
+		for _, owner := range self.exchange.Owners(entry.Subject) {
+			if owner == peer {
+				subjects = append(subjects, entry.Subject)
+				break
+			}
+		}
+	}
+	return subjects
+}
+
+func (self *HealthGServer) GetOwners(ctx context.Context, in *pb.GetOwnersRequest) (*pb.GetOwnersReply, error) {
+	if !self.exchange.Sharded() {
+		return nil, fmt.Errorf("Not in sharded mode")
+	}
+	peers := self.exchange.GetPeers()
+	reply := &pb.GetOwnersReply{}
+	for _, owner := range self.exchange.Owners(in.Subject) {
+		reply.Owners = append(reply.Owners, &pb.Peer{Id: owner, Addr: peers[owner]})
+	}
+	return reply, nil
+}
+
+// In sharded mode, get a client to an owner of the subject to proxy a query
+// to, nil if I own it or the query is already proxied by another instance
+func (self *HealthGServer) proxy(ctx context.Context, subject string) (context.Context, pb.HealthServiceClient) {
+	if !self.exchange.Sharded() {
+		return ctx, nil
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md[PROXIED_KEY]) > 0 {
+		return ctx, nil // the owners may disagree while membership changes, don't bounce
+	}
+	owner, client, err := self.exchange.OwnerClient(subject)
+	if err != nil {
+		du.LogE(stag, "fail to proxy query about %s, answer locally: %s", subject, err)
+		return ctx, nil
+	}
+	if client != nil {
+		du.LogD(stag, "proxy query about %s to owner %s", subject, owner)
+		ctx = metadata.AppendToOutgoingContext(ctx, PROXIED_KEY, self.Id)
+	}
+	return ctx, client
+}
+
 func (self *HealthGServer) GetPeers(ctx context.Context, in *pb.Empty) (*pb.GetPeerReply, error) {
-	peers := make([]*pb.Peer, 0, len(self.Peers))
-	for id, addr := range self.Peers {
+	current := self.exchange.GetPeers()
+	peers := make([]*pb.Peer, 0, len(current))
+	for id, addr := range current {
 		peers = append(peers, &pb.Peer{Id: id, Addr: addr})
 	}
 	return &pb.GetPeerReply{Peers: peers}, nil
 }
 
+// Apply a membership change and keep it, return whether it is applied
+func (self *HealthGServer) learnMember(member *pb.Member) bool {
+	if !self.exchange.UpdateMember(member) {
+		return false
+	}
+	if member.Removed {
+		self.remote.RemovePeer(member.Peer.Id)
+	}
+	if self.db != nil {
+		self.db.InsertMember(member)
+	}
+	return true
+}
+
+// Make a membership change and spread it across the cluster
+func (self *HealthGServer) changeMember(peer *pb.Peer, removed bool) error {
+	if len(peer.Id) == 0 || (!removed && len(peer.Addr) == 0) {
+		return fmt.Errorf("Peer id and address are required")
+	}
+	if removed && peer.Id == self.Id {
+		return fmt.Errorf("Cannot remove myself")
+	}
+	member := &pb.Member{Peer: peer, Removed: removed, Time: ptypes.TimestampNow()}
+	if !self.learnMember(member) {
+		return fmt.Errorf("A newer membership change of %s exists", peer.Id)
+	}
+	go self.exchange.PropagateMember(member)
+	return nil
+}
+
+func (self *HealthGServer) AddPeer(ctx context.Context, in *pb.Peer) (*pb.MembershipReply, error) {
+	if err := self.changeMember(in, false); err != nil {
+		return nil, err
+	}
+	du.LogI(stag, "added peer %s at %s", in.Id, in.Addr)
+	return &pb.MembershipReply{Members: self.exchange.GetMembers(false)}, nil
+}
+
+func (self *HealthGServer) RemovePeer(ctx context.Context, in *pb.Peer) (*pb.MembershipReply, error) {
+	if err := self.changeMember(in, true); err != nil {
+		return nil, err
+	}
+	du.LogI(stag, "removed peer %s", in.Id)
+	return &pb.MembershipReply{Members: self.exchange.GetMembers(false)}, nil
+}
+
+func (self *HealthGServer) Join(ctx context.Context, in *pb.Peer) (*pb.MembershipReply, error) {
+	if err := self.authenticate(ctx, in); err != nil {
+		return nil, err
+	}
+	if err := self.changeMember(in, false); err != nil {
+		return nil, err
+	}
+	du.LogI(stag, "%s at %s joined through me", in.Id, in.Addr)
+	// the removed ones too, so that the new peer does not bring them back
+	return &pb.MembershipReply{Members: self.exchange.GetMembers(true)}, nil
+}
+
+func (self *HealthGServer) GetPeerStatus(ctx context.Context, in *pb.Empty) (*pb.GetPeerStatusReply, error) {
+	return &pb.GetPeerStatusReply{Peers: self.exchange.GetPeerStatus()}, nil
+}
+
+// Share my inferences with the peers
+func (self *HealthGServer) OnInference(inf *pb.Inference) {
+	self.exchange.PropagateInference(inf)
+}
+
+// How my view of the liveness of a peer is recorded as an observation
+var peerStateValues = map[pb.PeerStatus_State]*pb.Value{
+	pb.PeerStatus_ALIVE:     &pb.Value{Status: pb.Status_HEALTHY, Score: 100},
+	pb.PeerStatus_SUSPECTED: &pb.Value{Status: pb.Status_MAYBE_UNHEALTHY, Score: 50},
+	pb.PeerStatus_DEAD:      &pb.Value{Status: pb.Status_DEAD, Score: 0},
+}
+
+// Panorama watches itself: the liveness of the peers is stored as my
+// observations about them, like the ones submitted by other observers.
+func (self *HealthGServer) OnPeerStatus(status *pb.PeerStatus) {
+	value, ok := peerStateValues[status.State]
+	if !ok {
+		return
+	}
+	metrics := map[string]*pb.Value{"liveness": &pb.Value{Status: value.Status, Score: value.Score}}
+	report := dt.NewReport(self.Id, status.Peer.Id, metrics)
+	self.storage.AddSubject(status.Peer.Id)
+	rc, err := self.storage.AddReport(report, false)
+	if err == nil && rc == store.REPORT_ACCEPTED {
+		self.AnalyzeReport(report, false)
+	}
+}
+
 func (self *HealthGServer) GetId(ctx context.Context, in *pb.Empty) (*pb.Peer, error) {
 	return &pb.Peer{Id: self.Id, Addr: self.Addr}, nil
 }
@@ -14,6 +14,7 @@ import (
 	"google.golang.org/grpc"
 
 	pb "panorama/build/gen"
+	"panorama/exchange"
 	dt "panorama/types"
 	du "panorama/util"
 )
@@ -47,6 +48,39 @@ func TestSubmitReport(t *testing.T) {
 	fmt.Println("Submitted report")
 }
 
+func TestLearnReportOrigin(t *testing.T) {
+	metrics := map[string]*pb.Value{"cpu": &pb.Value{Status: pb.Status_UNHEALTHY, Score: 30}}
+	request := &pb.LearnReportRequest{
+		Source: &pb.Peer{Id: "XFE_8"},
+		Origin: &pb.Peer{Id: "XFE_9"},
+		Report: dt.NewReport("XFE_9", "TS_4", metrics),
+		Id:     "XFE_9-1",
+		Hops:   1,
+	}
+	reply, err := client.LearnReport(context.Background(), request)
+	if err != nil || reply.Result != pb.LearnReportReply_ACCEPTED {
+		t.Fatalf("Fail to learn report: %v %v", reply, err)
+	}
+	pano, err := client.GetPanorama(context.Background(), &pb.GetPanoramaRequest{Subject: "TS_4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	view := pano.Views["XFE_9"]
+	if origin := view.Observations[len(view.Observations)-1].Origin; origin != "XFE_9" {
+		t.Errorf("expecting the report to originate from XFE_9, got %s", origin)
+	}
+	reply, err = client.LearnReport(context.Background(), request)
+	if err != nil || reply.Result != pb.LearnReportReply_DUPLICATE {
+		t.Errorf("expecting the second copy of the report to be a duplicate, got %v %v", reply, err)
+	}
+	request.Id = "XFE_9-2"
+	request.Hops = exchange.MAX_HOPS + 1
+	reply, err = client.LearnReport(context.Background(), request)
+	if err != nil || reply.Result != pb.LearnReportReply_DUPLICATE {
+		t.Errorf("expecting a report relayed too many times to be dropped, got %v %v", reply, err)
+	}
+}
+
 func BenchmarkSubmitReportAsync(b *testing.B) {
 	metrics := map[string]*pb.Value{
 		"cpu":     &pb.Value{Status: pb.Status_UNHEALTHY, Score: 30},
@@ -176,6 +210,21 @@ func BenchmarkPropagate(b *testing.B) {
 	}
 }
 
+func TestAdvanceDigest(t *testing.T) {
+	r1 := dt.NewReport("FE_1", "TS_1", map[string]*pb.Value{"cpu": &pb.Value{Status: pb.Status_HEALTHY, Score: 100}})
+	time.Sleep(time.Millisecond)
+	r2 := dt.NewReport("FE_1", "TS_1", map[string]*pb.Value{"cpu": &pb.Value{Status: pb.Status_HEALTHY, Score: 90}})
+	r3 := dt.NewReport("FE_2", "TS_2", map[string]*pb.Value{"cpu": &pb.Value{Status: pb.Status_HEALTHY, Score: 80}})
+	digest := []*pb.DigestEntry{&pb.DigestEntry{Subject: "TS_1", Observer: "FE_1", Latest: r1.Observation.Ts}}
+	digest = advanceDigest(digest, []*pb.Report{r2, r1, r3})
+	if len(digest) != 2 {
+		t.Fatalf("expecting 2 digest entries, got %v", digest)
+	}
+	if digest[0].Latest != r2.Observation.Ts || digest[1].Latest != r3.Observation.Ts {
+		t.Errorf("expecting the digest to move to the latest returned reports, got %v", digest)
+	}
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 
@@ -223,7 +272,7 @@ func TestMain(m *testing.M) {
 	}
 	defer conn.Close()
 	client = pb.NewHealthServiceClient(conn)
-	reply, err := client.Register(context.Background(), &pb.RegisterRequest{Module: "DeepHealth", Observer: "self"})
+	reply, err := client.Register(context.Background(), &pb.RegisterRequest{Module: "DeepHealth", Observer: "XFE_2"})
 	if err != nil {
 		panic(fmt.Sprintf("Fail to register with the health service: %v", err))
 	}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "panorama/build/gen"
+	dc "panorama/client"
+	dt "panorama/types"
+)
+
+// Write a certificate issued to a name, self-signed if there is no parent,
+// and its key in PEM to dir
+func writeCert(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name, "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "panorama")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	port := portstart + int(r.Intn(portend-portstart-1))
+	peers := map[string]string{
+		"DHS_1": fmt.Sprintf("localhost:%d", port),
+		"DHS_2": fmt.Sprintf("localhost:%d", port+1),
+	}
+	servers := make(map[string]*HealthGServer)
+	for _, id := range []string{"DHS_2", "DHS_1"} {
+		writeCert(t, dir, id, ca, caKey)
+		gs := NewHealthGServer(&dt.HealthServerConfig{
+			Addr:           peers[id],
+			Id:             id,
+			Peers:          peers,
+			DBFile:         filepath.Join(dir, id+".db"),
+			ExchangeConfig: dt.ExchangeConfig{SyncInterval: -1, Heartbeat: -1},
+			TLSConfig: dt.TLSConfig{
+				CertFile: filepath.Join(dir, id+".crt"),
+				KeyFile:  filepath.Join(dir, id+".key"),
+				CAFile:   filepath.Join(dir, "ca.crt"),
+				Mutual:   true,
+			},
+		})
+		if err := gs.Start(nil); err != nil {
+			t.Fatal(err)
+		}
+		defer gs.Stop(false)
+		servers[id] = gs
+	}
+	if _, err := servers["DHS_1"].exchange.Ping("DHS_2"); err != nil {
+		t.Fatalf("expecting DHS_1 to reach DHS_2 with its certificate, got %v", err)
+	}
+
+	// someone holding the certificate of DHS_1
+	creds, err := dc.ClientTLS(filepath.Join(dir, "DHS_1.crt"), filepath.Join(dir, "DHS_1.key"), filepath.Join(dir, "ca.crt"), "DHS_2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := dc.NewConnManager(grpc.WithTransportCredentials(creds))
+	defer conns.Close()
+	client, err := conns.Get("DHS_2", peers["DHS_2"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := &pb.LearnReportRequest{
+		Kind:   pb.LearnReportRequest_SUBSCRIPTION,
+		Source: &pb.Peer{Id: "DHS_1"},
+		Report: &pb.Report{Observer: "DHS_1", Subject: "TS_1"},
+	}
+	if _, err := client.LearnReport(context.Background(), request); err != nil {
+		t.Errorf("expecting DHS_1 to be accepted as itself, got %v", err)
+	}
+	request.Source = &pb.Peer{Id: "DHS_3"}
+	if _, err := client.LearnReport(context.Background(), request); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expecting DHS_1 to be rejected as DHS_3, got %v", err)
+	}
+	_, err = client.LearnReports(context.Background(), &pb.LearnReportsRequest{Source: &pb.Peer{Id: "DHS_3"},
+		Requests: []*pb.LearnReportRequest{request}})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expecting a batch from DHS_1 as DHS_3 to be rejected, got %v", err)
+	}
+
+	// without a certificate
+	creds, _ = dc.ClientTLS("", "", filepath.Join(dir, "ca.crt"), "")
+	anonymous := dc.NewConnManager(grpc.WithTransportCredentials(creds))
+	anonymous.DialTimeout = time.Second
+	defer anonymous.Close()
+	if client, err = anonymous.Get("DHS_2", peers["DHS_2"]); err == nil {
+		_, err = client.Ping(context.Background(), &pb.PingRequest{Source: &pb.Peer{Id: "DHS_1"}})
+	}
+	if err == nil {
+		t.Error("expecting a client without a certificate to be rejected")
+	}
+}
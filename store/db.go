@@ -7,6 +7,8 @@ import (
 	"time"
 
 	"database/sql"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	_ "github.com/mattn/go-sqlite3"
 
 	pb "panorama/build/gen"
@@ -18,13 +20,26 @@ const (
 	sdtag       = "db"
 	DB_FILE     = "deephealth.db"
 	CREATE_STMT = `
-		CREATE TABLE IF NOT EXISTS panorama (id INTEGER PRIMARY KEY, subject TEXT, observer TEXT, time TIMESTAMP, metrics TEXT);
+		CREATE TABLE IF NOT EXISTS panorama (id INTEGER PRIMARY KEY, subject TEXT, observer TEXT, time TIMESTAMP, metrics TEXT, origin TEXT);
 		CREATE TABLE IF NOT EXISTS inference (id INTEGER PRIMARY KEY, subject TEXT, observers TEXT, time TIMESTAMP, metrics TEXT);
-		CREATE TABLE IF NOT EXISTS registration (id INTEGER PRIMARY KEY, handle INTEGER, module TEXT, observer TEXT, time TIMESTAMP);
+		CREATE TABLE IF NOT EXISTS registration (id INTEGER PRIMARY KEY, handle INTEGER, module TEXT, observer TEXT, time TIMESTAMP, info BLOB);
+		CREATE TABLE IF NOT EXISTS silence (id TEXT PRIMARY KEY, subject TEXT, observer TEXT, start_time TIMESTAMP, end_time TIMESTAMP, mode INTEGER, reason TEXT, creator TEXT);
+		CREATE TABLE IF NOT EXISTS label (subject TEXT, name TEXT, value TEXT, PRIMARY KEY (subject, name));
+		CREATE TABLE IF NOT EXISTS member (id TEXT PRIMARY KEY, addr TEXT, removed INTEGER, time TIMESTAMP);
+		CREATE TABLE IF NOT EXISTS lease (subject TEXT, peer TEXT, expires TIMESTAMP, PRIMARY KEY (subject, peer));
 	`
-	PANO_INSERT_STMT     = "INSERT INTO panorama(subject, observer, time, metrics) VALUES(?,?,?,?)"
+	PANO_ORIGIN_STMT     = "ALTER TABLE panorama ADD COLUMN origin TEXT"
+	REGISTER_INFO_STMT   = "ALTER TABLE registration ADD COLUMN info BLOB"
+	PANO_INSERT_STMT     = "INSERT INTO panorama(subject, observer, time, metrics, origin) VALUES(?,?,?,?,?)"
 	INFER_INSERT_STMT    = "INSERT INTO inference(subject, observers, time, metrics) VALUES(?,?,?,?)"
-	REGISTER_INSERT_STMT = "INSERT INTO registration(handle, module, observer, time) VALUES(?,?,?,?)"
+	REGISTER_INSERT_STMT = "INSERT INTO registration(handle, module, observer, time, info) VALUES(?,?,?,?,?)"
+	REGISTER_DELETE_STMT = "DELETE FROM registration WHERE handle = ?"
+	SILENCE_INSERT_STMT  = "INSERT OR REPLACE INTO silence(id, subject, observer, start_time, end_time, mode, reason, creator) VALUES(?,?,?,?,?,?,?,?)"
+	LABEL_DELETE_STMT    = "DELETE FROM label WHERE subject = ?"
+	LABEL_INSERT_STMT    = "INSERT INTO label(subject, name, value) VALUES(?,?,?)"
+	MEMBER_INSERT_STMT   = "INSERT OR REPLACE INTO member(id, addr, removed, time) VALUES(?,?,?,?)"
+	LEASE_INSERT_STMT    = "INSERT OR REPLACE INTO lease(subject, peer, expires) VALUES(?,?,?)"
+	LEASE_DELETE_STMT    = "DELETE FROM lease WHERE subject = ? AND peer = ?"
 )
 
 type HealthDBStorage struct {
@@ -34,17 +49,26 @@ type HealthDBStorage struct {
 	insertReportStmt   *sql.Stmt
 	insertInferStmt    *sql.Stmt
 	insertRegisterStmt *sql.Stmt
+	insertSilenceStmt  *sql.Stmt
 	reportMu           *sync.Mutex
 	inferMu            *sync.Mutex
 	regMu              *sync.Mutex
+	silenceMu          *sync.Mutex
+	labelMu            *sync.Mutex
+	memberMu           *sync.Mutex
+	leaseMu            *sync.Mutex
 }
 
 func NewHealthDBStorage(file string) *HealthDBStorage {
 	storage := &HealthDBStorage{
-		File:     file,
-		reportMu: &sync.Mutex{},
-		inferMu:  &sync.Mutex{},
-		regMu:    &sync.Mutex{},
+		File:      file,
+		reportMu:  &sync.Mutex{},
+		inferMu:   &sync.Mutex{},
+		regMu:     &sync.Mutex{},
+		silenceMu: &sync.Mutex{},
+		labelMu:   &sync.Mutex{},
+		memberMu:  &sync.Mutex{},
+		leaseMu:   &sync.Mutex{},
 	}
 	return storage
 }
@@ -71,9 +95,14 @@ func (self *HealthDBStorage) Open() (*sql.DB, error) {
 		db.Close()
 		return nil, err
 	}
+	// databases created before the origin was recorded lack the column,
+	// the statement fails harmlessly on the others
+	db.Exec(PANO_ORIGIN_STMT)
+	db.Exec(REGISTER_INFO_STMT) // likewise for the info of the observers
 	self.insertReportStmt, _ = db.Prepare(PANO_INSERT_STMT)
 	self.insertInferStmt, _ = db.Prepare(INFER_INSERT_STMT)
 	self.insertRegisterStmt, _ = db.Prepare(REGISTER_INSERT_STMT)
+	self.insertSilenceStmt, _ = db.Prepare(SILENCE_INSERT_STMT)
 	du.LogI(sdtag, "Database %s opened.", self.File)
 	self.DB = db
 	return db, nil
@@ -89,7 +118,7 @@ func (self *HealthDBStorage) InsertReport(report *pb.Report) error {
 	ts := report.Observation.Ts
 	lts := time.Unix(ts.Seconds, int64(ts.Nanos)).UTC()
 	_, err := self.insertReportStmt.Exec(report.Subject, report.Observer, lts,
-		dt.MetricsString(report.Observation.Metrics))
+		dt.MetricsString(report.Observation.Metrics), report.Observation.Origin)
 	if err != nil {
 		du.LogE(sdtag, "Fail to insert report from %s to %s: %s", report.Observer, report.Subject, err)
 	} else {
@@ -124,7 +153,11 @@ func (self *HealthDBStorage) InsertRegistration(reg *dt.Registration) error {
 	self.regMu.Lock()
 	defer self.regMu.Unlock()
 	du.LogI(sdtag, "Inserting registration %v", reg)
-	_, err := self.insertRegisterStmt.Exec(reg.Handle, reg.Module, reg.Observer, reg.Time)
+	var info []byte
+	if reg.Info != nil {
+		info, _ = proto.Marshal(reg.Info)
+	}
+	_, err := self.insertRegisterStmt.Exec(reg.Handle, reg.Module, reg.Observer, reg.Time, info)
 	if err != nil {
 		du.LogE(sdtag, "Fail to insert registration from %s: %s", reg.Observer, err)
 	} else {
@@ -138,7 +171,7 @@ func (self *HealthDBStorage) ReadRegistrations() (map[uint64]*dt.Registration, u
 		return nil, 0
 	}
 	du.LogI(sdtag, "Reading previous registrations...")
-	rows, err := self.DB.Query("SELECT handle, module, observer, time FROM registration")
+	rows, err := self.DB.Query("SELECT handle, module, observer, time, info FROM registration ORDER BY id")
 	if err != nil {
 		du.LogE(sdtag, "Fail to read registrations %s", err)
 		return nil, 0
@@ -151,19 +184,24 @@ func (self *HealthDBStorage) ReadRegistrations() (map[uint64]*dt.Registration, u
 		var module string
 		var observer string
 		var ts time.Time
-		err = rows.Scan(&handle, &module, &observer, &ts)
+		var info []byte
+		err = rows.Scan(&handle, &module, &observer, &ts, &info)
 		if err == nil {
+			newreg := &dt.Registration{ObserverModule: dt.ObserverModule{Module: module, Observer: observer}, Handle: handle, Time: ts}
+			if len(info) > 0 {
+				newreg.Info = new(pb.ObserverInfo)
+				if proto.Unmarshal(info, newreg.Info) != nil {
+					newreg.Info = nil
+				}
+			}
 			reg, ok := registrations[handle]
 			if ok {
-				if reg.Time.Before(ts) {
-					observer := dt.ObserverModule{Module: module, Observer: observer}
-					newreg := &dt.Registration{ObserverModule: observer, Handle: handle, Time: ts}
+				// a later row updates the info of the observer
+				if !ts.Before(reg.Time) {
 					du.LogI(sdtag, "Overwrite an existing registration %v with %v", reg, newreg)
 					registrations[handle] = newreg
 				}
 			} else {
-				observer := dt.ObserverModule{Module: module, Observer: observer}
-				newreg := &dt.Registration{ObserverModule: observer, Handle: handle, Time: ts}
 				registrations[handle] = newreg
 				du.LogI(sdtag, "Read an existing registration %v", newreg)
 			}
@@ -178,6 +216,225 @@ func (self *HealthDBStorage) ReadRegistrations() (map[uint64]*dt.Registration, u
 	return registrations, max_handle
 }
 
+func (self *HealthDBStorage) DeleteRegistration(handle uint64) error {
+	if self.DB == nil {
+		return nil
+	}
+	self.regMu.Lock()
+	defer self.regMu.Unlock()
+	_, err := self.DB.Exec(REGISTER_DELETE_STMT, handle)
+	if err != nil {
+		du.LogE(sdtag, "Fail to delete registration of handle %d: %s", handle, err)
+	}
+	return err
+}
+
+func (self *HealthDBStorage) InsertSilence(silence *pb.Silence) error {
+	if self.DB == nil {
+		return nil
+	}
+	self.silenceMu.Lock()
+	defer self.silenceMu.Unlock()
+	start := time.Unix(silence.Start.Seconds, int64(silence.Start.Nanos)).UTC()
+	end := time.Unix(silence.End.Seconds, int64(silence.End.Nanos)).UTC()
+	_, err := self.insertSilenceStmt.Exec(silence.Id, silence.Subject, silence.Observer, start, end,
+		int32(silence.Mode), silence.Reason, silence.Creator)
+	if err != nil {
+		du.LogE(sdtag, "Fail to insert silence %s: %s", silence.Id, err)
+	} else {
+		du.LogD(sdtag, "Inserted silence %s", silence.Id)
+	}
+	return err
+}
+
+func (self *HealthDBStorage) ReadSilences() map[string]*pb.Silence {
+	if self.DB == nil {
+		return nil
+	}
+	rows, err := self.DB.Query("SELECT id, subject, observer, start_time, end_time, mode, reason, creator FROM silence")
+	if err != nil {
+		du.LogE(sdtag, "Fail to read silences %s", err)
+		return nil
+	}
+	defer rows.Close()
+	silences := make(map[string]*pb.Silence)
+	for rows.Next() {
+		var silence pb.Silence
+		var start, end time.Time
+		var mode int32
+		err = rows.Scan(&silence.Id, &silence.Subject, &silence.Observer, &start, &end, &mode,
+			&silence.Reason, &silence.Creator)
+		if err != nil {
+			du.LogE(sdtag, "Failed to read silence: %s", err)
+			continue
+		}
+		silence.Mode = pb.Silence_Mode(mode)
+		silence.Start, _ = ptypes.TimestampProto(start)
+		silence.End, _ = ptypes.TimestampProto(end)
+		silences[silence.Id] = &silence
+	}
+	return silences
+}
+
+func (self *HealthDBStorage) InsertLabels(subject string, labels map[string]string) error {
+	if self.DB == nil {
+		return nil
+	}
+	self.labelMu.Lock()
+	defer self.labelMu.Unlock()
+	tx, err := self.DB.Begin()
+	if err != nil {
+		du.LogE(sdtag, "Fail to begin transaction for labels of %s: %s", subject, err)
+		return err
+	}
+	_, err = tx.Exec(LABEL_DELETE_STMT, subject)
+	for name, value := range labels {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(LABEL_INSERT_STMT, subject, name, value)
+	}
+	if err != nil {
+		tx.Rollback()
+		du.LogE(sdtag, "Fail to insert labels of %s: %s", subject, err)
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		du.LogE(sdtag, "Fail to commit labels of %s: %s", subject, err)
+	} else {
+		du.LogD(sdtag, "Inserted labels of %s", subject)
+	}
+	return err
+}
+
+func (self *HealthDBStorage) ReadLabels() map[string]map[string]string {
+	if self.DB == nil {
+		return nil
+	}
+	rows, err := self.DB.Query("SELECT subject, name, value FROM label")
+	if err != nil {
+		du.LogE(sdtag, "Fail to read labels %s", err)
+		return nil
+	}
+	defer rows.Close()
+	labels := make(map[string]map[string]string)
+	for rows.Next() {
+		var subject, name, value string
+		err = rows.Scan(&subject, &name, &value)
+		if err != nil {
+			du.LogE(sdtag, "Failed to read label: %s", err)
+			continue
+		}
+		sl, ok := labels[subject]
+		if !ok {
+			sl = make(map[string]string)
+			labels[subject] = sl
+		}
+		sl[name] = value
+	}
+	return labels
+}
+
+func (self *HealthDBStorage) InsertMember(member *pb.Member) error {
+	if self.DB == nil {
+		return nil
+	}
+	self.memberMu.Lock()
+	defer self.memberMu.Unlock()
+	ts := time.Unix(member.Time.Seconds, int64(member.Time.Nanos)).UTC()
+	_, err := self.DB.Exec(MEMBER_INSERT_STMT, member.Peer.Id, member.Peer.Addr, member.Removed, ts)
+	if err != nil {
+		du.LogE(sdtag, "Fail to insert member %s: %s", member.Peer.Id, err)
+	} else {
+		du.LogD(sdtag, "Inserted member %s", member.Peer.Id)
+	}
+	return err
+}
+
+func (self *HealthDBStorage) ReadMembers() map[string]*pb.Member {
+	if self.DB == nil {
+		return nil
+	}
+	rows, err := self.DB.Query("SELECT id, addr, removed, time FROM member")
+	if err != nil {
+		du.LogE(sdtag, "Fail to read members %s", err)
+		return nil
+	}
+	defer rows.Close()
+	members := make(map[string]*pb.Member)
+	for rows.Next() {
+		var peer pb.Peer
+		var removed bool
+		var ts time.Time
+		err = rows.Scan(&peer.Id, &peer.Addr, &removed, &ts)
+		if err != nil {
+			du.LogE(sdtag, "Failed to read member: %s", err)
+			continue
+		}
+		member := &pb.Member{Peer: &peer, Removed: removed}
+		member.Time, _ = ptypes.TimestampProto(ts)
+		members[peer.Id] = member
+	}
+	return members
+}
+
+func (self *HealthDBStorage) InsertLease(lease *pb.Lease) error {
+	if self.DB == nil {
+		return nil
+	}
+	self.leaseMu.Lock()
+	defer self.leaseMu.Unlock()
+	ts := time.Unix(lease.Expires.Seconds, int64(lease.Expires.Nanos)).UTC()
+	_, err := self.DB.Exec(LEASE_INSERT_STMT, lease.Subject, lease.Peer, ts)
+	if err != nil {
+		du.LogE(sdtag, "Fail to insert lease of %s on %s: %s", lease.Peer, lease.Subject, err)
+	} else {
+		du.LogD(sdtag, "Inserted lease of %s on %s", lease.Peer, lease.Subject)
+	}
+	return err
+}
+
+func (self *HealthDBStorage) DeleteLease(subject string, peer string) error {
+	if self.DB == nil {
+		return nil
+	}
+	self.leaseMu.Lock()
+	defer self.leaseMu.Unlock()
+	_, err := self.DB.Exec(LEASE_DELETE_STMT, subject, peer)
+	if err != nil {
+		du.LogE(sdtag, "Fail to delete lease of %s on %s: %s", peer, subject, err)
+	} else {
+		du.LogD(sdtag, "Deleted lease of %s on %s", peer, subject)
+	}
+	return err
+}
+
+func (self *HealthDBStorage) ReadLeases() []*pb.Lease {
+	if self.DB == nil {
+		return nil
+	}
+	rows, err := self.DB.Query("SELECT subject, peer, expires FROM lease")
+	if err != nil {
+		du.LogE(sdtag, "Fail to read leases %s", err)
+		return nil
+	}
+	defer rows.Close()
+	var leases []*pb.Lease
+	for rows.Next() {
+		var lease pb.Lease
+		var ts time.Time
+		err = rows.Scan(&lease.Subject, &lease.Peer, &ts)
+		if err != nil {
+			du.LogE(sdtag, "Failed to read lease: %s", err)
+			continue
+		}
+		lease.Expires, _ = ptypes.TimestampProto(ts)
+		leases = append(leases, &lease)
+	}
+	return leases
+}
+
 func (self *HealthDBStorage) Close() {
 	if self.DB != nil {
 		self.DB.Close()
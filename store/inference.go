@@ -3,6 +3,9 @@ package store
 import (
 	"fmt"
 	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
 
 	dd "panorama/decision"
 	dt "panorama/types"
@@ -23,11 +26,13 @@ type HealthInferenceStorage struct {
 	ReportCh  chan *pb.Report
 	SubjectCh chan string
 
-	raw   dt.HealthStorage
-	db    dt.HealthDB
-	algo  dd.InferenceAlgo
-	mu    *sync.RWMutex
-	alive bool
+	raw       dt.HealthStorage
+	db        dt.HealthDB
+	algo      dd.InferenceAlgo
+	silencer  dt.HealthSilencer
+	listeners []dt.InferenceListener
+	mu        *sync.RWMutex
+	stopc     chan bool
 }
 
 func NewHealthInferenceStorage(raw dt.HealthStorage, algo dd.InferenceAlgo) *HealthInferenceStorage {
@@ -39,7 +44,6 @@ func NewHealthInferenceStorage(raw dt.HealthStorage, algo dd.InferenceAlgo) *Hea
 		raw:       raw,
 		algo:      algo,
 		mu:        &sync.RWMutex{},
-		alive:     true,
 	}
 	return storage
 }
@@ -75,7 +79,8 @@ func (self *HealthInferenceStorage) InferSubject(subject string) (*pb.Inference,
 	self.Workbooks[subject] = workbook
 	self.mu.Unlock()
 	pano.RLock()
-	inference := self.algo.InferPano(pano.Value, workbook)
+	value, silenced := self.filter(pano.Value)
+	inference := self.algo.InferPano(value, workbook)
 	pano.RUnlock()
 	if inference == nil {
 		du.LogD(itag, "empty inference for %s, reset result to empty", subject)
@@ -86,6 +91,7 @@ func (self *HealthInferenceStorage) InferSubject(subject string) (*pb.Inference,
 		return nil, fmt.Errorf("could not compute inference for %s\n", subject)
 	}
 	// du.LogD(itag, "inference result for %s: %s", subject, dt.ObservationString(inference.Observation))
+	inference.Silenced = silenced
 	self.mu.Lock()
 	self.Results[subject] = inference
 	self.mu.Unlock()
@@ -115,7 +121,8 @@ func (self *HealthInferenceStorage) InferReport(report *pb.Report) (*pb.Inferenc
 	}
 	self.mu.Unlock()
 	pano.RLock()
-	inference := self.algo.InferPano(pano.Value, workbook)
+	value, silenced := self.filter(pano.Value)
+	inference := self.algo.InferPano(value, workbook)
 	pano.RUnlock()
 	if inference == nil {
 		du.LogD(itag, "empty inference for %s, reset result to empty", report.Subject)
@@ -126,12 +133,69 @@ func (self *HealthInferenceStorage) InferReport(report *pb.Report) (*pb.Inferenc
 		return nil, fmt.Errorf("could not compute inference for %s\n", report.Subject)
 	}
 	du.LogD(itag, "inference result for %s: %s", report.Subject, dt.ObservationString(inference.Observation))
+	inference.Silenced = silenced
 	self.mu.Lock()
 	self.Results[report.Subject] = inference
 	self.mu.Unlock()
 	return inference, nil
 }
 
+func (self *HealthInferenceStorage) InferPanorama(pano *pb.Panorama) *pb.Inference {
+	value, silenced := self.filter(pano)
+	inference := self.algo.InferPano(value, make(InferMap))
+	if inference != nil {
+		inference.Silenced = silenced
+	}
+	return inference
+}
+
+// Exclude the observations made under maintenance from a panorama and tell
+// if the inference should be flagged. Must be called with panorama locked.
+func (self *HealthInferenceStorage) filter(pano *pb.Panorama) (*pb.Panorama, bool) {
+	if self.silencer == nil {
+		return pano, false
+	}
+	silenced := self.silencer.MatchSubject(pano.Subject, time.Now()) != nil
+	var filtered *pb.Panorama
+	for observer, view := range pano.Views {
+		kept := make([]*pb.Observation, 0, len(view.Observations))
+		for _, ob := range view.Observations {
+			t, err := ptypes.Timestamp(ob.Ts)
+			if err == nil {
+				silence := self.silencer.Match(pano.Subject, observer, t)
+				if silence != nil {
+					silenced = true
+					if silence.Mode == pb.Silence_EXCLUDE {
+						continue
+					}
+				}
+			}
+			kept = append(kept, ob)
+		}
+		if len(kept) == len(view.Observations) {
+			continue
+		}
+		if filtered == nil {
+			// copy on the first excluded observation
+			filtered = &pb.Panorama{Subject: pano.Subject, Views: make(map[string]*pb.View)}
+			for o, v := range pano.Views {
+				filtered.Views[o] = v
+			}
+		}
+		du.LogD(itag, "excluded %d observations from %s about %s under maintenance",
+			len(view.Observations)-len(kept), observer, pano.Subject)
+		if len(kept) == 0 {
+			delete(filtered.Views, observer)
+		} else {
+			filtered.Views[observer] = &pb.View{Observer: observer, Subject: view.Subject, Observations: kept}
+		}
+	}
+	if filtered != nil {
+		return filtered, silenced
+	}
+	return pano, silenced
+}
+
 func (self *HealthInferenceStorage) GetInference(subject string) *pb.Inference {
 	self.mu.Lock()
 	inference, ok := self.Results[subject]
@@ -150,10 +214,33 @@ func (self *HealthInferenceStorage) SetDB(db dt.HealthDB) {
 	self.db = db
 }
 
+func (self *HealthInferenceStorage) SetSilencer(silencer dt.HealthSilencer) {
+	self.silencer = silencer
+}
+
+func (self *HealthInferenceStorage) AddListener(listener dt.InferenceListener) {
+	self.mu.Lock()
+	self.listeners = append(self.listeners, listener)
+	self.mu.Unlock()
+}
+
+func (self *HealthInferenceStorage) notify(inf *pb.Inference) {
+	self.mu.RLock()
+	listeners := self.listeners
+	self.mu.RUnlock()
+	for _, listener := range listeners {
+		listener.OnInference(inf)
+	}
+}
+
 func (self *HealthInferenceStorage) Start() error {
+	stopc := make(chan bool)
+	self.stopc = stopc
 	go func() {
-		for self.alive {
+		for {
 			select {
+			case <-stopc:
+				return
 			case subject := <-self.SubjectCh:
 				{
 					du.LogD(itag, "perform inference on subject for %s", subject)
@@ -164,6 +251,7 @@ func (self *HealthInferenceStorage) Start() error {
 						if self.db != nil && inf != nil {
 							go self.db.InsertInference(inf)
 						}
+						self.notify(inf)
 					}
 				}
 			case report := <-self.ReportCh:
@@ -177,6 +265,7 @@ func (self *HealthInferenceStorage) Start() error {
 							if self.db != nil && inf != nil {
 								go self.db.InsertInference(inf)
 							}
+							self.notify(inf)
 						}
 					}
 				}
@@ -187,12 +276,9 @@ func (self *HealthInferenceStorage) Start() error {
 }
 
 func (self *HealthInferenceStorage) Stop() error {
-	self.alive = false
-	var report pb.Report
-	select {
-	case self.ReportCh <- &report:
-		du.LogI(itag, "send empty report to stop the service")
-	default:
+	if self.stopc != nil {
+		close(self.stopc)
+		self.stopc = nil
 	}
 	return nil
 }
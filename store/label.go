@@ -0,0 +1,105 @@
+package store
+
+import (
+	"sync"
+
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+const (
+	ltag = "label"
+)
+
+type LabelStorage struct {
+	Labels map[string]map[string]string
+
+	db dt.HealthDB
+	mu *sync.RWMutex
+}
+
+var _ dt.HealthLabeler = new(LabelStorage)
+
+func NewLabelStorage(labels map[string]map[string]string) *LabelStorage {
+	storage := &LabelStorage{
+		Labels: make(map[string]map[string]string),
+		mu:     &sync.RWMutex{},
+	}
+	for subject, sl := range labels {
+		storage.Labels[subject] = copyLabels(sl)
+	}
+	return storage
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	result := make(map[string]string, len(labels))
+	for key, value := range labels {
+		result[key] = value
+	}
+	return result
+}
+
+func (self *LabelStorage) SetDB(db dt.HealthDB) {
+	self.db = db
+}
+
+// Labels changed through RPC are stored in the database and
+// override the ones from the configuration
+func (self *LabelStorage) Load() error {
+	if self.db == nil {
+		return nil
+	}
+	labels := self.db.ReadLabels()
+	self.mu.Lock()
+	for subject, sl := range labels {
+		self.Labels[subject] = sl
+	}
+	self.mu.Unlock()
+	du.LogI(ltag, "Loaded labels of %d subjects", len(labels))
+	return nil
+}
+
+func (self *LabelStorage) SetLabels(subject string, labels map[string]string, remove []string, replace bool) map[string]string {
+	self.mu.Lock()
+	var sl map[string]string
+	old, ok := self.Labels[subject]
+	if ok && !replace {
+		// copy on write so readers can keep the old labels
+		sl = copyLabels(old)
+	} else {
+		sl = make(map[string]string)
+	}
+	for key, value := range labels {
+		sl[key] = value
+	}
+	for _, key := range remove {
+		delete(sl, key)
+	}
+	if len(sl) == 0 {
+		delete(self.Labels, subject)
+	} else {
+		self.Labels[subject] = sl
+	}
+	self.mu.Unlock()
+	du.LogI(ltag, "Labels of %s are now {%s}", subject, dt.LabelsString(sl))
+	if self.db != nil {
+		go self.db.InsertLabels(subject, sl)
+	}
+	return sl
+}
+
+func (self *LabelStorage) GetLabels(subject string) map[string]string {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.Labels[subject]
+}
+
+func (self *LabelStorage) DumpLabels() map[string]map[string]string {
+	snapshot := make(map[string]map[string]string)
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	for subject, sl := range self.Labels {
+		snapshot[subject] = sl
+	}
+	return snapshot
+}
@@ -10,6 +10,7 @@ import (
 	dt "panorama/types"
 	du "panorama/util"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/timestamp"
 )
@@ -23,6 +24,7 @@ const (
 	REPORT_IGNORED int = iota
 	REPORT_ACCEPTED
 	REPORT_FAILED
+	REPORT_DUPLICATE // the observation is already in the view
 )
 
 type RawHealthStorage struct {
@@ -116,7 +118,30 @@ func (self *RawHealthStorage) AddReport(report *pb.Report, filter bool) (int, er
 		pano.Value.Views[report.Observer] = view
 		du.LogD(stag, "create view for %s->%s...", report.Observer, report.Subject)
 	}
-	view.Observations = append(view.Observations, report.Observation)
+	obs := view.Observations
+	i := len(obs)
+	if report.Observation.Ts != nil {
+		// reports may arrive out of order through retries and anti-entropy,
+		// keep the observations of a view sorted by time
+		for i > 0 && obs[i-1].Ts != nil && dt.CompareTimestamp(obs[i-1].Ts, report.Observation.Ts) > 0 {
+			i--
+		}
+		// different observations may be made at the same time
+		for j := i; j > 0 && obs[j-1].Ts != nil && dt.CompareTimestamp(obs[j-1].Ts, report.Observation.Ts) == 0; j-- {
+			if proto.Equal(obs[j-1], report.Observation) {
+				du.LogD(stag, "duplicate report for %s from %s", report.Subject, report.Observer)
+				return REPORT_DUPLICATE, nil
+			}
+		}
+	}
+	if i == len(obs) {
+		view.Observations = append(obs, report.Observation)
+	} else {
+		obs = append(obs, nil)
+		copy(obs[i+1:], obs[i:])
+		obs[i] = report.Observation
+		view.Observations = obs
+	}
 	// du.LogD(stag, "add observation to view %s->%s: %s", report.Observer, report.Subject, dt.ObservationString(report.Observation))
 	// du.PrintMemUsage(os.Stdout)
 	if len(view.Observations) > MaxReportPerView {
@@ -129,6 +154,78 @@ func (self *RawHealthStorage) AddReport(report *pb.Report, filter bool) (int, er
 	return REPORT_ACCEPTED, nil
 }
 
+// Subjects to look at, all of them when none is given. Must be called with lock held.
+func (self *RawHealthStorage) selectTenants(subjects []string) map[string]*dt.ConcurrentPanorama {
+	tenants := make(map[string]*dt.ConcurrentPanorama)
+	if len(subjects) == 0 {
+		for subject, pano := range self.Tenants {
+			tenants[subject] = pano
+		}
+		return tenants
+	}
+	for _, subject := range subjects {
+		if pano, ok := self.Tenants[subject]; ok {
+			tenants[subject] = pano
+		}
+	}
+	return tenants
+}
+
+func (self *RawHealthStorage) GetDigest(subjects []string) []*pb.DigestEntry {
+	var digest []*pb.DigestEntry
+	self.mu.RLock()
+	tenants := self.selectTenants(subjects)
+	self.mu.RUnlock()
+	for subject, pano := range tenants {
+		pano.RLock()
+		for observer, view := range pano.Value.Views {
+			if lo := len(view.Observations); lo > 0 {
+				digest = append(digest, &pb.DigestEntry{
+					Subject:  subject,
+					Observer: observer,
+					Latest:   view.Observations[lo-1].Ts,
+				})
+			}
+		}
+		pano.RUnlock()
+	}
+	return digest
+}
+
+func (self *RawHealthStorage) GetMissing(digest []*pb.DigestEntry, subjects []string, max int) ([]*pb.Report, bool) {
+	type viewKey struct {
+		subject  string
+		observer string
+	}
+	latest := make(map[viewKey]*timestamp.Timestamp)
+	for _, entry := range digest {
+		latest[viewKey{entry.Subject, entry.Observer}] = entry.Latest
+	}
+	var reports []*pb.Report
+	self.mu.RLock()
+	tenants := self.selectTenants(subjects)
+	self.mu.RUnlock()
+	for subject, pano := range tenants {
+		pano.RLock()
+		for observer, view := range pano.Value.Views {
+			since := latest[viewKey{subject, observer}]
+			// oldest first, so that the peer can pick up the rest next time
+			for _, ob := range view.Observations {
+				if since != nil && ob.Ts != nil && dt.CompareTimestamp(ob.Ts, since) <= 0 {
+					continue
+				}
+				if len(reports) >= max {
+					pano.RUnlock()
+					return reports, true
+				}
+				reports = append(reports, &pb.Report{Observer: observer, Subject: subject, Observation: ob})
+			}
+		}
+		pano.RUnlock()
+	}
+	return reports, false
+}
+
 func (self *RawHealthStorage) GetPanorama(subject string) *dt.ConcurrentPanorama {
 	self.mu.RLock()
 	pano, _ := self.Tenants[subject]
@@ -223,3 +223,80 @@ func TestGC(t *testing.T) {
 		t.Errorf("Should retire 3 observations for TS_2")
 	}
 }
+
+func TestSyncMissing(t *testing.T) {
+	du.SetLogLevel(du.InfoLevel)
+	local := NewRawHealthStorage("TS_1", "TS_2")
+	remote := NewRawHealthStorage("TS_1", "TS_2")
+	var reports []*pb.Report
+	for i := 0; i < 6; i++ {
+		metrics := map[string]*pb.Value{"cpu": &pb.Value{Status: pb.Status_HEALTHY, Score: float32(i)}}
+		report := dt.NewReport(fmt.Sprintf("FE_%d", i%2), "TS_1", metrics)
+		reports = append(reports, report)
+		remote.AddReport(report, false)
+		time.Sleep(time.Millisecond)
+	}
+	// the local storage lost the last report of FE_0 and all reports of FE_1
+	local.AddReport(reports[0], false)
+	local.AddReport(reports[2], false)
+
+	digest := local.GetDigest(nil)
+	if len(digest) != 1 || digest[0].Observer != "FE_0" {
+		t.Fatalf("Expecting a digest of the view of FE_0, got %v", digest)
+	}
+	missing, truncated := remote.GetMissing(digest, nil, 2)
+	if len(missing) != 2 || !truncated {
+		t.Fatalf("Expecting 2 missing reports and more, got %d", len(missing))
+	}
+	for _, report := range missing {
+		local.AddReport(report, false)
+	}
+	missing, truncated = remote.GetMissing(local.GetDigest(nil), nil, 10)
+	if truncated {
+		t.Error("Expecting no more missing reports")
+	}
+	for _, report := range missing {
+		local.AddReport(report, false)
+	}
+	if missing, _ = remote.GetMissing(local.GetDigest(nil), nil, 10); len(missing) != 0 {
+		t.Errorf("Expecting the storages to be in sync, still missing %d reports", len(missing))
+	}
+	for _, observer := range []string{"FE_0", "FE_1"} {
+		view := local.GetView(observer, "TS_1")
+		if view == nil || len(view.Observations) != 3 {
+			t.Fatalf("Expecting 3 observations from %s", observer)
+		}
+		for i := 1; i < len(view.Observations); i++ {
+			if dt.CompareTimestamp(view.Observations[i-1].Ts, view.Observations[i].Ts) >= 0 {
+				t.Errorf("Observations from %s are out of order", observer)
+			}
+		}
+	}
+	// an old report learned again is not stored twice
+	local.AddReport(reports[0], false)
+	if view := local.GetView("FE_0", "TS_1"); len(view.Observations) != 3 {
+		t.Errorf("Expecting duplicate report to be skipped, got %d observations", len(view.Observations))
+	}
+	if missing, _ = remote.GetMissing(nil, []string{"TS_2"}, 10); len(missing) != 0 {
+		t.Errorf("Expecting no reports about TS_2, got %d", len(missing))
+	}
+}
+
+func TestSameTimestamp(t *testing.T) {
+	du.SetLogLevel(du.InfoLevel)
+	store := NewRawHealthStorage("TS_1")
+	cpu := dt.NewReport("FE_1", "TS_1", map[string]*pb.Value{"cpu": &pb.Value{Status: pb.Status_UNHEALTHY, Score: 20}})
+	disk := dt.NewReport("FE_1", "TS_1", map[string]*pb.Value{"disk": &pb.Value{Status: pb.Status_HEALTHY, Score: 90}})
+	disk.Observation.Ts = cpu.Observation.Ts
+	for _, report := range []*pb.Report{cpu, disk} {
+		if result, err := store.AddReport(report, false); err != nil || result != REPORT_ACCEPTED {
+			t.Errorf("Expecting report %s to be accepted, got %d", report, result)
+		}
+	}
+	if result, _ := store.AddReport(disk, false); result != REPORT_DUPLICATE {
+		t.Errorf("Expecting report %s learned again to be a duplicate, got %d", disk, result)
+	}
+	if view := store.GetView("FE_1", "TS_1"); len(view.Observations) != 2 {
+		t.Errorf("Expecting both observations made at the same time, got %d", len(view.Observations))
+	}
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"sync"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+const (
+	rtag = "remote"
+)
+
+// The latest inference of each peer about each subject, shared by peers
+// that exchange inferences. They are kept apart from the inferences made
+// from my own panorama.
+type RemoteInferenceStorage struct {
+	Inferences map[string]map[string]*pb.Inference // subject -> peer -> inference
+
+	mu *sync.RWMutex
+}
+
+var _ dt.HealthRemoteInference = new(RemoteInferenceStorage)
+
+func NewRemoteInferenceStorage() *RemoteInferenceStorage {
+	return &RemoteInferenceStorage{
+		Inferences: make(map[string]map[string]*pb.Inference),
+		mu:         &sync.RWMutex{},
+	}
+}
+
+func (self *RemoteInferenceStorage) AddInference(peer string, inference *pb.Inference) bool {
+	if inference.Observation == nil || inference.Observation.Ts == nil {
+		return false
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	peers, ok := self.Inferences[inference.Subject]
+	if !ok {
+		peers = make(map[string]*pb.Inference)
+		self.Inferences[inference.Subject] = peers
+	}
+	if known, ok := peers[peer]; ok && dt.CompareTimestamp(inference.Observation.Ts, known.Observation.Ts) <= 0 {
+		return false
+	}
+	peers[peer] = inference
+	du.LogD(rtag, "learned inference of %s from %s", inference.Subject, peer)
+	return true
+}
+
+func (self *RemoteInferenceStorage) GetInferences(subject string) map[string]*pb.Inference {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	result := make(map[string]*pb.Inference, len(self.Inferences[subject]))
+	for peer, inference := range self.Inferences[subject] {
+		result[peer] = inference
+	}
+	return result
+}
+
+func (self *RemoteInferenceStorage) RemovePeer(peer string) int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	var removed int
+	for subject, peers := range self.Inferences {
+		if _, ok := peers[peer]; ok {
+			delete(peers, peer)
+			removed++
+		}
+		if len(peers) == 0 {
+			delete(self.Inferences, subject)
+		}
+	}
+	if removed > 0 {
+		du.LogI(rtag, "dropped %d inferences of %s", removed, peer)
+	}
+	return removed
+}
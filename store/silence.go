@@ -0,0 +1,210 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	pb "panorama/build/gen"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+const (
+	sitag = "silence"
+	// Reports made during a maintenance window may stay in the panorama for
+	// a while after the window ends, so keep the expired silences around to
+	// continue excluding them
+	SILENCE_RETENTION = 1 * time.Hour
+)
+
+type silenceEntry struct {
+	value *pb.Silence
+	start time.Time
+	end   time.Time
+}
+
+type SilenceStorage struct {
+	Silences map[string]*silenceEntry
+
+	db dt.HealthDB
+	mu *sync.RWMutex
+}
+
+var _ dt.HealthSilencer = new(SilenceStorage)
+
+func NewSilenceStorage() *SilenceStorage {
+	return &SilenceStorage{
+		Silences: make(map[string]*silenceEntry),
+		mu:       &sync.RWMutex{},
+	}
+}
+
+func newSilenceEntry(silence *pb.Silence) (*silenceEntry, error) {
+	if len(silence.Id) == 0 {
+		return nil, fmt.Errorf("silence has no id")
+	}
+	if len(silence.Subject) == 0 && len(silence.Observer) == 0 {
+		return nil, fmt.Errorf("silence %s has neither subject nor observer", silence.Id)
+	}
+	start, err := ptypes.Timestamp(silence.Start)
+	if err != nil {
+		return nil, err
+	}
+	end, err := ptypes.Timestamp(silence.End)
+	if err != nil {
+		return nil, err
+	}
+	if end.Before(start) {
+		return nil, fmt.Errorf("silence %s ends before it starts", silence.Id)
+	}
+	return &silenceEntry{value: silence, start: start, end: end}, nil
+}
+
+func (self *silenceEntry) covers(t time.Time) bool {
+	return !t.Before(self.start) && t.Before(self.end)
+}
+
+func (self *SilenceStorage) SetDB(db dt.HealthDB) {
+	self.db = db
+}
+
+func (self *SilenceStorage) Load() error {
+	if self.db == nil {
+		return nil
+	}
+	silences := self.db.ReadSilences()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for id, silence := range silences {
+		entry, err := newSilenceEntry(silence)
+		if err != nil {
+			du.LogE(sitag, "Fail to load silence %s: %s", id, err)
+			continue
+		}
+		self.Silences[id] = entry
+	}
+	self.prune(time.Now())
+	du.LogI(sitag, "Loaded %d silences", len(self.Silences))
+	return nil
+}
+
+func (self *SilenceStorage) AddSilence(silence *pb.Silence) bool {
+	entry, err := newSilenceEntry(silence)
+	if err != nil {
+		du.LogE(sitag, "Invalid silence: %s", err)
+		return false
+	}
+	now := time.Now()
+	if now.Sub(entry.end) > SILENCE_RETENTION {
+		du.LogI(sitag, "Silence %s has long expired, ignore it", silence.Id)
+		return false
+	}
+	self.mu.Lock()
+	// a silence only ends earlier than planned, so a copy ending later is
+	// stale, e.g., a delayed copy of a silence lifted since
+	if old, ok := self.Silences[silence.Id]; ok && entry.end.After(old.end) {
+		self.mu.Unlock()
+		du.LogI(sitag, "Silence %s ended at %s, ignore the stale copy", silence.Id, old.end)
+		return false
+	}
+	self.Silences[silence.Id] = entry
+	self.prune(now)
+	self.mu.Unlock()
+	du.LogI(sitag, "Added silence %s for subject '%s' observer '%s' until %s", silence.Id,
+		silence.Subject, silence.Observer, entry.end)
+	if self.db != nil {
+		go self.db.InsertSilence(silence)
+	}
+	return true
+}
+
+func (self *SilenceStorage) EndSilence(id string) *pb.Silence {
+	now := time.Now()
+	self.mu.Lock()
+	entry, ok := self.Silences[id]
+	if !ok {
+		self.mu.Unlock()
+		return nil
+	}
+	var silence *pb.Silence
+	if entry.end.After(now) {
+		// keep the window so the reports made in it are still excluded,
+		// but make it end now
+		silence = &pb.Silence{}
+		*silence = *entry.value
+		silence.End, _ = ptypes.TimestampProto(now)
+		start := entry.start
+		if start.After(now) {
+			// an upcoming window becomes empty
+			silence.Start = silence.End
+			start = now
+		}
+		self.Silences[id] = &silenceEntry{value: silence, start: start, end: now}
+	} else {
+		silence = entry.value
+	}
+	self.mu.Unlock()
+	if self.db != nil {
+		go self.db.InsertSilence(silence)
+	}
+	return silence
+}
+
+func (self *SilenceStorage) GetSilences() []*pb.Silence {
+	now := time.Now()
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	silences := make([]*pb.Silence, 0, len(self.Silences))
+	for _, entry := range self.Silences {
+		if entry.end.After(now) {
+			silences = append(silences, entry.value)
+		}
+	}
+	sort.Slice(silences, func(i, j int) bool {
+		return dt.CompareTimestamp(silences[i].Start, silences[j].Start) < 0
+	})
+	return silences
+}
+
+// A silence matches the reports about its subject by its observer, either
+// of which may be left out to match all
+func (self *silenceEntry) matches(subject string, observer string) bool {
+	return (len(self.value.Subject) == 0 || self.value.Subject == subject) &&
+		(len(self.value.Observer) == 0 || self.value.Observer == observer)
+}
+
+func (self *SilenceStorage) Match(subject string, observer string, t time.Time) *pb.Silence {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	for _, entry := range self.Silences {
+		if entry.matches(subject, observer) && entry.covers(t) {
+			return entry.value
+		}
+	}
+	return nil
+}
+
+// Find the silence on a subject as a whole, not only the reports of an observer
+func (self *SilenceStorage) MatchSubject(subject string, t time.Time) *pb.Silence {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	for _, entry := range self.Silences {
+		if entry.value.Subject == subject && len(entry.value.Observer) == 0 && entry.covers(t) {
+			return entry.value
+		}
+	}
+	return nil
+}
+
+// Drop the silences that are past retention. Must be called with lock held.
+func (self *SilenceStorage) prune(now time.Time) {
+	for id, entry := range self.Silences {
+		if now.Sub(entry.end) > SILENCE_RETENTION {
+			delete(self.Silences, id)
+		}
+	}
+}
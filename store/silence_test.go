@@ -0,0 +1,141 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	pb "panorama/build/gen"
+	"panorama/decision"
+	dt "panorama/types"
+	du "panorama/util"
+)
+
+func makeSilence(id string, subject string, observer string, start time.Time, d time.Duration, mode pb.Silence_Mode) *pb.Silence {
+	pstart, _ := ptypes.TimestampProto(start)
+	pend, _ := ptypes.TimestampProto(start.Add(d))
+	return &pb.Silence{Id: id, Subject: subject, Observer: observer, Start: pstart, End: pend, Mode: mode}
+}
+
+func TestSilenceMatch(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	silencer := NewSilenceStorage()
+	now := time.Now()
+	if silencer.AddSilence(makeSilence("s0", "", "", now, time.Minute, pb.Silence_EXCLUDE)) {
+		t.Error("silence without subject or observer should be rejected")
+	}
+	if silencer.AddSilence(makeSilence("s0", "TS_1", "", now, -time.Minute, pb.Silence_EXCLUDE)) {
+		t.Error("silence ending before start should be rejected")
+	}
+	silencer.AddSilence(makeSilence("s1", "TS_1", "", now, time.Minute, pb.Silence_EXCLUDE))
+	silencer.AddSilence(makeSilence("s2", "", "FE_2", now.Add(time.Hour), time.Minute, pb.Silence_FLAG))
+	if s := silencer.Match("TS_1", "FE_1", now.Add(time.Second)); s == nil || s.Id != "s1" {
+		t.Errorf("report about TS_1 should be silenced by s1, got %v", s)
+	}
+	if s := silencer.Match("TS_1", "FE_1", now.Add(2*time.Minute)); s != nil {
+		t.Errorf("report after the window should not be silenced, got %v", s)
+	}
+	if s := silencer.Match("TS_2", "FE_2", now); s != nil {
+		t.Errorf("report before an upcoming window should not be silenced, got %v", s)
+	}
+	if s := silencer.Match("TS_2", "FE_2", now.Add(time.Hour)); s == nil || s.Id != "s2" {
+		t.Errorf("report by FE_2 should be silenced by s2, got %v", s)
+	}
+	if len(silencer.GetSilences()) != 2 {
+		t.Errorf("expecting 2 silences, got %d", len(silencer.GetSilences()))
+	}
+
+	ended := silencer.EndSilence("s2")
+	if ended == nil {
+		t.Fatal("fail to end silence s2")
+	}
+	if s := silencer.Match("TS_2", "FE_2", now.Add(time.Hour)); s != nil {
+		t.Errorf("ended silence should not match, got %v", s)
+	}
+	// a peer learning the ended silence replaces its copy
+	peer := NewSilenceStorage()
+	peer.AddSilence(makeSilence("s2", "", "FE_2", now.Add(time.Hour), time.Minute, pb.Silence_FLAG))
+	if !peer.AddSilence(ended) {
+		t.Error("ended silence should be accepted by peer")
+	}
+	if len(peer.GetSilences()) != 0 {
+		t.Errorf("peer should have no silence in effect, got %v", peer.GetSilences())
+	}
+	// a delayed copy from before the silence ended does not bring it back
+	if peer.AddSilence(makeSilence("s2", "", "FE_2", now.Add(time.Hour), time.Minute, pb.Silence_FLAG)) {
+		t.Error("expecting the stale copy of s2 to be ignored")
+	}
+	if s := peer.Match("TS_2", "FE_2", now.Add(time.Hour)); s != nil {
+		t.Errorf("expecting s2 to stay ended, got %v", s)
+	}
+}
+
+func TestSilenceSubjectObserver(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	silencer := NewSilenceStorage()
+	now := time.Now()
+	silencer.AddSilence(makeSilence("s1", "TS_1", "FE_1", now, time.Minute, pb.Silence_EXCLUDE))
+	if s := silencer.Match("TS_1", "FE_1", now); s == nil || s.Id != "s1" {
+		t.Errorf("expecting report by FE_1 about TS_1 to be silenced by s1, got %v", s)
+	}
+	if s := silencer.Match("TS_1", "FE_2", now); s != nil {
+		t.Errorf("expecting report by FE_2 not to be silenced, got %v", s)
+	}
+	if s := silencer.Match("TS_2", "FE_1", now); s != nil {
+		t.Errorf("expecting report about TS_2 not to be silenced, got %v", s)
+	}
+	if s := silencer.MatchSubject("TS_1", now); s != nil {
+		t.Errorf("expecting TS_1 as a whole not to be silenced, got %v", s)
+	}
+}
+
+func TestSilenceInference(t *testing.T) {
+	du.SetLogLevel(du.ErrorLevel)
+	raw := NewRawHealthStorage()
+	var majority decision.SimpleMajorityInference
+	infs := NewHealthInferenceStorage(raw, majority)
+	silencer := NewSilenceStorage()
+	infs.SetSilencer(silencer)
+
+	subject := "TS_1"
+	for _, observer := range []string{"FE_1", "FE_2"} {
+		r := dt.NewReport(observer, subject, metrics_t{"cpu": &pb.Value{Status: pb.Status_HEALTHY, Score: 90}})
+		raw.AddReport(r, false)
+	}
+	start := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	// FE_2 is restarting and considers everyone dead
+	for i := 0; i < 3; i++ {
+		r := dt.NewReport("FE_2", subject, metrics_t{"cpu": &pb.Value{Status: pb.Status_DEAD, Score: 10}})
+		raw.AddReport(r, false)
+	}
+	inf, err := infs.InferSubject(subject)
+	if err != nil {
+		t.Fatalf("Fail to infer %s: %s", subject, err)
+	}
+	if inf.Silenced || inf.Observation.Metrics["cpu"].Value.Status != pb.Status_DEAD {
+		t.Errorf("expecting unsilenced DEAD inference, got %s", dt.InferenceString(inf))
+	}
+
+	silencer.AddSilence(makeSilence("s1", "", "FE_2", start, time.Minute, pb.Silence_EXCLUDE))
+	inf, err = infs.InferSubject(subject)
+	if err != nil {
+		t.Fatalf("Fail to infer %s: %s", subject, err)
+	}
+	if !inf.Silenced || inf.Observation.Metrics["cpu"].Value.Status != pb.Status_HEALTHY {
+		t.Errorf("expecting silenced HEALTHY inference, got %s", dt.InferenceString(inf))
+	}
+	if view := raw.GetView("FE_2", subject); view == nil || len(view.Observations) != 4 {
+		t.Error("silenced reports should still be stored")
+	}
+
+	silencer.AddSilence(makeSilence("s1", "", "FE_2", start, time.Minute, pb.Silence_FLAG))
+	inf, err = infs.InferSubject(subject)
+	if err != nil {
+		t.Fatalf("Fail to infer %s: %s", subject, err)
+	}
+	if !inf.Silenced || inf.Observation.Metrics["cpu"].Value.Status != pb.Status_DEAD {
+		t.Errorf("expecting flagged DEAD inference, got %s", dt.InferenceString(inf))
+	}
+}
@@ -8,17 +8,29 @@ import (
 )
 
 type HealthServerConfig struct {
-	Addr             string
-	Id               string
-	Subjects         []string
-	Peers            map[string]string // all peers' id and address
-	FilterSubmission bool              // whether to filter submitted report based on the subject id
-	LogLevel         string
-	DumpMemUsage     bool
-	DBFile           string
+	Addr              string
+	Id                string
+	Subjects          []string
+	SubjectLabels     map[string]map[string]string // labels of subjects, e.g., zone, rack, role
+	Dependencies      map[string][]string          // subjects each subject depends on
+	Peers             map[string]string            // all peers' id and address
+	Seeds             []string                     // addresses of instances to join the cluster through on startup
+	FilterSubmission  bool                         // whether to filter submitted report based on the subject id
+	ObserverTokens    map[string]string            // token of each observer or "observer/module" to register with, empty to accept anyone
+	RegistrationLease int                          // seconds a registration lasts without submissions or renewals, negative for ever
+	LogLevel          string
+	DumpMemUsage      bool
+	DBFile            string
 
-	GCConfig  GarbageCollectionConfig
-	BufConfig BufferingConfig
+	GCConfig       GarbageCollectionConfig
+	BufConfig      BufferingConfig
+	ExchangeConfig ExchangeConfig
+	AlertConfig    AlertingConfig
+	IncidentConfig IncidentDetectionConfig
+
+	FederationConfig FederationConfig
+	TLSConfig        TLSConfig
+	AccessConfig     AccessConfig
 }
 
 type GarbageCollectionConfig struct {
@@ -33,6 +45,93 @@ type BufferingConfig struct {
 	HoldListLen int
 }
 
+type ExchangeConfig struct {
+	Mode     string // how reports are disseminated, broadcast (default), gossip or sharded
+	Fanout   int    // number of peers to gossip a report to in each round
+	Rounds   int    // number of gossip rounds, 0 to derive from the number of peers
+	Replicas int    // number of owners of each subject in sharded mode
+
+	QueueLen    int // number of requests to buffer for each peer before dropping
+	BatchSize   int // maximum number of requests sent to a peer at once
+	SendTimeout int // milliseconds for a peer to learn a batch
+
+	SummaryInterval int  // seconds between summaries of repeated healthy reports, negative to send all reports at once
+	ShareInferences bool // whether to send my inferences to the peers interested in their subjects
+	LeaseDuration   int  // seconds a subscription to the reports about a subject lasts unless renewed
+
+	DialTimeout int // milliseconds to connect to a peer
+	IdleTimeout int // seconds after which an unused connection to a peer is closed
+
+	OutboxLen  int    // number of failed requests to keep for each peer for retry
+	OutboxFile string // file to save the failed requests in, empty to keep them in memory
+	Freshness  int    // seconds after its observation that a report is too stale to retry
+
+	SyncInterval   int // seconds between anti-entropy rounds with a random peer, negative to disable
+	SyncMaxReports int // maximum number of observations to pull from a peer at once
+
+	Heartbeat  int     // milliseconds between heartbeats to peers, negative to disable
+	PhiSuspect float64 // suspicion level to suspect a peer
+	PhiDead    float64 // suspicion level to consider a peer dead
+}
+
+type TLSConfig struct {
+	CertFile string // certificate of this instance issued to its id, empty to disable TLS
+	KeyFile  string // private key of the certificate
+	CAFile   string // certificate authorities that issue the certificates of the peers and clients
+	Mutual   bool   // whether clients must present certificates, peers ones issued to the ids they claim
+}
+
+type AccessConfig struct {
+	Enable     bool
+	Identities map[string][]string // roles of the callers by a name in their certificates, with mutual TLS
+	Tokens     map[string][]string // roles of the callers presenting a token
+	Anonymous  []string            // roles of every caller, e.g., reader
+	Token      string              // token to present to the peers and the downstream clusters
+}
+
+type FederationConfig struct {
+	Clusters []*DownstreamConfig // downstream clusters to pull the inferences of, empty unless aggregating
+	Interval int                 // seconds between pulls from the downstream clusters
+}
+
+type DownstreamConfig struct {
+	Name     string   // observer of the subjects in my panorama on behalf of the cluster
+	Addrs    []string // addresses of instances of the cluster, tried in order
+	Selector string   // label selector of the subjects to pull, empty for all
+}
+
+type AlertingConfig struct {
+	Rules       []*AlertRuleConfig
+	Sinks       []*AlertSinkConfig
+	DedupWindow int // seconds to suppress an identical alert after it is sent
+}
+
+type AlertRuleConfig struct {
+	Name        string
+	Subject     string   // regular expression for the subject, empty matches all
+	Metric      string   // metric name, empty matches all
+	Severity    string   // minimum status to fire, e.g., unhealthy
+	MinDuration int      // seconds the status must persist before firing
+	Sinks       []string // sinks to deliver to, empty means all sinks
+}
+
+type AlertSinkConfig struct {
+	Name    string
+	Kind    string   // webhook, exec or file
+	Target  string   // URL of the webhook, path of the script or the file
+	Args    []string // extra arguments to the exec sink
+	Retries int      // number of retries for the webhook sink
+	Timeout int      // seconds to wait for a delivery
+}
+
+type IncidentDetectionConfig struct {
+	Domains    []string // label keys of the failure domains, e.g., rack, zone
+	Window     int      // seconds within which the members must fail to be correlated
+	MinMembers int      // minimum number of failed members in an incident
+	MinRatio   float32  // minimum ratio of failed members in an incident
+	Severity   string   // minimum status for a member to be failed, e.g., unhealthy
+}
+
 type ClassifierConfig struct {
 	Context string
 	Subject string
@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/timestamp"
 	pb "panorama/build/gen"
@@ -113,6 +114,56 @@ func CompareTimestamp(a *timestamp.Timestamp, b *timestamp.Timestamp) int32 {
 	return a.Nanos - b.Nanos
 }
 
+// Merge the panoramas of a subject from several instances into one. The
+// views from the same observer are merged by the time of the observations,
+// with the copies of the same observation kept once. Different observations
+// made at the same time are all kept.
+func MergePanorama(subject string, panoramas ...*pb.Panorama) *pb.Panorama {
+	merged := &pb.Panorama{Subject: subject, Views: make(map[string]*pb.View)}
+	for _, pano := range panoramas {
+		if pano == nil {
+			continue
+		}
+		for observer, view := range pano.Views {
+			mv, ok := merged.Views[observer]
+			if !ok {
+				mv = &pb.View{Observer: observer, Subject: subject}
+				merged.Views[observer] = mv
+			}
+			for _, ob := range view.Observations {
+				if ob.Ts != nil {
+					mv.Observations = append(mv.Observations, ob)
+				}
+			}
+		}
+	}
+	for _, view := range merged.Views {
+		obs := view.Observations
+		sort.SliceStable(obs, func(i, j int) bool {
+			return CompareTimestamp(obs[i].Ts, obs[j].Ts) < 0
+		})
+		unique := obs[:0]
+		for _, ob := range obs {
+			if !containsObservation(unique, ob) {
+				unique = append(unique, ob)
+			}
+		}
+		view.Observations = unique
+	}
+	return merged
+}
+
+// Check if a copy of an observation is among the sorted observations, which
+// is among the last ones made at the same time
+func containsObservation(obs []*pb.Observation, ob *pb.Observation) bool {
+	for i := len(obs) - 1; i >= 0 && CompareTimestamp(obs[i].Ts, ob.Ts) == 0; i-- {
+		if proto.Equal(obs[i], ob) {
+			return true
+		}
+	}
+	return false
+}
+
 func MetricsString(metrics map[string]*pb.Metric) string {
 	var buf bytes.Buffer
 	keys := make([]string, 0, len(metrics))
@@ -132,6 +183,9 @@ func ObservationString(ob *pb.Observation) string {
 		return "{}"
 	}
 	mStr := MetricsString(ob.Metrics)
+	if len(ob.Origin) > 0 {
+		return ptypes.TimestampString(ob.Ts) + " {" + mStr + "} via " + ob.Origin
+	}
 	return ptypes.TimestampString(ob.Ts) + " {" + mStr + "}"
 }
 
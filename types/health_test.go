@@ -21,3 +21,48 @@ func TestNewObservation(t *testing.T) {
 	}
 	t.Log(m)
 }
+
+func TestMergePanorama(t *testing.T) {
+	now := time.Now()
+	ob := func(offset int, score float32) *pb.Observation {
+		return NewObservationSingleMetric(now.Add(time.Duration(offset)*time.Second), "cpu", pb.Status_HEALTHY, score)
+	}
+	shared := ob(1, 90)
+	p1 := &pb.Panorama{Subject: "TS_1", Views: map[string]*pb.View{
+		"FE_1": &pb.View{Observer: "FE_1", Subject: "TS_1", Observations: []*pb.Observation{ob(0, 100), shared}},
+	}}
+	p2 := &pb.Panorama{Subject: "TS_1", Views: map[string]*pb.View{
+		"FE_1": &pb.View{Observer: "FE_1", Subject: "TS_1", Observations: []*pb.Observation{shared, ob(2, 80)}},
+		"FE_2": &pb.View{Observer: "FE_2", Subject: "TS_1", Observations: []*pb.Observation{ob(0, 70)}},
+	}}
+	merged := MergePanorama("TS_1", p1, nil, p2)
+	if len(merged.Views) != 2 {
+		t.Fatalf("expecting views from 2 observers, got %d", len(merged.Views))
+	}
+	view := merged.Views["FE_1"]
+	if len(view.Observations) != 3 {
+		t.Fatalf("expecting 3 distinct observations from FE_1, got %d", len(view.Observations))
+	}
+	for i, score := range []float32{100, 90, 80} {
+		if metric := GetMetric(view.Observations[i], "cpu"); metric.Value.Score != score {
+			t.Errorf("expecting score %.0f for observation %d, got %.0f", score, i, metric.Value.Score)
+		}
+	}
+	if len(p1.Views["FE_1"].Observations) != 2 {
+		t.Error("merging should not change the source panoramas")
+	}
+
+	// different observations made at the same time are both kept
+	disk := NewObservationSingleMetric(now, "disk", pb.Status_UNHEALTHY, 20)
+	disk.Ts = shared.Ts
+	p3 := &pb.Panorama{Subject: "TS_1", Views: map[string]*pb.View{
+		"FE_1": &pb.View{Observer: "FE_1", Subject: "TS_1", Observations: []*pb.Observation{disk, shared}},
+	}}
+	view = MergePanorama("TS_1", p1, p2, p3).Views["FE_1"]
+	if len(view.Observations) != 4 {
+		t.Fatalf("expecting 4 distinct observations from FE_1, got %d", len(view.Observations))
+	}
+	if GetMetric(view.Observations[1], "cpu") == nil || GetMetric(view.Observations[2], "disk") == nil {
+		t.Errorf("expecting the observations made at the same time in the order they are merged, got %v", view.Observations)
+	}
+}
@@ -0,0 +1,118 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	LABEL_EQUAL     = "="
+	LABEL_NOT_EQUAL = "!="
+	LABEL_EXISTS    = ""
+	LABEL_NOT_EXIST = "!"
+)
+
+// A requirement on a single label, e.g., role=follower, zone!=a, rack or !rack
+type LabelRequirement struct {
+	Key      string
+	Operator string
+	Value    string
+}
+
+// A selector matches subjects whose labels meet all the requirements
+type LabelSelector []*LabelRequirement
+
+// Parse a comma separated list of requirements. An empty
+// string is parsed into a selector that matches everything.
+func ParseLabelSelector(str string) (LabelSelector, error) {
+	var selector LabelSelector
+	str = strings.TrimSpace(str)
+	if len(str) == 0 || str == "*" {
+		return selector, nil
+	}
+	for _, part := range strings.Split(str, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		var req *LabelRequirement
+		if idx := strings.Index(part, LABEL_NOT_EQUAL); idx >= 0 {
+			req = &LabelRequirement{Key: part[:idx], Operator: LABEL_NOT_EQUAL, Value: part[idx+2:]}
+		} else if idx := strings.Index(part, LABEL_EQUAL); idx >= 0 {
+			value := strings.TrimPrefix(part[idx+1:], LABEL_EQUAL) // accept == as well
+			req = &LabelRequirement{Key: part[:idx], Operator: LABEL_EQUAL, Value: value}
+		} else if strings.HasPrefix(part, LABEL_NOT_EXIST) {
+			req = &LabelRequirement{Key: part[1:], Operator: LABEL_NOT_EXIST}
+		} else {
+			req = &LabelRequirement{Key: part, Operator: LABEL_EXISTS}
+		}
+		req.Key = strings.TrimSpace(req.Key)
+		req.Value = strings.TrimSpace(req.Value)
+		if len(req.Key) == 0 {
+			return nil, fmt.Errorf("Empty label key in selector %s", str)
+		}
+		selector = append(selector, req)
+	}
+	return selector, nil
+}
+
+func (self *LabelRequirement) Matches(labels map[string]string) bool {
+	value, ok := labels[self.Key]
+	switch self.Operator {
+	case LABEL_EQUAL:
+		return ok && value == self.Value
+	case LABEL_NOT_EQUAL:
+		return !ok || value != self.Value
+	case LABEL_EXISTS:
+		return ok
+	case LABEL_NOT_EXIST:
+		return !ok
+	}
+	return false
+}
+
+func (self LabelSelector) Matches(labels map[string]string) bool {
+	for _, req := range self {
+		if !req.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (self LabelSelector) Empty() bool {
+	return len(self) == 0
+}
+
+func (self LabelSelector) String() string {
+	parts := make([]string, len(self))
+	for i, req := range self {
+		switch req.Operator {
+		case LABEL_EXISTS:
+			parts[i] = req.Key
+		case LABEL_NOT_EXIST:
+			parts[i] = LABEL_NOT_EXIST + req.Key
+		default:
+			parts[i] = req.Key + req.Operator + req.Value
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func LabelsString(labels map[string]string) string {
+	var buf bytes.Buffer
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString(key + "=" + labels[key])
+	}
+	return buf.String()
+}
@@ -0,0 +1,60 @@
+package types
+
+import (
+	"testing"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	good := map[string]string{
+		"":                     "",
+		"*":                    "",
+		"role=follower":        "role=follower",
+		"role==follower":       "role=follower",
+		" zone != a , rack ":   "zone!=a,rack",
+		"!rack,service=zk1":    "!rack,service=zk1",
+		"role=follower,,zone=": "role=follower,zone=",
+	}
+	for str, expected := range good {
+		selector, err := ParseLabelSelector(str)
+		if err != nil {
+			t.Errorf("Fail to parse selector '%s': %s", str, err)
+			continue
+		}
+		if selector.String() != expected {
+			t.Errorf("selector '%s' parsed into '%s', expecting '%s'", str, selector, expected)
+		}
+	}
+	for _, str := range []string{"=a", "!", "role=a,!=b"} {
+		if _, err := ParseLabelSelector(str); err == nil {
+			t.Errorf("selector '%s' should be rejected", str)
+		}
+	}
+}
+
+func TestLabelSelectorMatches(t *testing.T) {
+	labels := map[string]string{"zone": "a", "rack": "r1", "role": "follower"}
+	cases := map[string]bool{
+		"":                    true,
+		"role=follower":       true,
+		"role=leader":         false,
+		"zone!=b,rack":        true,
+		"zone!=a":             false,
+		"service!=zk1":        true,
+		"!service":            true,
+		"!rack":               false,
+		"role=follower,rack=": false,
+	}
+	for str, expected := range cases {
+		selector, err := ParseLabelSelector(str)
+		if err != nil {
+			t.Fatalf("Fail to parse selector '%s': %s", str, err)
+		}
+		if selector.Matches(labels) != expected {
+			t.Errorf("selector '%s' should match %t", str, expected)
+		}
+	}
+	selector, _ := ParseLabelSelector("rack")
+	if selector.Matches(nil) {
+		t.Error("selector requiring a label should not match a subject without labels")
+	}
+}
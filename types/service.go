@@ -5,6 +5,7 @@ import (
 	"time"
 
 	pb "panorama/build/gen"
+	dc "panorama/client"
 )
 
 // Simple tuple about the local observer
@@ -17,8 +18,11 @@ type ObserverModule struct {
 // Represents a registration to Panorama
 type Registration struct {
 	ObserverModule
-	Handle uint64
-	Time   time.Time
+	Handle         uint64
+	Time           time.Time
+	LastSubmission time.Time        // zero until the first report
+	Expires        time.Time        // zero if it never expires
+	Info           *pb.ObserverInfo // what the observer is and reports, nil if unknown
 }
 
 type HealthStorage interface {
@@ -44,6 +48,14 @@ type HealthStorage interface {
 	// Get the view from an observer about a subject
 	GetView(observer string, subject string) *pb.View
 
+	// Get the time of the latest observation in each view about the
+	// subjects, or about all subjects if none is given
+	GetDigest(subjects []string) []*pb.DigestEntry
+
+	// Get at most max observations about the subjects (all if none is given)
+	// that are newer than the digest of a peer, and whether there are more
+	GetMissing(digest []*pb.DigestEntry, subjects []string, max int) ([]*pb.Report, bool)
+
 	// Get the whole panorama for a subject
 	GetPanorama(subject string) *ConcurrentPanorama
 
@@ -58,10 +70,28 @@ type HealthStorage interface {
 	GC(ttl time.Duration, relative bool) map[string]uint32
 }
 
+// Receives the newly computed inference results
+type InferenceListener interface {
+	OnInference(inf *pb.Inference)
+}
+
+// Receives the correlated failures when they are detected and resolved
+type IncidentListener interface {
+	OnIncident(incident *pb.Incident)
+}
+
+// Receives the liveness of peers from the failure detector
+type PeerStatusListener interface {
+	OnPeerStatus(status *pb.PeerStatus)
+}
+
 type HealthInference interface {
 	// Associate database with the raw storage
 	SetDB(db HealthDB)
 
+	// Add a listener to be notified of new inference results
+	AddListener(listener InferenceListener)
+
 	// Asynchronously infer the health of a subject
 	InferSubjectAsync(subject string) error
 
@@ -76,6 +106,13 @@ type HealthInference interface {
 	// May support incremental inference
 	InferReport(report *pb.Report) (*pb.Inference, error)
 
+	// Infer the health from a panorama that is not in the raw storage,
+	// e.g., one merged from several instances, without keeping the result
+	InferPanorama(pano *pb.Panorama) *pb.Inference
+
+	// Use silencer to exclude or flag reports under maintenance
+	SetSilencer(silencer HealthSilencer)
+
 	// Get the health inference of a subject
 	GetInference(subject string) *pb.Inference
 
@@ -89,6 +126,59 @@ type HealthInference interface {
 	Stop() error
 }
 
+type HealthSilencer interface {
+	// Associate database with the silence storage
+	SetDB(db HealthDB)
+
+	// Load the silences stored in the database
+	Load() error
+
+	// Add or replace a silence, return false if it is invalid
+	AddSilence(silence *pb.Silence) bool
+
+	// End a silence now, return the updated silence or nil if not found
+	EndSilence(id string) *pb.Silence
+
+	// Get the silences that are in effect or upcoming
+	GetSilences() []*pb.Silence
+
+	// Find a silence that covers a report made by observer about subject at t
+	Match(subject string, observer string, t time.Time) *pb.Silence
+
+	// Find a silence that covers the subject at t
+	MatchSubject(subject string, t time.Time) *pb.Silence
+}
+
+type HealthLabeler interface {
+	// Associate database with the label storage
+	SetDB(db HealthDB)
+
+	// Load the labels stored in the database
+	Load() error
+
+	// Add or overwrite labels of a subject and remove the labels with the given keys.
+	// With replace, all the existing labels are dropped first. Return the new labels.
+	SetLabels(subject string, labels map[string]string, remove []string, replace bool) map[string]string
+
+	// Get the labels of a subject
+	GetLabels(subject string) map[string]string
+
+	// Get the labels of all the labeled subjects
+	DumpLabels() map[string]map[string]string
+}
+
+// Inferences made by peers, kept apart from my own
+type HealthRemoteInference interface {
+	// Keep the inference of a peer if it is newer than the known one
+	AddInference(peer string, inference *pb.Inference) bool
+
+	// Get the latest inference of each peer about a subject
+	GetInferences(subject string) map[string]*pb.Inference
+
+	// Drop the inferences of a peer that left
+	RemovePeer(peer string) int
+}
+
 type HealthDB interface {
 	// Open or create a database with file name
 	Open() (*sql.DB, error)
@@ -105,29 +195,135 @@ type HealthDB interface {
 	// Read the past registrations from the database
 	ReadRegistrations() (map[uint64]*Registration, uint64)
 
+	// Delete the registration of a handle from the database
+	DeleteRegistration(handle uint64) error
+
+	// Insert or update a silence in the database
+	InsertSilence(silence *pb.Silence) error
+
+	// Read the past silences from the database
+	ReadSilences() map[string]*pb.Silence
+
+	// Replace the labels of a subject in the database
+	InsertLabels(subject string, labels map[string]string) error
+
+	// Read the labels of subjects from the database
+	ReadLabels() map[string]map[string]string
+
+	// Insert or update a member of the cluster into the database
+	InsertMember(member *pb.Member) error
+
+	// Read the members of the cluster from the database
+	ReadMembers() map[string]*pb.Member
+
+	// Insert or renew the lease of a peer subscribed to a subject
+	InsertLease(lease *pb.Lease) error
+
+	// Delete the lease of a peer on a subject from the database
+	DeleteLease(subject string, peer string) error
+
+	// Read the leases of the subscribed peers from the database
+	ReadLeases() []*pb.Lease
+
 	// Close the database connection
 	Close()
 }
 
 type HealthExchange interface {
+	// Start the background retry of failed propagations
+	Start() error
+
+	// Stop the background retry of failed propagations
+	Stop() error
+
 	// Propagate a report to other peers
 	Propagate(report *pb.Report) error
 
+	// Propagate my inference to the peers interested in its subject
+	PropagateInference(inference *pb.Inference) error
+
+	// Check if a propagated request was learned before, and remember it if not
+	Seen(request *pb.LearnReportRequest) bool
+
+	// Relay a gossiped request to more peers if it has rounds left
+	Relay(request *pb.LearnReportRequest) error
+
+	// Let others know about a new or updated maintenance window
+	PropagateSilence(silence *pb.Silence) error
+
 	// Let others know I'd like to subscribe to reports about subject
 	Subscribe(subject string) error
 
 	// Let others know I'd like to unsubscribe to reports about subject
 	Unsubscribe(subject string) error
 
+	// Get the queue depth and counters of the senders to peers
+	GetQueues() map[string]*pb.PeerQueue
+
+	// Ask a peer for the observations missing from my digest
+	Sync(peer string, request *pb.SyncRequest) (*pb.SyncReply, error)
+
+	// Get a snapshot of the current peers' id and address
+	GetPeers() map[string]string
+
+	// Get the current members, and optionally the removed ones
+	GetMembers(removed bool) []*pb.Member
+
+	// Apply a membership change if it is newer than what is known about
+	// the peer, return whether it is applied
+	UpdateMember(member *pb.Member) bool
+
+	// Let others know about a membership change
+	PropagateMember(member *pb.Member) error
+
+	// Join the cluster through the instance at addr, get all the members
+	Join(addr string) ([]*pb.Member, error)
+
+	// Whether reports are sent only to the owners of their subjects
+	Sharded() bool
+
+	// Get the peers that own a subject in sharded mode, the primary first
+	Owners(subject string) []string
+
+	// Check if I own a subject, always true if not sharded
+	IsOwner(subject string) bool
+
+	// Get a client to a live owner of a subject to proxy a query to, nil
+	// if I own the subject
+	OwnerClient(subject string) (string, pb.HealthServiceClient, error)
+
+	// Get the liveness of the peers from the failure detector
+	GetPeerStatus() []*pb.PeerStatus
+
+	// Add a listener to be notified about the liveness of peers
+	AddPeerListener(listener PeerStatusListener)
+
+	// Reach the peers through another transport, must be called before Start
+	SetTransport(transport dc.Transport)
+
+	// Get a client to query a peer
+	Client(peer string) (pb.HealthServiceClient, error)
+
 	// Ping one peer and get a response
 	Ping(peer string) (*pb.PingReply, error)
 
 	// Ping all peers and get response
 	PingAll() (map[string]*pb.PingReply, error)
 
-	// peer is interested in a particular subject
-	Interested(peer string, subject string) bool
+	// peer is interested in a particular subject for the duration of a
+	// lease, the default duration if zero
+	Interested(peer string, subject string, lease time.Duration) bool
 
 	// peer is not interested in a particular subject
 	Uninterested(peer string, subject string) bool
+
+	// Keep the leases of the subscribed peers in a database and load the
+	// ones that have not expired
+	SetDB(db HealthDB)
+
+	// Get the leases of the peers subscribed to subjects
+	GetLeases() []*pb.Lease
+
+	// Drop the leases that expired, return the number dropped
+	ExpireLeases() int
 }